@@ -0,0 +1,229 @@
+package sqpulser
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// AggregateFormat is the body format of the aggregated outgoing message.
+type AggregateFormat string
+
+const (
+	// AggregateFormatNone disables aggregation, each message is emitted individually.
+	AggregateFormatNone AggregateFormat = ""
+	// AggregateFormatJSON is a JSON array of AggregatedEntry.
+	AggregateFormatJSON AggregateFormat = "json"
+	// AggregateFormatNDJSON is newline-delimited JSON of AggregatedEntry.
+	AggregateFormatNDJSON AggregateFormat = "ndjson"
+)
+
+// ParseAggregateFormat parses the aggregate format string.
+func ParseAggregateFormat(str string) (AggregateFormat, error) {
+	switch f := AggregateFormat(strings.ToLower(str)); f {
+	case AggregateFormatNone, AggregateFormatJSON, AggregateFormatNDJSON:
+		return f, nil
+	default:
+		return AggregateFormatNone, fmt.Errorf("unknown aggregate format `%s`", str)
+	}
+}
+
+// AggregatedEntry is an original message compiled into the aggregated outgoing message.
+type AggregatedEntry struct {
+	MessageID         string                         `json:"messageId"`
+	SentTimestamp     int64                          `json:"sentTimestamp"`
+	Body              string                         `json:"body"`
+	MessageAttributes map[string]AggregatedAttribute `json:"messageAttributes,omitempty"`
+}
+
+// AggregatedAttribute is a message attribute of AggregatedEntry.
+type AggregatedAttribute struct {
+	DataType    string  `json:"dataType"`
+	StringValue *string `json:"stringValue,omitempty"`
+	BinaryValue []byte  `json:"binaryValue,omitempty"`
+}
+
+func newAggregatedEntry(p *pendingMessage) *AggregatedEntry {
+	entry := &AggregatedEntry{
+		MessageID:     p.original.MessageID,
+		SentTimestamp: p.original.SentTimestamp,
+		Body:          aws.ToString(p.msg.Body),
+	}
+	for key, value := range p.msg.MessageAttributes {
+		// the late attribute is delivered, and the others are recorded in the entry itself or used only for resending.
+		if sqpulserAttributeKeys[key] && key != LateAttributeKey {
+			continue
+		}
+		if entry.MessageAttributes == nil {
+			entry.MessageAttributes = make(map[string]AggregatedAttribute, len(p.msg.MessageAttributes))
+		}
+		entry.MessageAttributes[key] = AggregatedAttribute{
+			DataType:    aws.ToString(value.DataType),
+			StringValue: value.StringValue,
+			BinaryValue: value.BinaryValue,
+		}
+	}
+	if p.late {
+		if entry.MessageAttributes == nil {
+			entry.MessageAttributes = make(map[string]AggregatedAttribute, 1)
+		}
+		entry.MessageAttributes[LateAttributeKey] = AggregatedAttribute{
+			DataType:    "String",
+			StringValue: aws.String("true"),
+		}
+	}
+	return entry
+}
+
+// DecodeAggregatedBody decodes the body of the aggregated outgoing message.
+func (f AggregateFormat) DecodeAggregatedBody(body string) ([]*AggregatedEntry, error) {
+	var entries []*AggregatedEntry
+	switch f {
+	case AggregateFormatJSON:
+		if err := json.Unmarshal([]byte(body), &entries); err != nil {
+			return nil, err
+		}
+	case AggregateFormatNDJSON:
+		scanner := bufio.NewScanner(strings.NewReader(body))
+		scanner.Buffer(make([]byte, 0, 64*1024), sqsMaxMessageSize)
+		for scanner.Scan() {
+			var entry AggregatedEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				return nil, err
+			}
+			entries = append(entries, &entry)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("can not decode aggregate format `%s`", f)
+	}
+	return entries, nil
+}
+
+// aggregatedChunk is a part of a window that fits into one outgoing message.
+type aggregatedChunk struct {
+	body    string
+	members []*pendingMessage
+}
+
+func (f AggregateFormat) encodeChunks(members []*pendingMessage, maxBodySize int) ([]*aggregatedChunk, error) {
+	var (
+		opening, sep, closing string
+		chunks                []*aggregatedChunk
+		current               *aggregatedChunk
+		b                     strings.Builder
+	)
+	switch f {
+	case AggregateFormatJSON:
+		opening, sep, closing = "[", ",", "]"
+	case AggregateFormatNDJSON:
+		sep = "\n"
+	default:
+		return nil, fmt.Errorf("can not encode aggregate format `%s`", f)
+	}
+	flush := func() {
+		if current == nil {
+			return
+		}
+		b.WriteString(closing)
+		current.body = b.String()
+		chunks = append(chunks, current)
+		current = nil
+		b.Reset()
+	}
+	for _, p := range members {
+		encoded, err := json.Marshal(newAggregatedEntry(p))
+		if err != nil {
+			return nil, fmt.Errorf("marshal message %s: %w", *p.msg.MessageId, err)
+		}
+		if current != nil && b.Len()+len(sep)+len(encoded)+len(closing) > maxBodySize {
+			flush()
+		}
+		if current == nil {
+			current = &aggregatedChunk{}
+			b.WriteString(opening)
+		} else {
+			b.WriteString(sep)
+		}
+		b.Write(encoded)
+		current.members = append(current.members, p)
+	}
+	flush()
+	return chunks, nil
+}
+
+// headroom for the message attributes of the aggregated outgoing message.
+const aggregateMaxBodySize = sqsMaxMessageSize - 1024
+
+// aggregateWindow is the key of messages compiled into the same outgoing messages.
+type aggregateWindow struct {
+	dest          *destination
+	emitTimestamp int64
+}
+
+// aggregate compiles due messages of the same destination and emit time into outgoing messages.
+// If messages can not be compiled, the errors are set to errs.
+func (app *App) aggregate(due []*pendingMessage, errs []error) []*sendRequest {
+	windows := make(map[aggregateWindow][]*pendingMessage)
+	var keys []aggregateWindow
+	for _, p := range due {
+		key := aggregateWindow{dest: p.dest, emitTimestamp: p.emitTime.UnixMilli()}
+		if _, ok := windows[key]; !ok {
+			keys = append(keys, key)
+		}
+		windows[key] = append(windows[key], p)
+	}
+	var requests []*sendRequest
+	for _, key := range keys {
+		members := windows[key]
+		chunks, err := app.opt.AggregateFormat.encodeChunks(members, aggregateMaxBodySize)
+		if err != nil {
+			for _, p := range members {
+				errs[p.index] = fmt.Errorf("aggregate: %w", err)
+			}
+			continue
+		}
+		for _, chunk := range chunks {
+			requests = append(requests, app.newAggregatedSendRequest(key.dest, key.emitTimestamp, chunk))
+		}
+	}
+	return requests
+}
+
+func (app *App) newAggregatedSendRequest(dest *destination, emitTimestamp int64, chunk *aggregatedChunk) *sendRequest {
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(dest.queueURL),
+		MessageBody: aws.String(chunk.body),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			EmitTimestampAttributeKey: {
+				DataType:    aws.String("Number"),
+				StringValue: aws.String(fmt.Sprintf("%d", emitTimestamp)),
+			},
+			AggregatedMessageCountAttributeKey: {
+				DataType:    aws.String("Number"),
+				StringValue: aws.String(fmt.Sprintf("%d", len(chunk.members))),
+			},
+		},
+	}
+	if dest.sink != nil || isFIFOQueue(dest.queueURL) {
+		setAggregatedFIFOParameters(input, chunk.members)
+	}
+	for _, p := range chunk.members {
+		app.logf("[info][%s] aggregate into a message of %d messages, emitTime=%s", *p.msg.MessageId, len(chunk.members), p.emitTime)
+	}
+	if dest.sink != nil {
+		input.QueueUrl = nil
+	}
+	return &sendRequest{
+		input:   input,
+		members: chunk.members,
+		sink:    dest.sink,
+	}
+}
@@ -0,0 +1,166 @@
+package sqpulser_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testIncomingQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/012345678900/sqpulser-in"
+	testOutgoingQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/012345678900/sqpulser-out"
+)
+
+func TestHandleMessagesAggregate(t *testing.T) {
+	for _, format := range []sqpulser.AggregateFormat{sqpulser.AggregateFormatJSON, sqpulser.AggregateFormatNDJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+			defer restore()
+
+			client := &fakeSQSClient{}
+			app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+				IncomingQueueURL: testIncomingQueueURL,
+				OutgoingQueueURL: testOutgoingQueueURL,
+				EmitInterval:     15 * time.Minute,
+				AggregateFormat:  format,
+				StateStore:       sqpulser.NewMemoryStateStore(),
+			})
+			require.NoError(t, err)
+			msgs := []types.Message{
+				newTestMessage("msg-1", `{"id":1}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+					"Foo": {DataType: aws.String("String"), StringValue: aws.String("bar")},
+				}),
+				newTestMessage("msg-2", `{"id":2}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")).UnixMilli(), nil),
+				newTestMessage("msg-3", `{"id":3}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:30:58Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+					sqpulser.OriginalMessageIDAttributeKey: {
+						DataType:    aws.String("String"),
+						StringValue: aws.String("original-3"),
+					},
+					sqpulser.OriginalMessageSentTimestampAttributeKey: {
+						DataType:    aws.String("Number"),
+						StringValue: aws.String("1545081900000"), // 2018-12-17T21:25:00Z
+					},
+				}),
+				newTestMessage("msg-4", `{"id":4}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:10:00Z")).UnixMilli(), nil),
+			}
+			errs := app.HandleMessages(context.Background(), msgs)
+			require.Equal(t, []error{nil, nil, nil, nil}, errs)
+			// the due messages are buffered, and a flush message is sent per emit window.
+			require.Len(t, client.sent, 3)
+			require.Equal(t, testIncomingQueueURL, *client.sent[0].QueueUrl)
+			require.Contains(t, *client.sent[0].MessageAttributes[sqpulser.FlushAttributeKey].StringValue, "/1545082200000")
+			require.EqualValues(t, 60, client.sent[0].DelaySeconds)
+			require.Contains(t, *client.sent[1].MessageAttributes[sqpulser.FlushAttributeKey].StringValue, "/1545081300000")
+
+			require.Equal(t, testIncomingQueueURL, *client.sent[2].QueueUrl)
+			require.Equal(t, `{"id":2}`, *client.sent[2].MessageBody)
+			require.EqualValues(t, 14*60, client.sent[2].DelaySeconds)
+
+			// a message of the same window in another receive is compiled into the same outgoing message.
+			errs = app.HandleMessages(context.Background(), []types.Message{
+				newTestMessage("msg-5", `{"id":5}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:29:00Z")).UnixMilli(), nil),
+			})
+			require.Equal(t, []error{nil}, errs)
+			require.Len(t, client.sent, 3)
+
+			flushes := flushMessages(client)
+			require.Len(t, flushes, 2)
+			// the flush message received before the flush delay is held.
+			errs = app.HandleMessages(context.Background(), flushes[:1])
+			require.ErrorIs(t, errs[0], sqpulser.ErrMessageHeld)
+			require.Len(t, client.changed, 1)
+			require.EqualValues(t, 60, client.changed[0].VisibilityTimeout)
+
+			flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")))
+			errs = app.HandleMessages(context.Background(), flushes)
+			require.Equal(t, []error{nil, nil}, errs)
+			require.Len(t, client.sent, 5)
+
+			require.Equal(t, testOutgoingQueueURL, *client.sent[3].QueueUrl)
+			require.Equal(t, "1545082200000", *client.sent[3].MessageAttributes[sqpulser.EmitTimestampAttributeKey].StringValue)
+			require.Equal(t, "3", *client.sent[3].MessageAttributes[sqpulser.AggregatedMessageCountAttributeKey].StringValue)
+			entries, err := format.DecodeAggregatedBody(*client.sent[3].MessageBody)
+			require.NoError(t, err)
+			// in the order in which the messages joined the window.
+			require.EqualValues(t, []*sqpulser.AggregatedEntry{
+				{
+					MessageID:     "msg-1",
+					SentTimestamp: 1545081600000,
+					Body:          `{"id":1}`,
+					MessageAttributes: map[string]sqpulser.AggregatedAttribute{
+						"Foo": {DataType: "String", StringValue: aws.String("bar")},
+					},
+				},
+				{
+					MessageID:     "original-3",
+					SentTimestamp: 1545081900000,
+					Body:          `{"id":3}`,
+				},
+				{
+					MessageID:     "msg-5",
+					SentTimestamp: 1545082140000,
+					Body:          `{"id":5}`,
+				},
+			}, entries)
+
+			require.Equal(t, testOutgoingQueueURL, *client.sent[4].QueueUrl)
+			require.Equal(t, "1545081300000", *client.sent[4].MessageAttributes[sqpulser.EmitTimestampAttributeKey].StringValue)
+			require.Equal(t, "1", *client.sent[4].MessageAttributes[sqpulser.AggregatedMessageCountAttributeKey].StringValue)
+
+			// the window is flushed only once.
+			errs = app.HandleMessages(context.Background(), flushes)
+			require.Equal(t, []error{nil, nil}, errs)
+			require.Len(t, client.sent, 5)
+		})
+	}
+}
+
+func TestNewWithClientAggregateWithoutStateStore(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		AggregateFormat:  sqpulser.AggregateFormatJSON,
+	})
+	require.EqualError(t, err, "aggregate requires state store or state table, to buffer messages of an emit window")
+}
+
+func TestHandleMessagesAggregateSplitLargeWindow(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		AggregateFormat:  sqpulser.AggregateFormatJSON,
+		StateStore:       sqpulser.NewMemoryStateStore(),
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli()
+	body := strings.Repeat("x", 100*1024)
+	msgs := []types.Message{
+		newTestMessage("msg-1", body, sentTimestamp, nil),
+		newTestMessage("msg-2", body, sentTimestamp, nil),
+		newTestMessage("msg-3", body, sentTimestamp, nil),
+	}
+	errs := app.HandleMessages(context.Background(), msgs)
+	require.Equal(t, []error{nil, nil, nil}, errs)
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")))
+	errs = app.HandleMessages(context.Background(), flushMessages(client))
+	require.Equal(t, []error{nil}, errs)
+	require.Len(t, client.sent, 3)
+	require.Equal(t, "2", *client.sent[1].MessageAttributes[sqpulser.AggregatedMessageCountAttributeKey].StringValue)
+	require.Equal(t, "1", *client.sent[2].MessageAttributes[sqpulser.AggregatedMessageCountAttributeKey].StringValue)
+	for _, input := range client.sent[1:] {
+		require.LessOrEqual(t, len(*input.MessageBody), 256*1024)
+	}
+}
@@ -5,17 +5,22 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
-	"os/signal"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/Songmu/flextime"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 )
@@ -28,18 +33,126 @@ type Option struct {
 	OutgoingQueueName string
 	EmitInterval      time.Duration
 	Offset            time.Duration
+	// Schedule overrides EmitInterval and Offset if set.
+	Schedule Schedule
+	// Location is the time zone in which emit times are computed. default is UTC.
+	Location *time.Location
+	// AggregateFormat enables to compile messages of the same emit time into one outgoing message.
+	// Due messages are buffered in StateStore until the emit window is flushed, so it requires StateStore or StateTable.
+	AggregateFormat AggregateFormat
+	// FlushDelay is the duration from the first due message of an emit window to the flush of the window,
+	// to wait for the other messages of the window. default is DefaultFlushDelay, and at most 15 minutes.
+	FlushDelay time.Duration
+	// MinEmitInterval and MaxEmitInterval bound the emit interval overridden by message attributes. zero means unbounded.
+	MinEmitInterval time.Duration
+	MaxEmitInterval time.Duration
+	// MaxEmitDelay bounds the duration from the sent time to the emit time overridden by message attributes. default is DefaultMaxEmitDelay.
+	MaxEmitDelay time.Duration
+	// Concurrency is the number of polling loops run in parallel. default is 1.
+	Concurrency int
+	// OutgoingTopicARN is the SNS topic to which messages are published instead of the outgoing queue.
+	OutgoingTopicARN string
+	// SNSClient publishes messages to SNS topics. New creates it from the aws config.
+	SNSClient SNSClient
+	// OutgoingEventBusName is the EventBridge event bus name or ARN to which messages are put as events instead of the outgoing queue.
+	OutgoingEventBusName string
+	// EventSource and EventDetailType are the source and the detail type of events. default is `sqpulser` and `Sqpulser Message`.
+	EventSource     string
+	EventDetailType string
+	// EventBridgeClient puts events to EventBridge event buses. New creates it from the aws config.
+	EventBridgeClient EventBridgeClient
+	// OutgoingWebhookURL is the HTTP endpoint to which messages are posted instead of the outgoing queue.
+	OutgoingWebhookURL string
+	Webhook            WebhookOption
+	// HTTPClient posts messages to webhooks. default is http.DefaultClient.
+	HTTPClient *http.Client
+	// OutgoingStream is the Kinesis data stream name or ARN to which messages are put instead of the outgoing queue.
+	// Due messages are buffered in StateStore until the emit window is flushed, so it requires StateStore or StateTable.
+	OutgoingStream string
+	// PartitionKeyAttribute is the message attribute used as the partition key of Kinesis records.
+	// If the message does not have it, the original message id is used.
+	PartitionKeyAttribute string
+	// KinesisClient puts records to Kinesis data streams. New creates it from the aws config.
+	KinesisClient KinesisClient
+	// OutgoingBucket is the S3 bucket to which messages of the same emit time are written as an object instead of the outgoing queue.
+	OutgoingBucket string
+	// S3KeyTemplate is the object key template parsed by ParseS3KeyTemplate.
+	S3KeyTemplate string
+	// S3Gzip compresses objects by gzip.
+	S3Gzip bool
+	// S3Client puts objects to S3 buckets and gets large payloads. New creates it from the aws config.
+	S3Client S3Client
+	// LargePayload is the large payload support by the Amazon SQS Extended Client convention.
+	LargePayload LargePayloadOption
+	// MaxHops is the max number of times a message is resent to the incoming queue. 0 means unlimited.
+	MaxHops int
+	// MaxTotalDelay is the max duration from the original sent time to the emit time. 0 means unlimited.
+	MaxTotalDelay time.Duration
+	// DeadLetterQueueURL or DeadLetterQueueName is the queue to which messages violating MaxHops or MaxTotalDelay are sent.
+	// If empty, such messages are left in the incoming queue.
+	DeadLetterQueueURL  string
+	DeadLetterQueueName string
+	// MaxLateness is the max duration from the emit time to the actual delivery. 0 means unlimited.
+	// Messages also expire at the time of the SqpulserExpiresAt attribute.
+	MaxLateness time.Duration
+	// LatePolicy decides what to do with expired messages, default is LatePolicyDeliver.
+	LatePolicy LatePolicy
+	// CatchUp decides when messages of the pulses missed before start are emitted, default is CatchUpImmediate.
+	CatchUp CatchUpPolicy
+	// CatchUpStart is the start of the catch-up, e.g. the end of the downtime, before which pulses are missed.
+	// If zero, the start is shared by the processes in StateStore, and it is the start of the process without StateStore.
+	CatchUpStart time.Time
+	// Spread spreads emissions after the pulse. It can not be used with aggregation.
+	Spread SpreadOption
+	// DedupKey is the message attribute name or JSONPath into the body (e.g. `$.entity.id`) to deduplicate messages by.
+	// Only one message per key per emit window is delivered.
+	DedupKey string
+	// DedupKeep decides which message of the same key is delivered, default is DedupKeepFirst.
+	DedupKeep DedupKeep
+	// StateStore is the durable state shared by multiple processes, e.g. for deduplication.
+	// Without it, messages are deduplicated only in the process.
+	StateStore StateStore
+	// StateTable is the DynamoDB table name of DynamoDBStateStore, used when StateStore is nil.
+	StateTable string
+	// DynamoDBClient reads and writes the state table. New creates it from the aws config.
+	DynamoDBClient DynamoDBClient
+	// Routing routes messages to multiple outgoing queues instead of OutgoingQueueURL.
+	Routing *RoutingConfig
+	// Name is the log prefix. default is empty, or the incoming queue name in Pipelines.
+	Name string
+	// MetricsAddr is the address to serve Prometheus metrics on /metrics, e.g. `:9090`. If empty, metrics are not recorded.
+	// It is not served in Lambda.
+	MetricsAddr string
+	// EMF writes CloudWatch Embedded Metric Format log lines per invocation in Lambda.
+	EMF EMFOption
+	// Pipelines polls multiple incoming queues in one App instead of IncomingQueueURL.
+	// The zero value fields of each pipeline are inherited from this option.
+	Pipelines []*Option
 }
 
 type SQSClient interface {
 	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
 	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
 	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	SendMessageBatch(ctx context.Context, params *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error)
+	DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+	GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
 	GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error)
 }
 
 type App struct {
-	client SQSClient
-	opt    *Option
+	client    SQSClient
+	opt       *Option
+	name      string
+	router    *router
+	pipelines []*App
+	catchUp   *catchUp
+	spreader  *spreader
+	dedupKey  *dedupKey
+	// dedupStore records the delivered messages by the dedup key, Option.StateStore or the one in memory.
+	dedupStore StateStore
+	metrics    *metrics
 }
 
 func New(ctx context.Context, opt *Option, optFns ...func(*config.LoadOptions) error) (*App, error) {
@@ -48,10 +161,39 @@ func New(ctx context.Context, opt *Option, optFns ...func(*config.LoadOptions) e
 		return nil, err
 	}
 	client := sqs.NewFromConfig(c)
+	if opt.SNSClient == nil {
+		opt.SNSClient = sns.NewFromConfig(c)
+	}
+	if opt.EventBridgeClient == nil {
+		opt.EventBridgeClient = eventbridge.NewFromConfig(c)
+	}
+	if opt.KinesisClient == nil {
+		opt.KinesisClient = kinesis.NewFromConfig(c)
+	}
+	if opt.S3Client == nil {
+		opt.S3Client = s3.NewFromConfig(c)
+	}
+	if opt.DynamoDBClient == nil {
+		opt.DynamoDBClient = dynamodb.NewFromConfig(c)
+	}
 	return NewWithClient(ctx, client, opt)
 }
 
 func NewWithClient(ctx context.Context, client SQSClient, opt *Option) (*App, error) {
+	if len(opt.Pipelines) > 0 {
+		app := &App{
+			client: client,
+			opt:    opt,
+			name:   opt.Name,
+		}
+		if opt.MetricsAddr != "" {
+			app.metrics = newMetrics()
+		}
+		if err := app.newPipelines(ctx); err != nil {
+			return nil, err
+		}
+		return app, nil
+	}
 	if opt.IncomingQueueURL == "" && opt.IncomingQueueName == "" {
 		return nil, errors.New("either incoming queue url or incoming quene name is required")
 	}
@@ -65,10 +207,18 @@ func NewWithClient(ctx context.Context, client SQSClient, opt *Option) (*App, er
 		}
 		opt.IncomingQueueURL = *output.QueueUrl
 	}
-	if opt.OutgoingQueueURL == "" && opt.OutgoingQueueName == "" {
-		return nil, errors.New("either outgoing queue url or outgoing quene name is required")
+	hasOutgoingQueue := opt.OutgoingQueueURL != "" || opt.OutgoingQueueName != ""
+	outgoingSinks := opt.outgoingSinkCount()
+	if opt.Routing != nil && (hasOutgoingQueue || outgoingSinks > 0) {
+		return nil, errors.New("outgoing queue can not be used with routing, define destinations in routing config instead")
+	}
+	if (hasOutgoingQueue && outgoingSinks > 0) || outgoingSinks > 1 {
+		return nil, errors.New("only one outgoing destination can be used")
+	}
+	if opt.Routing == nil && !hasOutgoingQueue && outgoingSinks == 0 {
+		return nil, errors.New("either outgoing queue url, outgoing quene name or other outgoing destination is required")
 	}
-	if opt.OutgoingQueueURL == "" {
+	if opt.Routing == nil && hasOutgoingQueue && opt.OutgoingQueueURL == "" {
 		log.Printf("[info] try get outgoing queue url: queue name `%s`", opt.OutgoingQueueName)
 		output, err := client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
 			QueueName: aws.String(opt.OutgoingQueueName),
@@ -78,76 +228,265 @@ func NewWithClient(ctx context.Context, client SQSClient, opt *Option) (*App, er
 		}
 		opt.OutgoingQueueURL = *output.QueueUrl
 	}
+	if opt.DeadLetterQueueURL == "" && opt.DeadLetterQueueName != "" {
+		log.Printf("[info] try get dead-letter queue url: queue name `%s`", opt.DeadLetterQueueName)
+		output, err := client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+			QueueName: aws.String(opt.DeadLetterQueueName),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can not get dead-letter queue url: %w", err)
+		}
+		opt.DeadLetterQueueURL = *output.QueueUrl
+	}
+	schedule := opt.Schedule
+	if schedule == nil && opt.EmitInterval > 0 {
+		schedule = IntervalSchedule{
+			Interval: opt.EmitInterval,
+			Offset:   opt.Offset,
+		}
+	}
 	app := &App{
 		client: client,
 		opt:    opt,
+		name:   opt.Name,
+	}
+	if opt.MetricsAddr != "" {
+		app.metrics = newMetrics()
+		app.metrics.watch(app)
+	}
+	if err := app.checkLargePayload(); err != nil {
+		return nil, err
+	}
+	latePolicy, err := ParseLatePolicy(string(opt.LatePolicy))
+	if err != nil {
+		return nil, err
+	}
+	app.opt.LatePolicy = latePolicy
+	if latePolicy == LatePolicyDeadLetter && opt.DeadLetterQueueURL == "" {
+		return nil, errors.New("late policy dead-letter requires dead-letter queue url or name")
+	}
+	switch {
+	case opt.MaxEmitDelay == 0:
+		opt.MaxEmitDelay = DefaultMaxEmitDelay
+	case opt.MaxEmitDelay < 0:
+		return nil, fmt.Errorf("max emit delay %s must be positive", opt.MaxEmitDelay)
+	}
+	if app.opt.CatchUp, err = ParseCatchUpPolicy(string(opt.CatchUp)); err != nil {
+		return nil, err
+	}
+	if app.spreader, err = newSpreader(opt.Spread); err != nil {
+		return nil, err
+	}
+	if app.spreader != nil && opt.AggregateFormat != AggregateFormatNone {
+		return nil, errors.New("spread can not be used with aggregate")
+	}
+	if app.opt.DedupKeep, err = ParseDedupKeep(string(opt.DedupKeep)); err != nil {
+		return nil, err
+	}
+	if opt.StateStore == nil && opt.StateTable != "" {
+		if opt.DynamoDBClient == nil {
+			return nil, fmt.Errorf("DynamoDB client is required to use state table %s", opt.StateTable)
+		}
+		opt.StateStore = NewDynamoDBStateStore(opt.DynamoDBClient, opt.StateTable)
+	}
+	if opt.AggregateFormat != AggregateFormatNone && opt.StateStore == nil {
+		return nil, errors.New("aggregate requires state store or state table, to buffer messages of an emit window")
+	}
+	if opt.FlushDelay > sqsMaxDelaySeconds*time.Second {
+		return nil, fmt.Errorf("flush delay %s exceeds %ds", opt.FlushDelay, sqsMaxDelaySeconds)
+	}
+	if opt.DedupKey != "" {
+		if app.dedupKey, err = parseDedupKey(opt.DedupKey); err != nil {
+			return nil, err
+		}
+		// without the state store, messages are deduplicated only in the process.
+		app.dedupStore = opt.StateStore
+		if app.dedupStore == nil {
+			app.dedupStore = NewMemoryStateStore()
+		}
+	}
+	if opt.Routing != nil {
+		r, err := app.newRouter(ctx, opt.Routing, schedule)
+		if err != nil {
+			return nil, fmt.Errorf("routing: %w", err)
+		}
+		app.router = r
+	} else {
+		if schedule == nil {
+			return nil, errors.New("emit interval must be positive")
+		}
+		dest := &destination{
+			queueURL: opt.OutgoingQueueURL,
+			schedule: schedule,
+		}
+		sink, err := app.newOutgoingSink()
+		if err != nil {
+			return nil, err
+		}
+		dest.sink = sink
+		app.router = &router{
+			logf:     app.logf,
+			defaults: []*destination{dest},
+		}
+	}
+	if opt.StateStore == nil {
+		dests := append([]*destination{}, app.router.defaults...)
+		for _, dest := range app.router.destinations {
+			dests = append(dests, dest)
+		}
+		for _, dest := range dests {
+			if app.windowed(dest) {
+				return nil, fmt.Errorf("%s requires state store or state table, to emit messages once per emit window", dest.sink)
+			}
+		}
+	}
+	if app.catchUp, err = app.newCatchUp(ctx); err != nil {
+		return nil, err
+	}
+	if isFIFOQueue(opt.IncomingQueueURL) {
+		if err := app.checkFIFOHold(ctx); err != nil {
+			return nil, err
+		}
 	}
 	return app, nil
 }
 
+func (app *App) inLocation(schedule Schedule) Schedule {
+	if app.opt.Location == nil {
+		return schedule
+	}
+	return InLocation(schedule, app.opt.Location)
+}
+
+// Run polls the incoming queue until ctx is done, or starts the Lambda handler in Lambda.
+// When ctx is done, Run stops receiving new messages, and returns after in-flight messages are handled and deleted.
+// The caller cancels ctx on SIGTERM, e.g. by signal.NotifyContext.
 func (app *App) Run(ctx context.Context) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
 	if strings.HasPrefix(os.Getenv("AWS_EXECUTION_ENV"), "AWS_Lambda") || os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
-		log.Printf("[info] start lambda handler")
+		app.logf("[info] start lambda handler")
 		lambda.Start(app.LambdaHandler)
 		return nil
 	}
-	return app.run(ctx)
+	// in-flight messages are handled with the values of ctx, but not canceled by ctx.
+	handleCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	if app.opt.MetricsAddr != "" {
+		if err := app.serveMetrics(handleCtx); err != nil {
+			return fmt.Errorf("serve metrics on %s: %w", app.opt.MetricsAddr, err)
+		}
+	}
+	return app.run(handleCtx, ctx)
 }
 
-func (app *App) run(ctx context.Context) error {
-	var trapSignals = []os.Signal{
-		syscall.SIGHUP,
-		syscall.SIGINT,
-		syscall.SIGTERM,
+// run polls the incoming queue until receiveCtx is done, and handles received messages with ctx.
+func (app *App) run(ctx context.Context, receiveCtx context.Context) error {
+	if len(app.pipelines) > 0 {
+		return app.runPipelines(ctx, receiveCtx)
+	}
+	concurrency := app.opt.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// on a permanent error of any polling loop, stop the others and exit.
+	receiveCtx, abort := context.WithCancel(receiveCtx)
+	defer abort()
+	var (
+		once     sync.Once
+		firstErr error
+	)
+	app.logf("[info] start polling: %s concurrency=%d", app.opt.IncomingQueueURL, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := app.poll(ctx, receiveCtx); err != nil {
+				once.Do(func() {
+					firstErr = err
+					abort()
+				})
+			}
+		}()
 	}
-	ctx, stop := signal.NotifyContext(ctx, trapSignals...)
-	defer stop()
+	wg.Wait()
+	app.logf("[info] stop polling: %s", app.opt.IncomingQueueURL)
+	return firstErr
+}
 
-	log.Printf("[info] start polling: %s ", app.opt.IncomingQueueURL)
+// poll receives, handles and deletes messages until receiveCtx is done.
+// Throttling and transient errors of receive are retried with exponential backoff, and a permanent error of receive is returned.
+// Errors of handling messages fail only the messages.
+func (app *App) poll(ctx context.Context, receiveCtx context.Context) error {
+	var b backoff
 	for {
 		select {
-		case <-ctx.Done():
+		case <-receiveCtx.Done():
 			return nil
 		default:
 		}
-		output, err := app.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
-			MaxNumberOfMessages:   1,
-			QueueUrl:              aws.String(app.opt.IncomingQueueURL),
-			MessageAttributeNames: []string{"All"},
-			AttributeNames:        []types.QueueAttributeName{"All"},
-		})
+		msgs, err := app.receiveMessages(receiveCtx)
 		if err != nil {
-			if errors.Is(err, context.Canceled) && errors.Is(err, context.DeadlineExceeded) {
-				log.Printf("[warn] recive message: %v", err)
-				time.Sleep(time.Second)
+			switch class := classifyError(err); class {
+			case errorClassCanceled:
+				if receiveCtx.Err() != nil {
+					return nil
+				}
+				// e.g. http client timeout, retry as a transient error.
+				fallthrough
+			case errorClassTransient, errorClassThrottling:
+				wait := b.next()
+				app.logf("[warn] recive message: %s error, retry after %s: %v", class, wait, err)
+				if !sleepContext(receiveCtx, wait) {
+					return nil
+				}
+				continue
+			default:
+				return fmt.Errorf("recive message from %s: %w", app.opt.IncomingQueueURL, err)
 			}
-			continue
 		}
-		for _, msg := range output.Messages {
-			log.Printf("[info][%s] recive message handle=%s", *msg.MessageId, *msg.ReceiptHandle)
-			m := msg
-			if err := app.HandleMessage(ctx, &m); err != nil {
-				log.Printf("[error][%s] failed to handle message. %v", *msg.MessageId, err)
+		b.reset()
+		for _, msg := range msgs {
+			app.logf("[info][%s] recive message handle=%s", *msg.MessageId, *msg.ReceiptHandle)
+		}
+		errs, reports := app.handleMessages(ctx, msgs, nil)
+		handled := make([]types.Message, 0, len(msgs))
+		for i, msg := range msgs {
+			if errors.Is(errs[i], ErrMessageHeld) {
 				continue
 			}
-			if _, err := app.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
-				QueueUrl:      aws.String(app.opt.IncomingQueueURL),
-				ReceiptHandle: aws.String(*m.ReceiptHandle),
-			}); err != nil {
-				log.Printf("[error][%s] failed to delete message:%v, handle=%s", *msg.MessageId, err, *msg.ReceiptHandle)
+			if errs[i] != nil {
+				// the failed message is received again after the visibility timeout, or moved by the redrive policy.
+				// even a permanent error, e.g. of a destination, fails only the message and does not stop polling.
+				app.logf("[error][%s] failed to handle message, %s error. %v", *msg.MessageId, classifyError(errs[i]), errs[i])
 				continue
 			}
-			log.Printf("[info][%s] success", *msg.MessageId)
+			handled = append(handled, msg)
 		}
+		app.cleanupLargePayloads(ctx, reports, app.deleteBatch(ctx, handled))
+	}
+}
+
+func (app *App) receiveMessages(ctx context.Context) ([]types.Message, error) {
+	output, err := app.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		MaxNumberOfMessages:   sqsMaxBatchEntries,
+		WaitTimeSeconds:       sqsLongPollingSeconds,
+		QueueUrl:              aws.String(app.opt.IncomingQueueURL),
+		MessageAttributeNames: []string{"All"},
+		AttributeNames:        []types.QueueAttributeName{"All"},
+	})
+	if err != nil {
+		return nil, err
 	}
+	return output.Messages, nil
 }
 
 const (
 	OriginalMessageSentTimestampAttributeKey = "OriginalSentTimestamp"
 	OriginalMessageIDAttributeKey            = "OriginalMessageID"
+	EmitTimestampAttributeKey                = "EmitTimestamp"
+	AggregatedMessageCountAttributeKey       = "AggregatedMessageCount"
 	sqsMaxDelaySeconds                       = 900
+	sqsMaxMessageSize                        = 262144
 )
 
 type OriginalAttributes struct {
@@ -156,52 +495,343 @@ type OriginalAttributes struct {
 }
 
 func (app *App) HandleMessage(ctx context.Context, msg *types.Message) error {
-	log.Printf("[debug][%s] received message: %v", *msg.MessageId, *msg)
+	return app.HandleMessages(ctx, []types.Message{*msg})[0]
+}
+
+// HandleMessages handles received messages and returns an error for each message.
+// The messages whose error is nil can be deleted from the incoming queue.
+func (app *App) HandleMessages(ctx context.Context, msgs []types.Message) []error {
+	errs, _ := app.handleMessages(ctx, msgs, nil)
+	return errs
+}
+
+// handleMessages handles received messages, dispatched to pipelines by the event source ARNs,
+// and returns an error for each message and the report of each app which handled them.
+func (app *App) handleMessages(ctx context.Context, msgs []types.Message, eventSourceARNs []string) ([]error, []*handleReport) {
+	if len(app.pipelines) > 0 {
+		return app.handlePipelineMessages(ctx, msgs, eventSourceARNs)
+	}
+	start := time.Now()
+	errs := make([]error, len(msgs))
+	report := newHandleReport(app, len(msgs))
+	var (
+		pending  []*pendingMessage
+		due      []*pendingMessage
+		requests []*sendRequest
+		flushes  []*windowFlush
+	)
+	if err := app.catchUp.load(ctx); err != nil {
+		app.logf("[warn] failed to load catch-up state: %v", err)
+	}
+	for i := range msgs {
+		errs[i] = protect(func() error {
+			if isFlushMessage(&msgs[i]) {
+				f, err := app.flush(ctx, &msgs[i], i)
+				if f != nil {
+					flushes = append(flushes, f)
+				}
+				return err
+			}
+			if attr, err := ExtructOriginalAttribute(&msgs[i]); err == nil && attr == nil {
+				report.firstTime++
+			}
+			ps, err := app.newPendingMessages(&msgs[i])
+			if err != nil {
+				return err
+			}
+			for _, p := range ps {
+				p.index = i
+				pending = append(pending, p)
+			}
+			return nil
+		})
+	}
+	if err := app.catchUp.save(ctx); err != nil {
+		app.logf("[warn] failed to save catch-up state: %v", err)
+	}
+	var deduped []*pendingMessage
+	if err := protect(func() error {
+		deduped = app.dedup(ctx, pending, errs)
+		return nil
+	}); err != nil {
+		for _, p := range pending {
+			errs[p.index] = err
+		}
+		pending, deduped = nil, nil
+	}
+	if len(deduped) < len(pending) {
+		kept := make(map[*pendingMessage]bool, len(deduped))
+		for _, p := range deduped {
+			kept[p] = true
+		}
+		for _, p := range pending {
+			if !kept[p] && errs[p.index] == nil {
+				report.dropped[dropReasonDuplicate]++
+			}
+		}
+	}
+	for _, p := range deduped {
+		if err := protect(func() error {
+			req, expired, err := app.expire(p)
+			if err != nil {
+				return err
+			}
+			if expired {
+				if req != nil {
+					requests = append(requests, req)
+				} else {
+					report.dropped[dropReasonExpired]++
+				}
+				return nil
+			}
+			if app.windowed(p.dest) && p.delay == 0 {
+				return app.buffer(ctx, p)
+			}
+			req, err = app.newSendRequest(ctx, p)
+			if err != nil {
+				if errors.Is(err, ErrMessageHeld) {
+					report.observeRemaining(p.delay)
+				}
+				return err
+			}
+			requests = append(requests, req)
+			return nil
+		}); err != nil {
+			errs[p.index] = err
+		}
+	}
+	for _, f := range flushes {
+		if app.opt.AggregateFormat != AggregateFormatNone {
+			due = append(due, f.members...)
+			continue
+		}
+		for _, p := range f.members {
+			if err := protect(func() error {
+				req, err := app.newSendRequest(ctx, p)
+				if err != nil {
+					return err
+				}
+				requests = append(requests, req)
+				return nil
+			}); err != nil {
+				errs[p.index] = err
+			}
+		}
+	}
+	if len(due) > 0 {
+		if err := protect(func() error {
+			requests = append(requests, app.aggregate(due, errs)...)
+			return nil
+		}); err != nil {
+			for _, p := range due {
+				errs[p.index] = err
+			}
+		}
+	}
+	app.sendBatch(ctx, requests, errs)
+	report.collect(requests, errs)
+	report.cleanups = app.largePayloadCleanups(msgs, requests, errs)
+	for _, f := range flushes {
+		if errs[f.index] != nil {
+			continue
+		}
+		// the flush message is kept in the incoming queue, unless the window record is updated.
+		if err := protect(func() error { return app.flushed(ctx, f) }); err != nil {
+			errs[f.index] = err
+			report.collect(nil, []error{err})
+		}
+	}
+	report.duration = time.Since(start)
+	app.metrics.observe(report)
+	return errs, []*handleReport{report}
+}
+
+// protect runs fn and returns the panic in fn as an error,
+// so that a panic fails only the messages handled by fn, instead of all received messages.
+func protect(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn()
+}
+
+type pendingMessage struct {
+	index    int
+	msg      *types.Message
+	original *OriginalAttributes
+	dest     *destination
+	// fanOut is true if the message is routed to multiple destinations.
+	fanOut   bool
+	emitTime time.Time
+	delay    time.Duration
+	// late is set if the message is delivered after its deadline.
+	late bool
+	// spreadOffset is the offset from the pulse if emissions are spread.
+	spreadOffset *time.Duration
+	// deduplicated is set if the message has the dedup key, and is delivered only when due.
+	deduplicated bool
+	// pulse and nextPulse are the emit window of the message, regardless of the spread offset.
+	pulse     time.Time
+	nextPulse time.Time
+}
+
+// newPendingMessages returns a pending message for each destination of the message.
+func (app *App) newPendingMessages(msg *types.Message) ([]*pendingMessage, error) {
+	app.logf("[debug][%s] received message: %v", *msg.MessageId, *msg)
 
 	originalAttr, err := ExtructOriginalAttribute(msg)
 	if err != nil {
-		return fmt.Errorf("extruct original attribute: %w", err)
+		return nil, fmt.Errorf("extruct original attribute: %w", err)
 	}
 	if originalAttr == nil {
-		log.Printf("[debug][%s] handle 1st time message", *msg.MessageId)
+		app.logf("[debug][%s] handle 1st time message", *msg.MessageId)
 		sentTimestamp, err := ExtructSentTimestamp(msg)
 		if err != nil {
-			return fmt.Errorf("extruct sent timestamp: %w", err)
+			return nil, fmt.Errorf("extruct sent timestamp: %w", err)
 		}
-		log.Printf("[info][%s] handle 1st time message, sentTimestamp=%d", *msg.MessageId, sentTimestamp)
+		app.logf("[info][%s] handle 1st time message, sentTimestamp=%d", *msg.MessageId, sentTimestamp)
 		originalAttr = &OriginalAttributes{
 			MessageID:     *msg.MessageId,
 			SentTimestamp: sentTimestamp,
 		}
 	} else {
-		log.Printf("[info][%s] handle extended message, originalMessageID=%s originalSentTimestamp=%d", *msg.MessageId, originalAttr.MessageID, originalAttr.SentTimestamp)
+		app.logf("[info][%s] handle extended message, originalMessageID=%s originalSentTimestamp=%d", *msg.MessageId, originalAttr.MessageID, originalAttr.SentTimestamp)
+	}
+	dests, err := app.router.route(msg)
+	if err != nil {
+		return nil, fmt.Errorf("route: %w", err)
+	}
+	ps := make([]*pendingMessage, 0, len(dests))
+	for _, dest := range dests {
+		schedule, err := app.messageSchedule(msg, originalAttr, dest)
+		if err != nil {
+			return nil, fmt.Errorf("message schedule: %w", err)
+		}
+		schedule = app.catchUp.schedule(schedule)
+		emitTime := originalAttr.ScheduledEmitTime(schedule)
+		if emitTime.IsZero() {
+			return nil, fmt.Errorf("no emit time scheduled after original sent time %s", originalAttr.SentTime())
+		}
+		p := &pendingMessage{
+			msg:       msg,
+			original:  originalAttr,
+			dest:      dest,
+			fanOut:    len(dests) > 1,
+			emitTime:  emitTime,
+			delay:     originalAttr.ScheduledDelayDuration(schedule),
+			pulse:     emitTime,
+			nextPulse: schedule.Next(emitTime),
+		}
+		if err := app.spread(p); err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
 	}
+	return ps, nil
+}
+
+// newSendRequest decides where the message is sent. If the message is held in the incoming queue, it returns ErrMessageHeld.
+func (app *App) newSendRequest(ctx context.Context, p *pendingMessage) (*sendRequest, error) {
+	msg, delay, outgoingQueueURL := p.msg, p.delay, p.dest.queueURL
 	input := &sqs.SendMessageInput{
 		MessageBody:       msg.Body,
-		MessageAttributes: msg.MessageAttributes,
-	}
-	input.MessageAttributes = originalAttr.SetMessageAttribute(input.MessageAttributes)
-	delay := originalAttr.DelayDuration(app.opt.EmitInterval, app.opt.Offset)
-	if delay <= sqsMaxDelaySeconds*time.Second {
-		log.Printf("[info][%s] no extended, ready to emit delay=%s", *msg.MessageId, delay)
-		input.DelaySeconds = int32(delay.Seconds())
-		input.QueueUrl = aws.String(app.opt.OutgoingQueueURL)
-		output, err := app.client.SendMessage(ctx, input)
-		if err != nil {
-			return fmt.Errorf("send message to %s: %w", app.opt.OutgoingQueueURL, err)
+		MessageAttributes: p.messageAttributes(),
+	}
+	if reason := app.checkTotalDelay(p); reason != "" {
+		return app.newDeadLetterRequest(p, reason)
+	}
+	aggregating := app.opt.AggregateFormat != AggregateFormatNone
+	switch {
+	case delay == 0 && p.dest.sink != nil:
+		app.logf("[info][%s] no extended, ready to emit to %s", *msg.MessageId, p.dest)
+		input.MessageAttributes = p.outgoingAttributes()
+		setFIFOParameters(input, p)
+		return &sendRequest{
+			input:   input,
+			members: []*pendingMessage{p},
+			sink:    p.dest.sink,
+		}, nil
+	case delay == 0 || (delay <= sqsMaxDelaySeconds*time.Second && !aggregating && !p.deduplicated && p.dest.sink == nil && !isFIFOQueue(outgoingQueueURL)):
+		app.logf("[info][%s] no extended, ready to emit delay=%s", *msg.MessageId, delay)
+		input.MessageAttributes = p.outgoingAttributes()
+		input.DelaySeconds = delaySeconds(delay)
+		input.QueueUrl = aws.String(outgoingQueueURL)
+		if isFIFOQueue(outgoingQueueURL) {
+			setFIFOParameters(input, p)
 		}
-		log.Printf("[info][%s] send to %s, message id=%s", *msg.MessageId, app.opt.OutgoingQueueURL, *output.MessageId)
-	} else {
-		log.Printf("[info][%s] need extended, resend queue totalDelay=%s", *msg.MessageId, delay)
+	case isFIFOQueue(app.opt.IncomingQueueURL) && p.fanOut:
+		// a message routed to multiple destinations can not be held for each destination,
+		// so resend a copy for each destination, which is held when received again.
+		app.logf("[info][%s] fan out to destination `%s`, resend queue totalDelay=%s", *msg.MessageId, p.dest.name, delay)
+		input.QueueUrl = aws.String(app.opt.IncomingQueueURL)
+		setFIFOParameters(input, p)
+		input.MessageDeduplicationId = aws.String(*input.MessageDeduplicationId + "-" + p.dest.name)
+	case isFIFOQueue(app.opt.IncomingQueueURL):
+		return nil, app.holdMessage(ctx, p.msg, p.delay)
+	case delay <= sqsMaxDelaySeconds*time.Second:
+		app.logf("[info][%s] wait for emit time, resend queue delay=%s", *msg.MessageId, delay)
+		input.DelaySeconds = delaySeconds(delay)
+		input.QueueUrl = aws.String(app.opt.IncomingQueueURL)
+	default:
+		app.logf("[info][%s] need extended, resend queue totalDelay=%s", *msg.MessageId, delay)
 		input.DelaySeconds = int32(sqsMaxDelaySeconds)
 		input.QueueUrl = aws.String(app.opt.IncomingQueueURL)
-		output, err := app.client.SendMessage(ctx, input)
+	}
+	if aws.ToString(input.QueueUrl) == app.opt.IncomingQueueURL {
+		reason, err := app.countHop(input, p)
 		if err != nil {
-			return fmt.Errorf("send message to %s: %w", app.opt.IncomingQueueURL, err)
+			return nil, err
+		}
+		if reason != "" {
+			return app.newDeadLetterRequest(p, reason)
+		}
+	}
+	return &sendRequest{
+		input:   input,
+		members: []*pendingMessage{p},
+	}, nil
+}
+
+// messageAttributes returns a copy of the message attributes with the original attributes and the destination.
+func (p *pendingMessage) messageAttributes() map[string]types.MessageAttributeValue {
+	attributes := make(map[string]types.MessageAttributeValue, len(p.msg.MessageAttributes)+3)
+	for key, value := range p.msg.MessageAttributes {
+		attributes[key] = value
+	}
+	if p.dest.name != "" {
+		attributes[DestinationAttributeKey] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(p.dest.name),
 		}
-		log.Printf("[info][%s] send to %s, message id=%s", *msg.MessageId, app.opt.IncomingQueueURL, *output.MessageId)
+	} else {
+		// the attribute is written only by sqpulser.
+		delete(attributes, DestinationAttributeKey)
+	}
+	if p.late {
+		setLateAttribute(attributes)
+	}
+	if p.spreadOffset != nil {
+		setSpreadOffsetAttribute(attributes, *p.spreadOffset)
 	}
-	return nil
+	return p.original.SetMessageAttribute(attributes)
+}
+
+// outgoingAttributes returns the message attributes of the message emitted to the destination,
+// without the attributes used only while the message is resent to the incoming queue or the dead-letter queue.
+func (p *pendingMessage) outgoingAttributes() map[string]types.MessageAttributeValue {
+	attributes := p.messageAttributes()
+	for _, key := range []string{HopCountAttributeKey, SpreadOffsetAttributeKey, DestinationAttributeKey, DeadLetterReasonAttributeKey} {
+		delete(attributes, key)
+	}
+	return attributes
+}
+
+// delaySeconds returns the delay in seconds rounded up, so that the message never comes back before the emit time.
+// Rounding down makes the message come back just before the emit time, and be resent for the fraction of a second.
+func delaySeconds(delay time.Duration) int32 {
+	return int32((delay + time.Second - 1) / time.Second)
 }
 
 func ExtructOriginalAttribute(msg *types.Message) (*OriginalAttributes, error) {
@@ -259,12 +889,22 @@ func (attr *OriginalAttributes) SentTime() time.Time {
 }
 
 func (attr *OriginalAttributes) EmitTime(emitInterval, offset time.Duration) time.Time {
-	return attr.SentTime().Truncate(emitInterval).Add(emitInterval).Add(offset)
+	return attr.ScheduledEmitTime(IntervalSchedule{Interval: emitInterval, Offset: offset})
 }
 
 func (attr *OriginalAttributes) DelayDuration(emitInterval, offset time.Duration) time.Duration {
+	return attr.ScheduledDelayDuration(IntervalSchedule{Interval: emitInterval, Offset: offset})
+}
+
+// ScheduledEmitTime returns the next emit time of the schedule after the original sent time.
+func (attr *OriginalAttributes) ScheduledEmitTime(schedule Schedule) time.Time {
+	return schedule.Next(attr.SentTime().UTC())
+}
+
+// ScheduledDelayDuration returns the duration from now until the scheduled emit time.
+func (attr *OriginalAttributes) ScheduledDelayDuration(schedule Schedule) time.Duration {
 	now := flextime.Now()
-	emitTime := attr.EmitTime(emitInterval, offset)
+	emitTime := attr.ScheduledEmitTime(schedule)
 	delay := emitTime.Sub(now)
 	if delay < 0 {
 		return 0
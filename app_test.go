@@ -1,7 +1,9 @@
 package sqpulser_test
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -229,3 +231,122 @@ func TestOriginalAttrCore(t *testing.T) {
 		})
 	}
 }
+
+func TestRunConcurrency(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	client := &fakeSQSClient{}
+	expected := make([]string, 0, 100)
+	for i := 0; i < 10; i++ {
+		msgs := make([]types.Message, 0, 10)
+		for j := 0; j < 10; j++ {
+			id := fmt.Sprintf("msg-%d-%d", i, j)
+			msgs = append(msgs, newTestMessage(id, id, sentTimestamp, nil))
+			expected = append(expected, "handle-"+id)
+		}
+		client.received = append(client.received, msgs)
+	}
+	var once sync.Once
+	client.onEmpty = func() {
+		// wait in-flight messages of other workers
+		once.Do(func() {
+			go func() {
+				for {
+					client.mu.Lock()
+					n := len(client.deleted)
+					client.mu.Unlock()
+					if n >= len(expected) {
+						cancel()
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		})
+	}
+	app, err := sqpulser.NewWithClient(ctx, client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		Concurrency:      4,
+	})
+	require.NoError(t, err)
+	require.NoError(t, app.Run(ctx))
+	require.Len(t, client.sent, len(expected))
+	require.ElementsMatch(t, expected, client.deleted)
+}
+
+func TestRunGracefulShutdown(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	client := &fakeSQSClient{
+		received: [][]types.Message{
+			{
+				newTestMessage("msg-1", "body-1", sentTimestamp, nil),
+				newTestMessage("msg-2", "body-2", sentTimestamp, nil),
+			},
+		},
+		sendHook: func() {
+			close(sending)
+			<-release
+		},
+	}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		Concurrency:      2,
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- app.Run(ctx)
+	}()
+	<-sending
+	// as on SIGTERM, cancel ctx while the messages are in flight.
+	cancel()
+	select {
+	case <-done:
+		t.Fatal("Run returned before in-flight messages were handled")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after ctx was canceled")
+	}
+	require.Len(t, client.sent, 2)
+	require.Equal(t, []string{"handle-msg-1", "handle-msg-2"}, client.deleted)
+}
+
+func TestHandleMessageFractionalDelay(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339Nano, "2018-12-17T21:30:59.5Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingTopicARN: testOutgoingTopicARN,
+		SNSClient:        &fakeSNSClient{},
+		EmitInterval:     15 * time.Minute,
+	})
+	require.NoError(t, err)
+	msg := newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil)
+	require.NoError(t, app.HandleMessage(context.Background(), &msg))
+	require.Len(t, client.sent, 1)
+	// 14m0.5s until 21:45 is rounded up, not to come back before the emit time.
+	require.Equal(t, testIncomingQueueURL, *client.sent[0].QueueUrl)
+	require.EqualValues(t, 841, client.sent[0].DelaySeconds)
+}
@@ -0,0 +1,254 @@
+package sqpulser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	sqsMaxBatchEntries     = 10
+	sqsMaxBatchPayloadSize = 262144
+	sqsLongPollingSeconds  = 20
+	// sqsMaxMessageAttributes is the max number of the message attributes of a SQS message.
+	sqsMaxMessageAttributes = 10
+)
+
+// ErrTooManyMessageAttributes is returned when the message exceeds the limit of the message attributes of SQS
+// with the attributes added by sqpulser. The rejected message is not deleted from the incoming queue,
+// so it is moved to the dead-letter queue by the redrive policy.
+var ErrTooManyMessageAttributes = errors.New("too many message attributes")
+
+// sqpulserAttributeKeys are the message attributes added by sqpulser to the sent messages.
+var sqpulserAttributeKeys = map[string]bool{
+	OriginalMessageIDAttributeKey:            true,
+	OriginalMessageSentTimestampAttributeKey: true,
+	HopCountAttributeKey:                     true,
+	LateAttributeKey:                         true,
+	SpreadOffsetAttributeKey:                 true,
+	DestinationAttributeKey:                  true,
+	DeadLetterReasonAttributeKey:             true,
+}
+
+// sendRequest is an outgoing message and the received messages that it delivers.
+type sendRequest struct {
+	input   *sqs.SendMessageInput
+	members []*pendingMessage
+	// sink is set if the message is emitted to the sink instead of the queue of input.
+	sink Sink
+	// offloaded is set if the body is offloaded to S3.
+	offloaded *S3Pointer
+	// resolved is set if the S3 pointer body is resolved to emit to the sink.
+	resolved *S3Pointer
+}
+
+// sendBatch sends the requests by SendMessageBatch per queue, and sets the result of each request to errs of its members.
+// The requests to sinks are emitted per sink.
+func (app *App) sendBatch(ctx context.Context, requests []*sendRequest, errs []error) {
+	var (
+		queueURLs    []string
+		sinkRequests []*sendRequest
+	)
+	byQueue := make(map[string][]*sendRequest)
+	for _, req := range requests {
+		if req.sink != nil {
+			sinkRequests = append(sinkRequests, req)
+			continue
+		}
+		if err := protect(func() error { return app.offloadLargePayload(ctx, req) }); err != nil {
+			for _, p := range req.members {
+				errs[p.index] = err
+			}
+			continue
+		}
+		if err := req.checkMessageAttributes(); err != nil {
+			for _, p := range req.members {
+				errs[p.index] = err
+			}
+			// the offloaded payload is never referenced.
+			if req.offloaded != nil {
+				app.deleteLargePayload(ctx, *req.members[0].msg.MessageId, req.offloaded)
+			}
+			continue
+		}
+		queueURL := *req.input.QueueUrl
+		if _, ok := byQueue[queueURL]; !ok {
+			queueURLs = append(queueURLs, queueURL)
+		}
+		byQueue[queueURL] = append(byQueue[queueURL], req)
+	}
+	for _, queueURL := range queueURLs {
+		for _, batch := range splitSendBatch(byQueue[queueURL]) {
+			if err := protect(func() error {
+				app.sendMessageBatch(ctx, queueURL, batch, errs)
+				return nil
+			}); err != nil {
+				for _, req := range batch {
+					for _, p := range req.members {
+						errs[p.index] = err
+					}
+				}
+			}
+		}
+		// the offloaded payloads of the failed messages are never referenced.
+		for _, req := range byQueue[queueURL] {
+			if req.offloaded != nil && errs[req.members[0].index] != nil {
+				app.deleteLargePayload(ctx, *req.members[0].msg.MessageId, req.offloaded)
+			}
+		}
+	}
+	if len(sinkRequests) > 0 {
+		app.emit(ctx, sinkRequests, errs)
+	}
+}
+
+// checkMessageAttributes returns ErrTooManyMessageAttributes if the message to send exceeds the limit of SQS,
+// instead of failing the whole SendMessageBatch call.
+func (req *sendRequest) checkMessageAttributes() error {
+	n := len(req.input.MessageAttributes)
+	if n <= sqsMaxMessageAttributes {
+		return nil
+	}
+	added := n
+	if len(req.members) == 1 {
+		received := req.members[0].msg.MessageAttributes
+		added = 0
+		for key := range req.input.MessageAttributes {
+			if _, ok := received[key]; !ok || sqpulserAttributeKeys[key] {
+				added++
+			}
+		}
+	}
+	return fmt.Errorf("%w: %d message attributes including %d added by sqpulser, exceed %d of SQS", ErrTooManyMessageAttributes, n, added, sqsMaxMessageAttributes)
+}
+
+// splitSendBatch splits requests by the limits of the number of entries and the total payload size.
+func splitSendBatch(requests []*sendRequest) [][]*sendRequest {
+	var (
+		batches [][]*sendRequest
+		current []*sendRequest
+		size    int
+	)
+	for _, req := range requests {
+		reqSize := sendMessageInputSize(req.input)
+		if len(current) > 0 && (len(current) >= sqsMaxBatchEntries || size+reqSize > sqsMaxBatchPayloadSize) {
+			batches = append(batches, current)
+			current, size = nil, 0
+		}
+		current = append(current, req)
+		size += reqSize
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+func (app *App) sendMessageBatch(ctx context.Context, queueURL string, batch []*sendRequest, errs []error) {
+	setErr := func(req *sendRequest, err error) {
+		for _, p := range req.members {
+			errs[p.index] = err
+		}
+	}
+	entries := make([]types.SendMessageBatchRequestEntry, 0, len(batch))
+	for i, req := range batch {
+		entries = append(entries, types.SendMessageBatchRequestEntry{
+			Id:                     aws.String(strconv.Itoa(i)),
+			MessageBody:            req.input.MessageBody,
+			MessageAttributes:      req.input.MessageAttributes,
+			DelaySeconds:           req.input.DelaySeconds,
+			MessageGroupId:         req.input.MessageGroupId,
+			MessageDeduplicationId: req.input.MessageDeduplicationId,
+		})
+	}
+	output, err := app.client.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(queueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		for _, req := range batch {
+			setErr(req, fmt.Errorf("send message to %s: %w", queueURL, err))
+		}
+		return
+	}
+	for _, failed := range output.Failed {
+		i, err := strconv.Atoi(aws.ToString(failed.Id))
+		if err != nil || i < 0 || i >= len(batch) {
+			app.logf("[warn] unknown failed entry id `%s` in send message batch response", aws.ToString(failed.Id))
+			continue
+		}
+		setErr(batch[i], fmt.Errorf("send message to %s: %s: %s", queueURL, aws.ToString(failed.Code), aws.ToString(failed.Message)))
+	}
+	for _, successful := range output.Successful {
+		i, err := strconv.Atoi(aws.ToString(successful.Id))
+		if err != nil || i < 0 || i >= len(batch) {
+			app.logf("[warn] unknown successful entry id `%s` in send message batch response", aws.ToString(successful.Id))
+			continue
+		}
+		for _, p := range batch[i].members {
+			app.logf("[info][%s] send to %s, message id=%s", *p.msg.MessageId, queueURL, aws.ToString(successful.MessageId))
+		}
+	}
+}
+
+// sendMessageInputSize returns the size of the message, counted in the same way as the SQS message size limit.
+func sendMessageInputSize(input *sqs.SendMessageInput) int {
+	size := len(aws.ToString(input.MessageBody))
+	for name, value := range input.MessageAttributes {
+		size += len(name) + len(aws.ToString(value.DataType)) + len(aws.ToString(value.StringValue)) + len(value.BinaryValue)
+	}
+	return size
+}
+
+// deleteBatch deletes the handled messages from the incoming queue by DeleteMessageBatch, and returns the deleted ones.
+func (app *App) deleteBatch(ctx context.Context, msgs []types.Message) []types.Message {
+	var deleted []types.Message
+	for start := 0; start < len(msgs); start += sqsMaxBatchEntries {
+		end := start + sqsMaxBatchEntries
+		if end > len(msgs) {
+			end = len(msgs)
+		}
+		batch := msgs[start:end]
+		entries := make([]types.DeleteMessageBatchRequestEntry, 0, len(batch))
+		for i, msg := range batch {
+			entries = append(entries, types.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: msg.ReceiptHandle,
+			})
+		}
+		output, err := app.client.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(app.opt.IncomingQueueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			for _, msg := range batch {
+				app.logf("[error][%s] failed to delete message:%v, handle=%s", *msg.MessageId, err, *msg.ReceiptHandle)
+			}
+			app.metrics.deleteFailed(app, len(batch))
+			continue
+		}
+		app.metrics.deleteFailed(app, len(output.Failed))
+		for _, failed := range output.Failed {
+			i, err := strconv.Atoi(aws.ToString(failed.Id))
+			if err != nil || i < 0 || i >= len(batch) {
+				app.logf("[warn] unknown failed entry id `%s` in delete message batch response", aws.ToString(failed.Id))
+				continue
+			}
+			app.logf("[error][%s] failed to delete message:%s: %s, handle=%s", *batch[i].MessageId, aws.ToString(failed.Code), aws.ToString(failed.Message), *batch[i].ReceiptHandle)
+		}
+		for _, successful := range output.Successful {
+			i, err := strconv.Atoi(aws.ToString(successful.Id))
+			if err != nil || i < 0 || i >= len(batch) {
+				continue
+			}
+			app.logf("[info][%s] success", *batch[i].MessageId)
+			deleted = append(deleted, batch[i])
+		}
+	}
+	return deleted
+}
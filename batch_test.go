@@ -0,0 +1,102 @@
+package sqpulser_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMessagesBatch(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{
+		sendErr: func(input *sqs.SendMessageInput) error {
+			if *input.MessageBody == "body-3" {
+				return errors.New("something wrong")
+			}
+			return nil
+		},
+	}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+	})
+	require.NoError(t, err)
+	msgs := make([]types.Message, 0, 13)
+	for i := 0; i < 12; i++ {
+		msgs = append(msgs, newTestMessage(fmt.Sprintf("msg-%d", i), fmt.Sprintf("body-%d", i), Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil))
+	}
+	msgs = append(msgs, newTestMessage("msg-long", "body-long", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil))
+	msgs[12].Attributes = nil
+
+	errs := app.HandleMessages(context.Background(), msgs)
+	for i, err := range errs {
+		switch i {
+		case 3:
+			require.EqualError(t, err, "send message to "+testOutgoingQueueURL+": InternalError: something wrong")
+		case 12:
+			require.EqualError(t, err, "extruct sent timestamp: attributes not found")
+		default:
+			require.NoError(t, err, "msg-%d", i)
+		}
+	}
+	require.Equal(t, 2, client.batches)
+	require.Len(t, client.sent, 11)
+	for _, input := range client.sent {
+		require.Equal(t, testOutgoingQueueURL, *input.QueueUrl)
+		require.EqualValues(t, 14*60, input.DelaySeconds)
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	client := &fakeSQSClient{
+		received: [][]types.Message{
+			{
+				newTestMessage("msg-1", "body-1", sentTimestamp, nil),
+				newTestMessage("msg-2", "body-2", sentTimestamp, nil),
+				newTestMessage("msg-3", "body-3", sentTimestamp, nil),
+			},
+		},
+		sendErr: func(input *sqs.SendMessageInput) error {
+			if *input.MessageBody == "body-2" {
+				return errors.New("something wrong")
+			}
+			return nil
+		},
+		deleteErr: func(receiptHandle string) error {
+			if receiptHandle == "handle-msg-3" {
+				return errors.New("invalid")
+			}
+			return nil
+		},
+		onEmpty: cancel,
+	}
+	app, err := sqpulser.NewWithClient(ctx, client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+	})
+	require.NoError(t, err)
+	require.NoError(t, app.Run(ctx))
+	require.Len(t, client.receives, 2)
+	require.EqualValues(t, 10, client.receives[0].MaxNumberOfMessages)
+	require.EqualValues(t, 20, client.receives[0].WaitTimeSeconds)
+	require.Len(t, client.sent, 2)
+	require.Equal(t, []string{"handle-msg-1"}, client.deleted)
+}
@@ -0,0 +1,277 @@
+package sqpulser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+)
+
+// CatchUpPolicy decides when messages of the pulses missed before sqpulser started are emitted,
+// e.g. the backlog after downtime.
+type CatchUpPolicy string
+
+const (
+	// CatchUpImmediate emits messages of missed pulses immediately.
+	CatchUpImmediate CatchUpPolicy = "immediate"
+	// CatchUpCoalesce emits messages of all missed pulses at the first pulse after sqpulser started.
+	CatchUpCoalesce CatchUpPolicy = "coalesce"
+	// CatchUpReplay replays missed pulses from the first pulse after sqpulser started, spaced as they were originally scheduled.
+	CatchUpReplay CatchUpPolicy = "replay"
+)
+
+// ParseCatchUpPolicy parses the catch-up policy string.
+func ParseCatchUpPolicy(str string) (CatchUpPolicy, error) {
+	switch p := CatchUpPolicy(strings.ToLower(str)); p {
+	case "":
+		return CatchUpImmediate, nil
+	case CatchUpImmediate, CatchUpCoalesce, CatchUpReplay:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown catch-up policy `%s`", str)
+	}
+}
+
+// catchUpTouchInterval is the min interval to record that sqpulser is running in the catch-up state.
+const catchUpTouchInterval = time.Minute
+
+// catchUpGrace is the time after a pulse within which the pulse is not missed even if no process was running,
+// e.g. a Lambda invocation delayed by the batching window of the event source mapping (max 5m).
+const catchUpGrace = 5 * time.Minute
+
+// catchUp tracks the pulses missed before sqpulser started.
+type catchUp struct {
+	policy CatchUpPolicy
+	// fixed is true if startedAt is given by Option.CatchUpStart.
+	fixed bool
+	// store and key persist the state shared by the processes and Lambda invocations of the incoming queue, if the state store is given.
+	store StateStore
+	key   string
+
+	mu        sync.Mutex
+	startedAt time.Time
+	// oldest is the oldest missed pulse seen so far, which is replayed at the first pulse after startedAt.
+	oldest time.Time
+	// version is the version of the state record, and seenAt is the time the record was put last.
+	version int64
+	seenAt  time.Time
+	dirty   bool
+}
+
+// catchUpState is the value of the catch-up record in the state store.
+type catchUpState struct {
+	StartedAt int64 `json:"startedAt"`
+	Oldest    int64 `json:"oldest,omitempty"`
+	// SeenAt is the last time sqpulser was running, in unix milliseconds as the others.
+	SeenAt int64 `json:"seenAt"`
+}
+
+// newCatchUp returns the catch-up of the app. The start is Option.CatchUpStart, or the one recorded in the state store
+// unless sqpulser has been down for catchUpGrace after a pulse since the record was put, or the start of the process.
+func (app *App) newCatchUp(ctx context.Context) (*catchUp, error) {
+	now := flextime.Now()
+	c := &catchUp{
+		policy:    app.opt.CatchUp,
+		startedAt: now,
+	}
+	if !app.opt.CatchUpStart.IsZero() {
+		c.startedAt, c.fixed = app.opt.CatchUpStart, true
+	}
+	if c.policy == CatchUpImmediate || app.opt.StateStore == nil {
+		return c, nil
+	}
+	c.store, c.key = app.opt.StateStore, "catch-up/"+app.opt.IncomingQueueURL
+	for i := 0; ; i++ {
+		record, state, err := c.get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("catch-up: %w", err)
+		}
+		var version int64
+		if record != nil {
+			seenAt := time.UnixMilli(state.SeenAt)
+			if next, ok := app.nextPulse(seenAt); !ok || !next.Before(now.Add(-catchUpGrace)) {
+				// no pulse has been missed since the last process.
+				c.restore(record, state)
+				return c, nil
+			}
+			version = record.Version
+		}
+		// sqpulser has been down after a pulse, or this is the first process.
+		c.mu.Lock()
+		c.version = version
+		c.mu.Unlock()
+		err = c.put(ctx, now)
+		if err == nil {
+			app.logf("[info] catch-up pulses missed before %s", c.start())
+			return c, nil
+		}
+		if !errors.Is(err, ErrStateConflict) || i >= maxStateConflicts {
+			return nil, fmt.Errorf("catch-up: %w", err)
+		}
+	}
+}
+
+func (c *catchUp) get(ctx context.Context) (*StateRecord, *catchUpState, error) {
+	record, err := c.store.Get(ctx, c.key)
+	if err != nil || record == nil {
+		return nil, nil, err
+	}
+	var state catchUpState
+	if err := json.Unmarshal(record.Value, &state); err != nil {
+		return nil, nil, fmt.Errorf("decode catch-up record %s: %w", c.key, err)
+	}
+	return record, &state, nil
+}
+
+// restore merges the state recorded by the other processes.
+func (c *catchUp) restore(record *StateRecord, state *catchUpState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version = record.Version
+	c.seenAt = time.UnixMilli(state.SeenAt)
+	if startedAt := time.UnixMilli(state.StartedAt); !c.fixed && !startedAt.Equal(c.startedAt) {
+		// the other process has started a new catch-up.
+		c.startedAt, c.oldest = startedAt, time.Time{}
+	}
+	var recorded time.Time
+	if state.Oldest != 0 {
+		recorded = time.UnixMilli(state.Oldest)
+	}
+	switch {
+	case recorded.IsZero():
+		c.dirty = c.dirty || !c.oldest.IsZero()
+	case c.oldest.IsZero() || recorded.Before(c.oldest):
+		c.oldest = recorded
+	case recorded.After(c.oldest):
+		// the oldest seen by the process is not recorded yet.
+		c.dirty = true
+	}
+}
+
+// put records the state with the expected version.
+func (c *catchUp) put(ctx context.Context, now time.Time) error {
+	c.mu.Lock()
+	state := catchUpState{
+		StartedAt: c.startedAt.UnixMilli(),
+		SeenAt:    now.UnixMilli(),
+	}
+	if !c.oldest.IsZero() {
+		state.Oldest = c.oldest.UnixMilli()
+	}
+	version := c.version
+	c.mu.Unlock()
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	record := &StateRecord{
+		Key:       c.key,
+		Value:     value,
+		ExpiresAt: now.Add(windowBufferTTL),
+	}
+	if err := c.store.Put(ctx, record, version); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version, c.seenAt = record.Version, now
+	c.dirty = c.oldest.UnixMilli() != state.Oldest && !c.oldest.IsZero()
+	return nil
+}
+
+// load merges the state recorded by the other processes, before messages are scheduled.
+func (c *catchUp) load(ctx context.Context) error {
+	if c == nil || c.store == nil {
+		return nil
+	}
+	record, state, err := c.get(ctx)
+	if err != nil || record == nil {
+		return err
+	}
+	c.restore(record, state)
+	return nil
+}
+
+// save records the oldest missed pulse seen by the process, and that sqpulser is running.
+func (c *catchUp) save(ctx context.Context) error {
+	if c == nil || c.store == nil {
+		return nil
+	}
+	for i := 0; ; i++ {
+		now := flextime.Now()
+		c.mu.Lock()
+		skip := !c.dirty && now.Sub(c.seenAt) < catchUpTouchInterval
+		c.mu.Unlock()
+		if skip {
+			return nil
+		}
+		err := c.put(ctx, now)
+		if !errors.Is(err, ErrStateConflict) || i >= maxStateConflicts {
+			return err
+		}
+		if err := c.load(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// start returns the start time, before which pulses are missed.
+func (c *catchUp) start() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.startedAt
+}
+
+// observe records the missed pulse and returns the oldest one.
+func (c *catchUp) observe(missed time.Time) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.oldest.IsZero() || missed.Before(c.oldest) {
+		c.oldest = missed
+		c.dirty = true
+	}
+	return c.oldest
+}
+
+// schedule returns the schedule rescheduling missed pulses by the policy.
+// The fixed emit time given by message attributes is not rescheduled.
+func (c *catchUp) schedule(schedule Schedule) Schedule {
+	if c == nil || c.policy == CatchUpImmediate {
+		return schedule
+	}
+	switch schedule.(type) {
+	case fixedSchedule, ImmediateSchedule:
+		return schedule
+	}
+	return &catchUpSchedule{
+		schedule: schedule,
+		catchUp:  c,
+	}
+}
+
+type catchUpSchedule struct {
+	schedule Schedule
+	catchUp  *catchUp
+}
+
+// Next implements Schedule. The pulse before the start time is missed, and is rescheduled by the policy.
+func (s *catchUpSchedule) Next(t time.Time) time.Time {
+	next := s.schedule.Next(t)
+	startedAt := s.catchUp.start()
+	if next.IsZero() || !next.Before(startedAt) {
+		return next
+	}
+	resume := s.schedule.Next(startedAt.In(t.Location()))
+	if resume.IsZero() {
+		return next
+	}
+	if s.catchUp.policy == CatchUpReplay {
+		return resume.Add(next.Sub(s.catchUp.observe(next)))
+	}
+	return resume
+}
@@ -0,0 +1,171 @@
+package sqpulser_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMessagesCatchUp(t *testing.T) {
+	cases := []struct {
+		policy sqpulser.CatchUpPolicy
+		// delays are the delay seconds at 21:31 by the message body, -1 means sent to the outgoing queue.
+		delays map[string]int32
+		// after are the delay seconds of the resent messages at 22:00.
+		after map[string]int32
+	}{
+		{
+			policy: sqpulser.CatchUpImmediate,
+			delays: map[string]int32{"body-1": -1, "body-2": -1, "body-3": -1, "body-4": 900},
+		},
+		{
+			policy: sqpulser.CatchUpCoalesce,
+			delays: map[string]int32{"body-1": 900, "body-2": 900, "body-3": 900, "body-4": 900},
+			after:  map[string]int32{"body-1": -1, "body-2": -1, "body-3": -1, "body-4": -1},
+		},
+		{
+			policy: sqpulser.CatchUpReplay,
+			delays: map[string]int32{"body-1": 900, "body-2": 900, "body-3": 900, "body-4": 900},
+			// replayed at 22:00, 23:00 and 00:00.
+			after: map[string]int32{"body-1": -1, "body-2": 900, "body-3": 900, "body-4": -1},
+		},
+	}
+	for _, c := range cases {
+		t.Run(string(c.policy), func(t *testing.T) {
+			restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+			defer restore()
+
+			client := &fakeSQSClient{}
+			app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+				IncomingQueueURL: testIncomingQueueURL,
+				OutgoingQueueURL: testOutgoingQueueURL,
+				EmitInterval:     time.Hour,
+				CatchUp:          c.policy,
+			})
+			require.NoError(t, err)
+			// missed the pulses at 19:00, 20:00 and 21:00 before start.
+			errs := app.HandleMessages(context.Background(), []types.Message{
+				newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T18:50:00Z")).UnixMilli(), nil),
+				newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T19:30:00Z")).UnixMilli(), nil),
+				newTestMessage("msg-3", "body-3", Must(time.Parse(time.RFC3339, "2018-12-17T20:10:00Z")).UnixMilli(), nil),
+				newTestMessage("msg-4", "body-4", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:30Z")).UnixMilli(), nil),
+			})
+			require.Equal(t, make([]error, 4), errs)
+			require.Equal(t, c.delays, sentDelays(client.sent))
+			if c.after == nil {
+				return
+			}
+
+			restore()
+			restore = flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T22:00:00Z")))
+			msgs := make([]types.Message, 0, len(client.sent))
+			for _, input := range client.sent {
+				msgs = append(msgs, newTestMessage(*input.MessageBody, *input.MessageBody, flextime.Now().UnixMilli(), input.MessageAttributes))
+			}
+			client.sent = nil
+			errs = app.HandleMessages(context.Background(), msgs)
+			require.Equal(t, make([]error, 4), errs)
+			require.Equal(t, c.after, sentDelays(client.sent))
+		})
+	}
+}
+
+func TestHandleMessagesCatchUpStateStore(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	store := sqpulser.NewMemoryStateStore()
+	client := &fakeSQSClient{}
+	// newApp starts a process, e.g. a cold start of Lambda, sharing the state store.
+	newApp := func() *sqpulser.App {
+		app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+			IncomingQueueURL: testIncomingQueueURL,
+			OutgoingQueueURL: testOutgoingQueueURL,
+			EmitInterval:     time.Hour,
+			CatchUp:          sqpulser.CatchUpReplay,
+			StateStore:       store,
+		})
+		require.NoError(t, err)
+		return app
+	}
+	// missed the pulses at 19:00, 20:00 and 21:00 before start.
+	errs := newApp().HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T18:50:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T19:30:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-3", "body-3", Must(time.Parse(time.RFC3339, "2018-12-17T20:10:00Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, make([]error, 3), errs)
+	require.Equal(t, map[string]int32{"body-1": 900, "body-2": 900, "body-3": 900}, sentDelays(client.sent))
+
+	// another process resumes the catch-up with the start and the oldest missed pulse of the first one.
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T22:00:00Z")))
+	msgs := make([]types.Message, 0, len(client.sent))
+	for _, input := range client.sent {
+		msgs = append(msgs, newTestMessage(*input.MessageBody, *input.MessageBody, flextime.Now().UnixMilli(), input.MessageAttributes))
+	}
+	client.sent = nil
+	errs = newApp().HandleMessages(context.Background(), msgs)
+	require.Equal(t, make([]error, 3), errs)
+	// replayed at 22:00, 23:00 and 00:00.
+	require.Equal(t, map[string]int32{"body-1": -1, "body-2": 900, "body-3": 900}, sentDelays(client.sent))
+
+	// down across the pulse at 23:00, a new catch-up starts.
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T23:30:00Z")))
+	client.sent = nil
+	errs = newApp().HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-4", "body-4", Must(time.Parse(time.RFC3339, "2018-12-17T22:10:00Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, []error{nil}, errs)
+	require.Equal(t, map[string]int32{"body-4": 900}, sentDelays(client.sent))
+}
+
+func TestHandleMessagesCatchUpStart(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     time.Hour,
+		CatchUp:          sqpulser.CatchUpCoalesce,
+		CatchUpStart:     Must(time.Parse(time.RFC3339, "2018-12-17T20:30:00Z")),
+	})
+	require.NoError(t, err)
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T19:30:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T20:10:00Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, make([]error, 2), errs)
+	// the pulse at 20:00 is missed before the start, and coalesced into 21:00. The pulse at 21:00 is not missed.
+	require.Equal(t, map[string]int32{"body-1": -1, "body-2": -1}, sentDelays(client.sent))
+}
+
+func TestNewWithClientUnknownCatchUpPolicy(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		CatchUp:          "skip",
+	})
+	require.EqualError(t, err, "unknown catch-up policy `skip`")
+}
+
+// sentDelays returns the delay seconds of the messages resent to the incoming queue by the body, and -1 for the others.
+func sentDelays(sent []*sqs.SendMessageInput) map[string]int32 {
+	delays := make(map[string]int32, len(sent))
+	for _, input := range sent {
+		if *input.QueueUrl != testIncomingQueueURL {
+			delays[*input.MessageBody] = -1
+			continue
+		}
+		delays[*input.MessageBody] = input.DelaySeconds
+	}
+	return delays
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/fatih/color"
 	"github.com/fujiwara/logutils"
@@ -38,9 +41,49 @@ func main() {
 		outQueueURL  string
 		inQueueName  string
 		outQueueName string
+		outTopicARN  string
+		outEventBus  string
+		outWebhook   string
+		outStream    string
+		partitionKey string
+		outBucket    string
+		keyTemplate  string
+		gzip         bool
+		largePayload sqpulser.LargePayloadOption
+		maxHops      int
+		maxTotal     time.Duration
+		dlqURL       string
+		dlqName      string
+		maxLateness  time.Duration
+		latePolicy   string
+		catchUp      string
+		catchUpStart string
+		spread       sqpulser.SpreadOption
+		spreadMode   string
+		dedupKey     string
+		dedupKeep    string
+		stateTable   string
+		metricsAddr  string
+		emf          sqpulser.EMFOption
+		secret       string
+		whFormat     string
+		whTimeout    time.Duration
+		whRetries    int
+		eventSource  string
+		detailType   string
 		minLevel     string
 		emitInterval string
 		offset       string
+		schedule     string
+		timezone     string
+		aggregate    string
+		flushDelay   time.Duration
+		minInterval  time.Duration
+		maxInterval  time.Duration
+		maxDelay     time.Duration
+		concurrency  int
+		routing      string
+		pipelines    string
 	)
 	flag.CommandLine.Usage = func() {
 		fmt.Fprintln(flag.CommandLine.Output(), "sqpulser is a tool for compiling SQS messages and emitting them in a pulsatile cycle")
@@ -51,9 +94,54 @@ func main() {
 	flag.StringVar(&outQueueURL, "out-queue-url", "", "Outgoing SQS queue URL")
 	flag.StringVar(&inQueueName, "in", "", "Incoming SQS queue Name")
 	flag.StringVar(&outQueueName, "out", "", "Outgoing SQS queue Name")
+	flag.StringVar(&outTopicARN, "out-topic-arn", "", "Outgoing SNS topic ARN, instead of outgoing SQS queue")
+	flag.StringVar(&outEventBus, "out-event-bus", "", "Outgoing EventBridge event bus name or ARN, instead of outgoing SQS queue")
+	flag.StringVar(&outWebhook, "out-webhook-url", "", "Outgoing HTTP webhook URL, instead of outgoing SQS queue")
+	flag.StringVar(&outStream, "out-stream", "", "Outgoing Kinesis data stream name or ARN, to which messages of the same emit time are put together (requires -state-table), instead of outgoing SQS queue")
+	flag.StringVar(&partitionKey, "partition-key-attribute", "", "message attribute used as the partition key of Kinesis records, default is the original message id")
+	flag.StringVar(&outBucket, "out-bucket", "", "Outgoing S3 bucket name, to which messages of the same emit time are written as an object (JSON Lines), instead of outgoing SQS queue")
+	flag.StringVar(&keyTemplate, "s3-key-template", "", "object key template of -out-bucket, default is '"+sqpulser.DefaultS3KeyTemplate+"' (with '.gz' if -s3-gzip)")
+	flag.BoolVar(&gzip, "s3-gzip", false, "compress objects of -out-bucket by gzip")
+	flag.BoolVar(&largePayload.Resolve, "large-payload", false, "resolve S3 pointer bodies of the SQS Extended Client when emitting to destinations other than SQS queues")
+	flag.StringVar(&largePayload.Bucket, "large-payload-bucket", "", "S3 bucket to which large bodies are offloaded when sending to SQS queues")
+	flag.IntVar(&largePayload.Threshold, "large-payload-threshold", 262144, "message size in bytes above which the body is offloaded to -large-payload-bucket")
+	flag.BoolVar(&largePayload.Cleanup, "large-payload-cleanup", false, "delete the resolved payloads in S3 after they are emitted and the messages are deleted")
+	flag.StringVar(&secret, "webhook-secret", "", "secret to sign webhook requests with HMAC-SHA256")
+	flag.StringVar(&whFormat, "webhook-format", "raw", "webhook request body format, raw (attributes as headers) or envelope (JSON)")
+	flag.DurationVar(&whTimeout, "webhook-timeout", 10*time.Second, "timeout of each webhook request")
+	flag.IntVar(&whRetries, "webhook-max-retries", 2, "max retries of a failed webhook request")
+	flag.StringVar(&eventSource, "event-source", sqpulser.DefaultEventSource, "source of events put to EventBridge")
+	flag.StringVar(&detailType, "event-detail-type", sqpulser.DefaultEventDetailType, "detail type of events put to EventBridge")
 	flag.StringVar(&minLevel, "log-level", "info", "awstee log level")
 	flag.StringVar(&emitInterval, "emit-interval", "15m", "sqs message emit interval")
 	flag.StringVar(&offset, "offset", "0m", "sqs message emit offset")
+	flag.StringVar(&schedule, "schedule", "", "sqs message emit schedule as cron expression or macro (e.g. '0 9,18 * * 1-5', '@hourly', or '@immediate' for the delay mode), overrides -emit-interval and -offset")
+	flag.StringVar(&aggregate, "aggregate", "", "compile messages of the same emit time into one outgoing message, format json or ndjson")
+	flag.DurationVar(&flushDelay, "flush-delay", sqpulser.DefaultFlushDelay, "duration from the first due message of an emit window to its flush in -aggregate, to wait for the other messages of the window")
+	flag.DurationVar(&minInterval, "min-emit-interval", time.Minute, "min emit interval that messages can override by attribute")
+	flag.DurationVar(&maxInterval, "max-emit-interval", 24*time.Hour, "max emit interval that messages can override by attribute")
+	flag.DurationVar(&maxDelay, "max-emit-delay", sqpulser.DefaultMaxEmitDelay, "max duration from sent time to emit time that messages can override by attribute")
+	flag.IntVar(&maxHops, "max-hops", 0, "max number of times a message is resent to the incoming queue, 0 means unlimited")
+	flag.DurationVar(&maxTotal, "max-total-delay", 0, "max duration from the original sent time to the emit time, 0 means unlimited")
+	flag.StringVar(&dlqURL, "dead-letter-queue-url", "", "SQS queue URL to which messages exceeding -max-hops or -max-total-delay are sent")
+	flag.StringVar(&dlqName, "dead-letter", "", "SQS queue Name to which messages exceeding -max-hops or -max-total-delay are sent")
+	flag.DurationVar(&maxLateness, "max-lateness", 0, "max duration from the emit time to the delivery, 0 means unlimited")
+	flag.StringVar(&latePolicy, "late-policy", "deliver", "policy for messages past -max-lateness or SqpulserExpiresAt, deliver (with SqpulserLate attribute), drop or dead-letter")
+	flag.StringVar(&catchUp, "catch-up", "immediate", "policy for messages of pulses missed before start, immediate, coalesce (into the next pulse) or replay (spaced as originally scheduled)")
+	flag.StringVar(&catchUpStart, "catch-up-start", "", "start of -catch-up in RFC3339, before which pulses are missed, default is the start shared in -state-table or the start of the process")
+	flag.StringVar(&spreadMode, "spread", "none", "spread emissions after the pulse, none, uniform (random jitter), hash (jitter by message id) or rate")
+	flag.DurationVar(&spread.Window, "spread-window", 0, "max jitter after the pulse of -spread uniform or hash")
+	flag.IntVar(&spread.Rate, "spread-rate", 0, "max messages per second after the pulse of -spread rate")
+	flag.StringVar(&dedupKey, "dedup-key", "", "message attribute name or JSONPath into the body (e.g. '$.entity.id') to deliver one message per key per emit window")
+	flag.StringVar(&dedupKeep, "dedup-keep", "first", "which message of the same dedup key is delivered, first or last")
+	flag.StringVar(&stateTable, "state-table", "", "DynamoDB table name of the state shared by multiple processes, e.g. for -dedup-key")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address to serve Prometheus metrics on /metrics, e.g. ':9090'")
+	flag.StringVar(&emf.Namespace, "emf-namespace", sqpulser.DefaultEMFNamespace, "CloudWatch namespace of the EMF metrics written per invocation in Lambda")
+	flag.BoolVar(&emf.Disabled, "disable-emf", false, "disable the EMF metrics written per invocation in Lambda")
+	flag.IntVar(&concurrency, "concurrency", 1, "number of polling loops run in parallel")
+	flag.StringVar(&routing, "routing-config", "", "routing config file (JSON) to route messages to multiple outgoing queues instead of -out-queue-url or -out")
+	flag.StringVar(&pipelines, "pipelines-config", "", "pipelines config file (JSON) to poll multiple incoming queues instead of -in-queue-url or -in")
+	flag.StringVar(&timezone, "timezone", "UTC", "time zone in which emit times are computed (e.g. Asia/Tokyo)")
 	flag.VisitAll(flagx.EnvToFlagWithPrefix("SQPULSER_"))
 	flag.Parse()
 	filter.SetMinLevel(logutils.LogLevel(strings.ToLower(minLevel)))
@@ -67,15 +155,92 @@ func main() {
 		log.Fatalln("[error] -offset parse failed", err)
 	}
 	opt := &sqpulser.Option{
-		IncomingQueueURL:  inQueueURL,
-		OutgoingQueueURL:  outQueueURL,
-		IncomingQueueName: inQueueName,
-		OutgoingQueueName: outQueueName,
-		EmitInterval:      i,
-		Offset:            o,
-	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+		IncomingQueueURL:      inQueueURL,
+		OutgoingQueueURL:      outQueueURL,
+		IncomingQueueName:     inQueueName,
+		OutgoingQueueName:     outQueueName,
+		OutgoingTopicARN:      outTopicARN,
+		OutgoingEventBusName:  outEventBus,
+		OutgoingWebhookURL:    outWebhook,
+		OutgoingStream:        outStream,
+		PartitionKeyAttribute: partitionKey,
+		OutgoingBucket:        outBucket,
+		S3KeyTemplate:         keyTemplate,
+		S3Gzip:                gzip,
+		LargePayload:          largePayload,
+		MaxHops:               maxHops,
+		MaxTotalDelay:         maxTotal,
+		DeadLetterQueueURL:    dlqURL,
+		DeadLetterQueueName:   dlqName,
+		MaxLateness:           maxLateness,
+		DedupKey:              dedupKey,
+		StateTable:            stateTable,
+		MetricsAddr:           metricsAddr,
+		EMF:                   emf,
+		EventSource:           eventSource,
+		EventDetailType:       detailType,
+		EmitInterval:          i,
+		Offset:                o,
+		MinEmitInterval:       minInterval,
+		MaxEmitInterval:       maxInterval,
+		MaxEmitDelay:          maxDelay,
+		FlushDelay:            flushDelay,
+		Concurrency:           concurrency,
+	}
+	if schedule != "" {
+		s, err := sqpulser.ParseSchedule(schedule)
+		if err != nil {
+			log.Fatalln("[error] -schedule parse failed", err)
+		}
+		opt.Schedule = s
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Fatalln("[error] -timezone load failed", err)
+	}
+	opt.Location = loc
+	if opt.AggregateFormat, err = sqpulser.ParseAggregateFormat(aggregate); err != nil {
+		log.Fatalln("[error] -aggregate parse failed", err)
+	}
+	opt.Webhook = sqpulser.WebhookOption{
+		Secret:     secret,
+		Timeout:    whTimeout,
+		MaxRetries: whRetries,
+	}
+	if opt.Webhook.Format, err = sqpulser.ParseWebhookFormat(whFormat); err != nil {
+		log.Fatalln("[error] -webhook-format parse failed", err)
+	}
+	if opt.LatePolicy, err = sqpulser.ParseLatePolicy(latePolicy); err != nil {
+		log.Fatalln("[error] -late-policy parse failed", err)
+	}
+	if opt.CatchUp, err = sqpulser.ParseCatchUpPolicy(catchUp); err != nil {
+		log.Fatalln("[error] -catch-up parse failed", err)
+	}
+	if catchUpStart != "" {
+		if opt.CatchUpStart, err = time.Parse(time.RFC3339, catchUpStart); err != nil {
+			log.Fatalln("[error] -catch-up-start parse failed", err)
+		}
+	}
+	if spread.Mode, err = sqpulser.ParseSpreadMode(spreadMode); err != nil {
+		log.Fatalln("[error] -spread parse failed", err)
+	}
+	opt.Spread = spread
+	if opt.DedupKeep, err = sqpulser.ParseDedupKeep(dedupKeep); err != nil {
+		log.Fatalln("[error] -dedup-keep parse failed", err)
+	}
+	if routing != "" {
+		if opt.Routing, err = sqpulser.LoadRoutingConfig(routing); err != nil {
+			log.Fatalln("[error] -routing-config load failed", err)
+		}
+	}
+	if pipelines != "" {
+		if opt.Pipelines, err = sqpulser.LoadPipelinesConfig(pipelines); err != nil {
+			log.Fatalln("[error] -pipelines-config load failed", err)
+		}
+	}
+	// on signals, stop receiving new messages, and return after in-flight messages are handled.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	app, err := sqpulser.New(ctx, opt)
 	if err != nil {
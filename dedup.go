@@ -0,0 +1,222 @@
+package sqpulser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// DedupKeep decides which message is delivered among the messages of the same dedup key in an emit window.
+type DedupKeep string
+
+const (
+	// DedupKeepFirst delivers the message sent first.
+	DedupKeepFirst DedupKeep = "first"
+	// DedupKeepLast delivers the message sent last.
+	DedupKeepLast DedupKeep = "last"
+)
+
+// ParseDedupKeep parses the dedup keep string.
+func ParseDedupKeep(str string) (DedupKeep, error) {
+	switch k := DedupKeep(strings.ToLower(str)); k {
+	case "":
+		return DedupKeepFirst, nil
+	case DedupKeepFirst, DedupKeepLast:
+		return k, nil
+	default:
+		return "", fmt.Errorf("unknown dedup keep `%s`", str)
+	}
+}
+
+// DedupEntry is the message recorded for a dedup key.
+type DedupEntry struct {
+	MessageID     string `json:"messageId"`
+	SentTimestamp int64  `json:"sentTimestamp"`
+}
+
+// preferred returns true if the entry is delivered instead of the recorded one.
+func (e DedupEntry) preferred(recorded DedupEntry, keep DedupKeep) bool {
+	if e.SentTimestamp == recorded.SentTimestamp {
+		return e.MessageID < recorded.MessageID
+	}
+	if keep == DedupKeepLast {
+		return e.SentTimestamp > recorded.SentTimestamp
+	}
+	return e.SentTimestamp < recorded.SentTimestamp
+}
+
+// dedupKey selects the dedup key of the message, either by the message attribute name or JSONPath into the body.
+type dedupKey struct {
+	attribute string
+	steps     []jsonPathStep
+}
+
+func parseDedupKey(str string) (*dedupKey, error) {
+	if !strings.HasPrefix(str, "$") {
+		return &dedupKey{attribute: str}, nil
+	}
+	steps, err := parseJSONPath(str)
+	if err != nil {
+		return nil, fmt.Errorf("dedup key: %w", err)
+	}
+	return &dedupKey{steps: steps}, nil
+}
+
+// value returns the dedup key value of the message. If the message has no value, it returns false.
+func (k *dedupKey) value(msg *types.Message) (string, bool) {
+	if k.steps == nil {
+		attr, ok := msg.MessageAttributes[k.attribute]
+		if !ok || attr.StringValue == nil {
+			return "", false
+		}
+		return *attr.StringValue, true
+	}
+	var body interface{}
+	if err := json.Unmarshal([]byte(aws.ToString(msg.Body)), &body); err != nil {
+		return "", false
+	}
+	value, ok := lookupJSONPath(body, k.steps)
+	if !ok {
+		return "", false
+	}
+	return jsonScalarString(value)
+}
+
+// defaultDedupTTL is the lifetime of the dedup record after the pulse, when the next pulse is unknown.
+const defaultDedupTTL = time.Hour
+
+// dedupClaim is the claim of the pending message for the dedup key.
+type dedupClaim struct {
+	p         *pendingMessage
+	key       string
+	value     string
+	entry     DedupEntry
+	expiresAt time.Time
+}
+
+func (app *App) newDedupClaim(p *pendingMessage) (*dedupClaim, bool) {
+	value, ok := app.dedupKey.value(p.msg)
+	if !ok {
+		return nil, false
+	}
+	// the record lives until the end of the next window, so that late messages of the window are also deduplicated.
+	expiresAt := p.nextPulse
+	if !expiresAt.After(p.pulse) {
+		expiresAt = p.pulse.Add(defaultDedupTTL)
+	}
+	return &dedupClaim{
+		p: p,
+		// the store may be shared by the pipelines and the other deployments of sqpulser.
+		key:   fmt.Sprintf("dedup/%s/%s/%d/%s", app.opt.IncomingQueueURL, p.dest, p.pulse.UnixMilli(), value),
+		value: value,
+		entry: DedupEntry{
+			MessageID:     p.original.MessageID,
+			SentTimestamp: p.original.SentTimestamp,
+		},
+		expiresAt: expiresAt,
+	}, true
+}
+
+func (app *App) claim(ctx context.Context, c *dedupClaim) (DedupEntry, error) {
+	recorded, err := app.claimState(ctx, c)
+	if err != nil {
+		return DedupEntry{}, fmt.Errorf("dedup: %w", err)
+	}
+	return recorded, nil
+}
+
+// claimState records the entry of the claim in the state store if no entry is recorded, or the entry is preferred
+// to the recorded one by Option.DedupKeep, by the optimistic locking of the record version.
+// It returns the recorded entry after the claim.
+func (app *App) claimState(ctx context.Context, c *dedupClaim) (DedupEntry, error) {
+	value, err := json.Marshal(c.entry)
+	if err != nil {
+		return DedupEntry{}, err
+	}
+	for i := 0; ; i++ {
+		record, err := app.dedupStore.Get(ctx, c.key)
+		if err != nil {
+			return DedupEntry{}, err
+		}
+		var version int64
+		if record != nil {
+			var recorded DedupEntry
+			if err := json.Unmarshal(record.Value, &recorded); err != nil {
+				return DedupEntry{}, fmt.Errorf("decode dedup record %s: %w", c.key, err)
+			}
+			if !c.entry.preferred(recorded, app.opt.DedupKeep) {
+				return recorded, nil
+			}
+			version = record.Version
+		}
+		// the key has the emit window, so the record has no window to be scanned.
+		err = app.dedupStore.Put(ctx, &StateRecord{
+			Key:       c.key,
+			Value:     value,
+			ExpiresAt: c.expiresAt,
+		}, version)
+		if err == nil {
+			return c.entry, nil
+		}
+		if !errors.Is(err, ErrStateConflict) || i >= maxStateConflicts {
+			return DedupEntry{}, err
+		}
+	}
+}
+
+// dedup returns the pending messages except duplicates, which are not delivered because another message
+// of the same dedup key in the emit window is preferred. Messages without the dedup key are never duplicates.
+// If the claim fails, the error is set to errs.
+func (app *App) dedup(ctx context.Context, ps []*pendingMessage, errs []error) []*pendingMessage {
+	if app.dedupKey == nil {
+		return ps
+	}
+	results := make([]*pendingMessage, 0, len(ps))
+	claims := make([]*dedupClaim, 0, len(ps))
+	counts := make(map[string]int)
+	for _, p := range ps {
+		c, ok := app.newDedupClaim(p)
+		if !ok {
+			results = append(results, p)
+			continue
+		}
+		p.deduplicated = true
+		claims = append(claims, c)
+		counts[c.key]++
+	}
+	recorded := make([]DedupEntry, len(claims))
+	for i, c := range claims {
+		entry, err := app.claim(ctx, c)
+		if err != nil {
+			errs[c.p.index] = err
+			continue
+		}
+		recorded[i] = entry
+	}
+	for i, c := range claims {
+		if errs[c.p.index] != nil {
+			continue
+		}
+		if counts[c.key] > 1 {
+			// the preferred message in the batch may be claimed after this one.
+			entry, err := app.claim(ctx, c)
+			if err != nil {
+				errs[c.p.index] = err
+				continue
+			}
+			recorded[i] = entry
+		}
+		if recorded[i].MessageID != c.entry.MessageID {
+			app.logf("[info][%s] drop duplicate of %s by dedup key `%s`", *c.p.msg.MessageId, recorded[i].MessageID, c.value)
+			continue
+		}
+		results = append(results, c.p)
+	}
+	return results
+}
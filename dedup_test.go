@@ -0,0 +1,191 @@
+package sqpulser_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMessagesDedupByAttribute(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		DedupKey:         "EntityID",
+	})
+	require.NoError(t, err)
+	entity := func(id string) map[string]types.MessageAttributeValue {
+		return map[string]types.MessageAttributeValue{
+			"EntityID": {DataType: aws.String("String"), StringValue: aws.String(id)},
+		}
+	}
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:50Z")).UnixMilli(), entity("x")),
+		newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:30Z")).UnixMilli(), entity("x")),
+		newTestMessage("msg-3", "body-3", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:40Z")).UnixMilli(), entity("y")),
+		newTestMessage("msg-4", "body-4", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:10Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, make([]error, 4), errs)
+	// messages with the dedup key wait in the incoming queue until due, instead of being sent to the outgoing queue with delay.
+	require.Equal(t, map[string]int32{"body-2": 840, "body-3": 840, "body-4": -1}, sentDelays(client.sent))
+
+	client.sent = nil
+	errs = app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-5", "body-5", Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")).UnixMilli(), entity("y")),
+	})
+	require.Equal(t, []error{nil}, errs)
+	require.Empty(t, client.sent)
+
+	// messages of another window are not duplicates.
+	errs = app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-6", "body-6", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), entity("x")),
+	})
+	require.Equal(t, []error{nil}, errs)
+	require.Equal(t, map[string]int32{"body-6": -1}, sentDelays(client.sent))
+}
+
+func TestHandleMessagesDedupByJSONPathKeepLast(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:46:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		DedupKey:         "$.entity.id",
+		DedupKeep:        sqpulser.DedupKeepLast,
+	})
+	require.NoError(t, err)
+	// all messages are due at 21:45.
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", `{"entity":{"id":1},"v":1}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-2", `{"entity":{"id":1},"v":3}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:40:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-3", `{"entity":{"id":1},"v":2}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:35:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-4", `{"entity":{"id":2}}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-5", `not json`, Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, make([]error, 5), errs)
+	require.Equal(t, map[string]int32{
+		`{"entity":{"id":1},"v":3}`: -1,
+		`{"entity":{"id":2}}`:       -1,
+		`not json`:                  -1,
+	}, sentDelays(client.sent))
+}
+
+type failingStateStore struct {
+	*sqpulser.MemoryStateStore
+}
+
+func (failingStateStore) Get(context.Context, string) (*sqpulser.StateRecord, error) {
+	return nil, errors.New("throttled")
+}
+
+// racingStateStore puts the competing record before the first put, as if another process claims the key concurrently.
+type racingStateStore struct {
+	*sqpulser.MemoryStateStore
+	competing *sqpulser.StateRecord
+}
+
+func (s *racingStateStore) Put(ctx context.Context, record *sqpulser.StateRecord, expectedVersion int64) error {
+	if s.competing != nil {
+		competing := s.competing
+		s.competing = nil
+		if err := s.MemoryStateStore.Put(ctx, competing, expectedVersion); err != nil {
+			return err
+		}
+	}
+	return s.MemoryStateStore.Put(ctx, record, expectedVersion)
+}
+
+func TestHandleMessagesDedupSharedStore(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	store := sqpulser.NewMemoryStateStore()
+	entity := map[string]types.MessageAttributeValue{
+		"EntityID": {DataType: aws.String("String"), StringValue: aws.String("x")},
+	}
+	// the incoming queues sharing the store do not deduplicate messages of each other.
+	for i, incomingQueueURL := range []string{testReportsInQueueURL, testBatchesInQueueURL} {
+		client := &fakeSQSClient{}
+		app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+			IncomingQueueURL: incomingQueueURL,
+			OutgoingQueueURL: testOutgoingQueueURL,
+			EmitInterval:     15 * time.Minute,
+			DedupKey:         "EntityID",
+			StateStore:       store,
+		})
+		require.NoError(t, err)
+		msg := newTestMessage(fmt.Sprintf("msg-%d", i), "body", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:30Z")).UnixMilli(), entity)
+		require.NoError(t, app.HandleMessage(context.Background(), &msg))
+		require.Len(t, client.sent, 1)
+	}
+}
+
+func TestHandleMessagesDedupStateStoreError(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:46:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		DedupKey:         "$.id",
+		StateStore:       failingStateStore{sqpulser.NewMemoryStateStore()},
+	})
+	require.NoError(t, err)
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", `{"id":1}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-2", `{}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")).UnixMilli(), nil),
+	})
+	require.EqualError(t, errs[0], "dedup: throttled")
+	require.NoError(t, errs[1])
+	require.Len(t, client.sent, 1)
+}
+
+func TestHandleMessagesDedupConflict(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	// another process claims the key of the window concurrently.
+	value, err := json.Marshal(sqpulser.DedupEntry{MessageID: "msg-0", SentTimestamp: Must(time.Parse(time.RFC3339, "2018-12-17T21:30:10Z")).UnixMilli()})
+	require.NoError(t, err)
+	key := fmt.Sprintf("dedup/%s/%s/%d/x", testIncomingQueueURL, testOutgoingQueueURL, Must(time.Parse(time.RFC3339, "2018-12-17T21:45:00Z")).UnixMilli())
+	store := &racingStateStore{
+		MemoryStateStore: sqpulser.NewMemoryStateStore(),
+		competing:        &sqpulser.StateRecord{Key: key, Value: value},
+	}
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		DedupKey:         "EntityID",
+		StateStore:       store,
+	})
+	require.NoError(t, err)
+	msg := newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:30Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+		"EntityID": {DataType: aws.String("String"), StringValue: aws.String("x")},
+	})
+	// the conflicted claim is retried with the record of the other process, which is preferred.
+	require.NoError(t, app.HandleMessage(context.Background(), &msg))
+	require.Empty(t, client.sent)
+	record, err := store.Get(context.Background(), key)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, record.Version)
+}
@@ -0,0 +1,47 @@
+package sqpulser
+
+import (
+	"context"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// SendDelayed sends the message to the incoming queue of sqpulser, to be delivered to the outgoing queue at deliverAt.
+// deliverAt can be beyond the SQS max delay of 15 minutes, and is rounded up to whole seconds,
+// so that the message is never delivered before deliverAt.
+// optFns can modify the input, for example to add message attributes.
+func SendDelayed(ctx context.Context, client SQSClient, queueURL string, body string, deliverAt time.Time, optFns ...func(*sqs.SendMessageInput)) (*sqs.SendMessageOutput, error) {
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueURL),
+		MessageBody: aws.String(body),
+	}
+	for _, optFn := range optFns {
+		optFn(input)
+	}
+	if input.MessageAttributes == nil {
+		input.MessageAttributes = make(map[string]types.MessageAttributeValue, 1)
+	}
+	// the attribute has no fraction of a second.
+	if truncated := deliverAt.Truncate(time.Second); truncated.Before(deliverAt) {
+		deliverAt = truncated.Add(time.Second)
+	}
+	input.MessageAttributes[EmitAtAttributeKey] = types.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(deliverAt.UTC().Format(time.RFC3339)),
+	}
+	// the first hop is delayed in the incoming queue as long as possible.
+	// FIFO queues do not allow per-message delay, and require MessageGroupId set by optFns.
+	delay := deliverAt.Sub(flextime.Now())
+	switch {
+	case isFIFOQueue(queueURL):
+	case delay > sqsMaxDelaySeconds*time.Second:
+		input.DelaySeconds = sqsMaxDelaySeconds
+	case delay > 0:
+		input.DelaySeconds = delaySeconds(delay)
+	}
+	return client.SendMessage(ctx, input)
+}
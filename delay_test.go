@@ -0,0 +1,112 @@
+package sqpulser_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendDelayed(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	cases := []struct {
+		name           string
+		deliverAt      string
+		expectedDelay  int32
+		expectedEmitAt string
+	}{
+		{name: "beyond max delay", deliverAt: "2018-12-19T00:00:00Z", expectedDelay: 900},
+		{name: "within max delay", deliverAt: "2018-12-17T21:36:30Z", expectedDelay: 330},
+		{name: "past", deliverAt: "2018-12-17T21:00:00Z", expectedDelay: 0},
+		// rounded up, so that the message is not delivered before deliverAt.
+		{name: "sub-second", deliverAt: "2018-12-17T21:36:30.2Z", expectedDelay: 331, expectedEmitAt: "2018-12-17T21:36:31Z"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &fakeSQSClient{}
+			_, err := sqpulser.SendDelayed(context.Background(), client, testIncomingQueueURL, "hello", Must(time.Parse(time.RFC3339, c.deliverAt)), func(input *sqs.SendMessageInput) {
+				input.MessageAttributes = map[string]types.MessageAttributeValue{
+					"Foo": {DataType: aws.String("String"), StringValue: aws.String("bar")},
+				}
+			})
+			require.NoError(t, err)
+			require.Len(t, client.sent, 1)
+			input := client.sent[0]
+			require.Equal(t, testIncomingQueueURL, *input.QueueUrl)
+			require.Equal(t, "hello", *input.MessageBody)
+			require.Equal(t, c.expectedDelay, input.DelaySeconds)
+			expectedEmitAt := c.expectedEmitAt
+			if expectedEmitAt == "" {
+				expectedEmitAt = c.deliverAt
+			}
+			require.Equal(t, expectedEmitAt, *input.MessageAttributes[sqpulser.EmitAtAttributeKey].StringValue)
+			require.Equal(t, "bar", *input.MessageAttributes["Foo"].StringValue)
+		})
+	}
+}
+
+func TestHandleMessageDelayMode(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	cases := []struct {
+		name          string
+		attrs         map[string]types.MessageAttributeValue
+		expectedQueue string
+		expectedDelay int32
+	}{
+		{
+			name:          "no delay",
+			expectedQueue: testOutgoingQueueURL,
+			expectedDelay: 0,
+		},
+		{
+			name: "relative delay",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.DelayAttributeKey: {DataType: aws.String("String"), StringValue: aws.String("17m30s")},
+			},
+			expectedQueue: testOutgoingQueueURL,
+			expectedDelay: 390,
+		},
+		{
+			name: "relative long delay",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.DelayAttributeKey: {DataType: aws.String("String"), StringValue: aws.String("36h")},
+			},
+			expectedQueue: testIncomingQueueURL,
+			expectedDelay: 900,
+		},
+		{
+			name: "deliver at",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.EmitAtAttributeKey: {DataType: aws.String("String"), StringValue: aws.String("2018-12-17T21:33:20Z")},
+			},
+			expectedQueue: testOutgoingQueueURL,
+			expectedDelay: 140,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &fakeSQSClient{}
+			app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+				IncomingQueueURL: testIncomingQueueURL,
+				OutgoingQueueURL: testOutgoingQueueURL,
+				Schedule:         Must(sqpulser.ParseSchedule("@immediate")),
+			})
+			require.NoError(t, err)
+			msg := newTestMessage("msg-1", "hello", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), c.attrs)
+			require.NoError(t, app.HandleMessage(context.Background(), &msg))
+			require.Len(t, client.sent, 1)
+			require.Equal(t, c.expectedQueue, *client.sent[0].QueueUrl)
+			require.Equal(t, c.expectedDelay, client.sent[0].DelaySeconds)
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package sqpulser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type DynamoDBClient interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+// Attribute names of the DynamoDB table of DynamoDBStateStore.
+const (
+	dynamoDBKeyAttribute       = "key"
+	dynamoDBValueAttribute     = "value"
+	dynamoDBVersionAttribute   = "version"
+	dynamoDBExpiresAtAttribute = "expires_at"
+)
+
+// DynamoDBStateStore is the StateStore on a DynamoDB table, shared by multiple processes.
+// The table has the partition key `key` (String).
+// `expires_at` (Number, unix time in seconds) should be enabled as the TTL attribute of the table, expired records are ignored anyway.
+type DynamoDBStateStore struct {
+	client DynamoDBClient
+	table  string
+}
+
+// NewDynamoDBStateStore returns the StateStore on the table.
+func NewDynamoDBStateStore(client DynamoDBClient, table string) *DynamoDBStateStore {
+	return &DynamoDBStateStore{
+		client: client,
+		table:  table,
+	}
+}
+
+// Get implements StateStore, by the strongly consistent read.
+func (s *DynamoDBStateStore) Get(ctx context.Context, key string) (*StateRecord, error) {
+	output, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            dynamoDBKey(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get item %s from %s: %w", key, s.table, err)
+	}
+	if output.Item == nil {
+		return nil, nil
+	}
+	record, err := decodeDynamoDBItem(output.Item)
+	if err != nil {
+		return nil, fmt.Errorf("decode item %s of %s: %w", key, s.table, err)
+	}
+	if record.expired(flextime.Now()) {
+		return nil, nil
+	}
+	return record, nil
+}
+
+// Put implements StateStore, by the conditional write.
+func (s *DynamoDBStateStore) Put(ctx context.Context, record *StateRecord, expectedVersion int64) error {
+	version := expectedVersion + 1
+	item := dynamoDBKey(record.Key)
+	item[dynamoDBValueAttribute] = &types.AttributeValueMemberB{Value: record.Value}
+	item[dynamoDBVersionAttribute] = &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)}
+	if !record.ExpiresAt.IsZero() {
+		item[dynamoDBExpiresAtAttribute] = &types.AttributeValueMemberN{Value: strconv.FormatInt(record.ExpiresAt.Unix(), 10)}
+	}
+	// the expired record may be left until it is deleted by TTL, and it is treated as not found.
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+		ExpressionAttributeNames: map[string]string{
+			"#key":        dynamoDBKeyAttribute,
+			"#expires_at": dynamoDBExpiresAtAttribute,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(flextime.Now().Unix(), 10)},
+		},
+	}
+	if expectedVersion == 0 {
+		input.ConditionExpression = aws.String("attribute_not_exists(#key) OR #expires_at < :now")
+	} else {
+		input.ConditionExpression = aws.String("attribute_exists(#key) AND #version = :version AND (attribute_not_exists(#expires_at) OR #expires_at >= :now)")
+		input.ExpressionAttributeNames["#version"] = dynamoDBVersionAttribute
+		input.ExpressionAttributeValues[":version"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expectedVersion, 10)}
+	}
+	if _, err := s.client.PutItem(ctx, input); err != nil {
+		var conditionalErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionalErr) {
+			return ErrStateConflict
+		}
+		return fmt.Errorf("put item %s to %s: %w", record.Key, s.table, err)
+	}
+	record.Version = version
+	return nil
+}
+
+// Delete implements StateStore.
+func (s *DynamoDBStateStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       dynamoDBKey(key),
+	})
+	if err != nil {
+		return fmt.Errorf("delete item %s from %s: %w", key, s.table, err)
+	}
+	return nil
+}
+
+func dynamoDBKey(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		dynamoDBKeyAttribute: &types.AttributeValueMemberS{Value: key},
+	}
+}
+
+func decodeDynamoDBItem(item map[string]types.AttributeValue) (*StateRecord, error) {
+	record := &StateRecord{}
+	for name, value := range item {
+		switch name {
+		case dynamoDBKeyAttribute:
+			v, ok := value.(*types.AttributeValueMemberS)
+			if !ok {
+				return nil, fmt.Errorf("%s attribute is not a string", name)
+			}
+			record.Key = v.Value
+		case dynamoDBValueAttribute:
+			v, ok := value.(*types.AttributeValueMemberB)
+			if !ok {
+				return nil, fmt.Errorf("%s attribute is not a binary", name)
+			}
+			record.Value = v.Value
+		case dynamoDBVersionAttribute, dynamoDBExpiresAtAttribute:
+			v, ok := value.(*types.AttributeValueMemberN)
+			if !ok {
+				return nil, fmt.Errorf("%s attribute is not a number", name)
+			}
+			n, err := strconv.ParseInt(v.Value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s attribute value parse failed: %w", name, err)
+			}
+			if name == dynamoDBVersionAttribute {
+				record.Version = n
+			} else {
+				record.ExpiresAt = time.Unix(n, 0)
+			}
+		}
+	}
+	return record, nil
+}
@@ -0,0 +1,73 @@
+package sqpulser_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDynamoDBStateStore(t *testing.T) {
+	client := &fakeDynamoDBClient{}
+	store := sqpulser.NewDynamoDBStateStore(client, "sqpulser-state")
+	testStateStore(t, store)
+
+	// expires_at is the TTL attribute in seconds.
+	require.NoError(t, store.Put(context.Background(), &sqpulser.StateRecord{
+		Key:       "e",
+		ExpiresAt: Must(time.Parse(time.RFC3339, "2018-12-17T21:15:00Z")),
+	}, 0))
+	require.Equal(t, &ddbtypes.AttributeValueMemberN{Value: "1545081300"}, client.items["e"]["expires_at"])
+}
+
+func TestHandleMessagesDedupByStateTable(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	dynamoDBClient := &fakeDynamoDBClient{}
+	entity := func(id string) map[string]types.MessageAttributeValue {
+		return map[string]types.MessageAttributeValue{
+			"EntityID": {DataType: aws.String("String"), StringValue: aws.String(id)},
+		}
+	}
+	// processes sharing the state table deduplicate messages across them.
+	for i, msg := range []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:30Z")).UnixMilli(), entity("x")),
+		newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:50Z")).UnixMilli(), entity("x")),
+	} {
+		client := &fakeSQSClient{}
+		app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+			IncomingQueueURL: testIncomingQueueURL,
+			OutgoingQueueURL: testOutgoingQueueURL,
+			EmitInterval:     15 * time.Minute,
+			DedupKey:         "EntityID",
+			StateTable:       "sqpulser-state",
+			DynamoDBClient:   dynamoDBClient,
+		})
+		require.NoError(t, err)
+		errs := app.HandleMessages(context.Background(), []types.Message{msg})
+		require.Equal(t, []error{nil}, errs)
+		if i == 0 {
+			require.Equal(t, map[string]int32{"body-1": 840}, sentDelays(client.sent))
+		} else {
+			require.Empty(t, client.sent)
+		}
+	}
+	require.Len(t, dynamoDBClient.items, 1)
+}
+
+func TestNewWithClientStateTableWithoutClient(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		StateTable:       "sqpulser-state",
+	})
+	require.EqualError(t, err, "DynamoDB client is required to use state table sqpulser-state")
+}
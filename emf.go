@@ -0,0 +1,130 @@
+package sqpulser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Songmu/flextime"
+)
+
+// DefaultEMFNamespace is the CloudWatch namespace of the metrics written by LambdaHandler.
+const DefaultEMFNamespace = "sqpulser"
+
+// EMFOption is the option of the CloudWatch Embedded Metric Format log lines written by LambdaHandler per invocation.
+type EMFOption struct {
+	// Disabled stops writing EMF log lines.
+	Disabled bool
+	// Namespace is the CloudWatch namespace, default is DefaultEMFNamespace.
+	Namespace string
+	// Writer is where EMF log lines are written, default is os.Stdout.
+	// Log lines of the standard logger can not be used, because they have the timestamp prefix.
+	Writer io.Writer
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+type emfLog struct {
+	AWS               emfMetadata `json:"_aws"`
+	IncomingQueue     string      `json:"IncomingQueue"`
+	OutgoingQueue     string      `json:"OutgoingQueue"`
+	FirstTimeMessages int         `json:"FirstTimeMessages"`
+	ExtendedMessages  int         `json:"ExtendedMessages"`
+	EmittedMessages   int         `json:"EmittedMessages"`
+	FailedMessages    int         `json:"FailedMessages"`
+	MaxRemainingDelay float64     `json:"MaxRemainingDelay"`
+}
+
+var emfMetrics = []emfMetric{
+	{Name: "FirstTimeMessages", Unit: "Count"},
+	{Name: "ExtendedMessages", Unit: "Count"},
+	{Name: "EmittedMessages", Unit: "Count"},
+	{Name: "FailedMessages", Unit: "Count"},
+	{Name: "MaxRemainingDelay", Unit: "Seconds"},
+}
+
+// emfMu serializes EMF log lines written concurrently to the same writer.
+var emfMu sync.Mutex
+
+// writeEMF writes the report of the app as an EMF log line, dimensioned by the incoming and outgoing queue names.
+func (app *App) writeEMF(r *handleReport) {
+	opt := app.opt.EMF
+	if opt.Disabled {
+		return
+	}
+	namespace := opt.Namespace
+	if namespace == "" {
+		namespace = DefaultEMFNamespace
+	}
+	w := opt.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	line, err := json.Marshal(emfLog{
+		AWS: emfMetadata{
+			Timestamp: flextime.Now().UnixMilli(),
+			CloudWatchMetrics: []emfDirective{{
+				Namespace:  namespace,
+				Dimensions: [][]string{{"IncomingQueue", "OutgoingQueue"}},
+				Metrics:    emfMetrics,
+			}},
+		},
+		IncomingQueue:     queueName(app.opt.IncomingQueueURL),
+		OutgoingQueue:     app.outgoingName(),
+		FirstTimeMessages: r.firstTime,
+		ExtendedMessages:  r.extended,
+		EmittedMessages:   r.emitted,
+		FailedMessages:    r.failures(),
+		MaxRemainingDelay: r.maxRemainingDelay.Seconds(),
+	})
+	if err != nil {
+		app.logf("[warn] marshal EMF log: %v", err)
+		return
+	}
+	emfMu.Lock()
+	defer emfMu.Unlock()
+	if _, err := fmt.Fprintln(w, string(line)); err != nil {
+		app.logf("[warn] write EMF log: %v", err)
+	}
+}
+
+// outgoingName returns the name of the outgoing queue or sink. If routing is configured, it returns the destination names.
+func (app *App) outgoingName() string {
+	if app.router == nil {
+		return ""
+	}
+	if app.opt.Routing != nil {
+		names := make([]string, 0, len(app.router.destinations))
+		for name := range app.router.destinations {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	if len(app.router.defaults) == 0 {
+		return ""
+	}
+	dest := app.router.defaults[0]
+	if dest.sink != nil {
+		return dest.sink.String()
+	}
+	return queueName(dest.queueURL)
+}
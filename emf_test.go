@@ -0,0 +1,165 @@
+package sqpulser_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeEMFLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var v map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &v), line)
+		lines = append(lines, v)
+	}
+	return lines
+}
+
+func TestLambdaHandlerEMF(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	var buf bytes.Buffer
+	app, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     time.Hour,
+		MaxHops:          1,
+		EMF: sqpulser.EMFOption{
+			Writer: &buf,
+		},
+	})
+	require.NoError(t, err)
+	resp, err := app.LambdaHandler(context.Background(), &sqpulser.SQSEvent{
+		Records: []types.Message{
+			newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T20:50:00Z")).UnixMilli(), nil),
+			newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), nil),
+			newTestMessage("msg-3", "body-3", Must(time.Parse(time.RFC3339, "2018-12-17T21:15:00Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+				sqpulser.OriginalMessageIDAttributeKey:            {DataType: aws.String("String"), StringValue: aws.String("msg-0")},
+				sqpulser.OriginalMessageSentTimestampAttributeKey: {DataType: aws.String("Number"), StringValue: aws.String(strconv.FormatInt(Must(time.Parse(time.RFC3339, "2018-12-17T19:40:00Z")).UnixMilli(), 10))},
+			}),
+			newTestMessage("msg-4", "body-4", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+				sqpulser.HopCountAttributeKey: {DataType: aws.String("Number"), StringValue: aws.String("1")},
+			}),
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []sqpulser.BatchItemFailureItem{{ItemIdentifier: "msg-4"}}, resp.BatchItemFailures)
+
+	lines := decodeEMFLines(t, &buf)
+	require.Len(t, lines, 1)
+	line := lines[0]
+	require.Equal(t, map[string]interface{}{
+		"Timestamp": float64(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")).UnixMilli()),
+		"CloudWatchMetrics": []interface{}{
+			map[string]interface{}{
+				"Namespace":  "sqpulser",
+				"Dimensions": []interface{}{[]interface{}{"IncomingQueue", "OutgoingQueue"}},
+				"Metrics": []interface{}{
+					map[string]interface{}{"Name": "FirstTimeMessages", "Unit": "Count"},
+					map[string]interface{}{"Name": "ExtendedMessages", "Unit": "Count"},
+					map[string]interface{}{"Name": "EmittedMessages", "Unit": "Count"},
+					map[string]interface{}{"Name": "FailedMessages", "Unit": "Count"},
+					map[string]interface{}{"Name": "MaxRemainingDelay", "Unit": "Seconds"},
+				},
+			},
+		},
+	}, line["_aws"])
+	delete(line, "_aws")
+	require.Equal(t, map[string]interface{}{
+		"IncomingQueue":     "sqpulser-in",
+		"OutgoingQueue":     "sqpulser-out",
+		"FirstTimeMessages": float64(3),
+		"ExtendedMessages":  float64(1),
+		"EmittedMessages":   float64(2),
+		"FailedMessages":    float64(1),
+		// msg-2 is extended until the pulse of 22:00.
+		"MaxRemainingDelay": float64(1740),
+	}, line)
+}
+
+func TestLambdaHandlerEMFPipelines(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	var buf bytes.Buffer
+	app, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		EmitInterval: 15 * time.Minute,
+		EMF: sqpulser.EMFOption{
+			Namespace: "reports",
+			Writer:    &buf,
+		},
+		Pipelines: []*sqpulser.Option{
+			{IncomingQueueURL: testReportsInQueueURL, OutgoingQueueURL: testReportsOutQueueURL},
+			{IncomingQueueURL: testBatchesInQueueURL, OutgoingQueueURL: testBatchesOutQueueURL},
+		},
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	_, err = app.LambdaHandler(context.Background(), &sqpulser.SQSEvent{
+		Records: []types.Message{
+			newTestMessage("msg-1", "body-1", sentTimestamp, nil),
+			newTestMessage("msg-2", "body-2", sentTimestamp, nil),
+			newTestMessage("msg-3", "body-3", sentTimestamp, nil),
+		},
+		EventSourceARNs: []string{
+			"arn:aws:sqs:ap-northeast-1:123456789012:reports-in",
+			"arn:aws:sqs:ap-northeast-1:123456789012:batches-in",
+			"arn:aws:sqs:ap-northeast-1:123456789012:reports-in",
+		},
+	})
+	require.NoError(t, err)
+
+	// a line per pipeline.
+	lines := decodeEMFLines(t, &buf)
+	require.Len(t, lines, 2)
+	for i, expected := range []struct {
+		in, out string
+		n       float64
+	}{
+		{in: "reports-in", out: "reports-out", n: 2},
+		{in: "batches-in", out: "batches-out", n: 1},
+	} {
+		require.Equal(t, "reports", lines[i]["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})["Namespace"])
+		require.Equal(t, expected.in, lines[i]["IncomingQueue"])
+		require.Equal(t, expected.out, lines[i]["OutgoingQueue"])
+		require.Equal(t, expected.n, lines[i]["FirstTimeMessages"])
+		require.Equal(t, expected.n, lines[i]["EmittedMessages"])
+	}
+}
+
+func TestLambdaHandlerEMFDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	app, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		EMF: sqpulser.EMFOption{
+			Disabled: true,
+			Writer:   &buf,
+		},
+	})
+	require.NoError(t, err)
+	_, err = app.LambdaHandler(context.Background(), &sqpulser.SQSEvent{
+		Records: []types.Message{
+			newTestMessage("msg-1", "body-1", flextime.Now().UnixMilli(), nil),
+		},
+	})
+	require.NoError(t, err)
+	require.Empty(t, buf.String())
+}
@@ -0,0 +1,171 @@
+package sqpulser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+type EventBridgeClient interface {
+	PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error)
+}
+
+const (
+	DefaultEventSource     = "sqpulser"
+	DefaultEventDetailType = "Sqpulser Message"
+	// EventDetailMetadataKey is the key of the event detail, which has the original attributes and the emit timestamp.
+	EventDetailMetadataKey = "sqpulser"
+
+	eventBridgeMaxBatchEntries     = 10
+	eventBridgeMaxBatchPayloadSize = 262144
+	// the size of the time field counted in the event size.
+	eventBridgeTimeSize = 14
+)
+
+// EventBridgeSink puts messages to an EventBridge event bus as events.
+// The message body must be a JSON object, which is the detail of the event.
+// The original attributes are added to the detail as the `sqpulser` field, and the time of the event is the emit time.
+type EventBridgeSink struct {
+	client       EventBridgeClient
+	eventBusName string
+	source       string
+	detailType   string
+}
+
+func NewEventBridgeSink(client EventBridgeClient, eventBusName string, source string, detailType string) *EventBridgeSink {
+	if source == "" {
+		source = DefaultEventSource
+	}
+	if detailType == "" {
+		detailType = DefaultEventDetailType
+	}
+	return &EventBridgeSink{
+		client:       client,
+		eventBusName: eventBusName,
+		source:       source,
+		detailType:   detailType,
+	}
+}
+
+func (app *App) newEventBridgeSink(eventBusName string, source string, detailType string) (*EventBridgeSink, error) {
+	if app.opt.EventBridgeClient == nil {
+		return nil, fmt.Errorf("EventBridge client is required to put events to %s", eventBusName)
+	}
+	if app.opt.AggregateFormat != AggregateFormatNone {
+		return nil, fmt.Errorf("aggregate can not be used with EventBridge event bus %s", eventBusName)
+	}
+	return NewEventBridgeSink(app.opt.EventBridgeClient, eventBusName, source, detailType), nil
+}
+
+// String implements Sink.
+func (s *EventBridgeSink) String() string {
+	return s.eventBusName
+}
+
+// Emit implements Sink, it puts events by PutEvents.
+func (s *EventBridgeSink) Emit(ctx context.Context, msgs []*OutgoingMessage) []error {
+	errs := make([]error, len(msgs))
+	var (
+		entries []ebtypes.PutEventsRequestEntry
+		indexes []int
+		size    int
+	)
+	flush := func() {
+		if len(entries) == 0 {
+			return
+		}
+		s.putEvents(ctx, entries, indexes, errs)
+		entries, indexes, size = nil, nil, 0
+	}
+	for i, msg := range msgs {
+		detail, err := eventDetail(msg)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		emitTime := msg.EmitTime
+		entry := ebtypes.PutEventsRequestEntry{
+			EventBusName: aws.String(s.eventBusName),
+			Source:       aws.String(s.source),
+			DetailType:   aws.String(s.detailType),
+			Detail:       aws.String(detail),
+			Time:         &emitTime,
+		}
+		entrySize := eventBridgeTimeSize + len(s.source) + len(s.detailType) + len(detail)
+		if len(entries) >= eventBridgeMaxBatchEntries || size+entrySize > eventBridgeMaxBatchPayloadSize {
+			flush()
+		}
+		entries = append(entries, entry)
+		indexes = append(indexes, i)
+		size += entrySize
+	}
+	flush()
+	return errs
+}
+
+func (s *EventBridgeSink) putEvents(ctx context.Context, entries []ebtypes.PutEventsRequestEntry, indexes []int, errs []error) {
+	output, err := s.client.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: entries,
+	})
+	if err != nil {
+		for _, i := range indexes {
+			errs[i] = err
+		}
+		return
+	}
+	// the result entries are in the same order as the request entries.
+	for j, i := range indexes {
+		if j >= len(output.Entries) {
+			errs[i] = errors.New("no result of put events entry " + strconv.Itoa(j))
+			continue
+		}
+		if result := output.Entries[j]; result.ErrorCode != nil {
+			errs[i] = fmt.Errorf("%s: %s", aws.ToString(result.ErrorCode), aws.ToString(result.ErrorMessage))
+		}
+	}
+}
+
+type eventDetailMetadata struct {
+	OriginalMessageID     string `json:"OriginalMessageID"`
+	OriginalSentTimestamp int64  `json:"OriginalSentTimestamp"`
+	EmitTimestamp         int64  `json:"EmitTimestamp"`
+}
+
+// eventDetail returns the message body with the metadata field. The body must be a JSON object.
+func eventDetail(msg *OutgoingMessage) (string, error) {
+	body := bytes.TrimSpace([]byte(msg.Body))
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return "", errors.New("message body is not a JSON object")
+	}
+	if _, ok := fields[EventDetailMetadataKey]; ok {
+		return "", fmt.Errorf("message body already has the `%s` field", EventDetailMetadataKey)
+	}
+	metadata := eventDetailMetadata{
+		EmitTimestamp: msg.EmitTime.UnixMilli(),
+	}
+	if msg.Original != nil {
+		metadata.OriginalMessageID = msg.Original.MessageID
+		metadata.OriginalSentTimestamp = msg.Original.SentTimestamp
+	}
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	// insert the metadata field at the head of the object, keeping the body as is.
+	var b bytes.Buffer
+	b.WriteString(`{"` + EventDetailMetadataKey + `":`)
+	b.Write(encoded)
+	if len(fields) > 0 {
+		b.WriteByte(',')
+	}
+	b.Write(bytes.TrimSpace(body[1:]))
+	return b.String(), nil
+}
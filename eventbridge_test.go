@@ -0,0 +1,76 @@
+package sqpulser_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMessagesEventBridge(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	ebClient := &fakeEventBridgeClient{
+		failed: func(detail string) bool {
+			return strings.Contains(detail, `"fail":true`)
+		},
+	}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL:     testIncomingQueueURL,
+		OutgoingEventBusName: "sqpulser-bus",
+		EventSource:          "com.example.reports",
+		EventBridgeClient:    ebClient,
+		EmitInterval:         15 * time.Minute,
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli()
+	msgs := []types.Message{
+		newTestMessage("msg-1", ` {"id":1, "name":"foo"}`, sentTimestamp, nil),
+		newTestMessage("msg-2", `{}`, sentTimestamp, nil),
+		newTestMessage("msg-3", `[1,2]`, sentTimestamp, nil),
+		newTestMessage("msg-4", `{"sqpulser":1}`, sentTimestamp, nil),
+		newTestMessage("msg-5", `{"fail":true}`, sentTimestamp, nil),
+		newTestMessage("msg-6", `{"id":6}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil),
+	}
+	errs := app.HandleMessages(context.Background(), msgs)
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.EqualError(t, errs[2], "emit to sqpulser-bus: message body is not a JSON object")
+	require.EqualError(t, errs[3], "emit to sqpulser-bus: message body already has the `sqpulser` field")
+	require.EqualError(t, errs[4], "emit to sqpulser-bus: InternalFailure: something wrong")
+	require.NoError(t, errs[5])
+
+	// not due yet, resent to the incoming queue.
+	require.Len(t, client.sent, 1)
+	require.Equal(t, testIncomingQueueURL, *client.sent[0].QueueUrl)
+	require.Equal(t, `{"id":6}`, *client.sent[0].MessageBody)
+
+	require.Len(t, ebClient.puts, 1)
+	entries := ebClient.puts[0].Entries
+	require.Len(t, entries, 3)
+	require.Equal(t, "sqpulser-bus", *entries[0].EventBusName)
+	require.Equal(t, "com.example.reports", *entries[0].Source)
+	require.Equal(t, sqpulser.DefaultEventDetailType, *entries[0].DetailType)
+	require.Equal(t, "2018-12-17T21:30:00Z", entries[0].Time.UTC().Format(time.RFC3339))
+	require.JSONEq(t, `{"sqpulser":{"OriginalMessageID":"msg-1","OriginalSentTimestamp":1545081600000,"EmitTimestamp":1545082200000},"id":1,"name":"foo"}`, *entries[0].Detail)
+	require.JSONEq(t, `{"sqpulser":{"OriginalMessageID":"msg-2","OriginalSentTimestamp":1545081600000,"EmitTimestamp":1545082200000}}`, *entries[1].Detail)
+}
+
+func TestNewWithClientEventBridgeAggregate(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL:     testIncomingQueueURL,
+		OutgoingEventBusName: "sqpulser-bus",
+		EventBridgeClient:    &fakeEventBridgeClient{},
+		EmitInterval:         15 * time.Minute,
+		AggregateFormat:      sqpulser.AggregateFormatJSON,
+		StateStore:           sqpulser.NewMemoryStateStore(),
+	})
+	require.EqualError(t, err, "aggregate can not be used with EventBridge event bus sqpulser-bus")
+}
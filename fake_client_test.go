@@ -0,0 +1,449 @@
+package sqpulser_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+type fakeSQSClient struct {
+	mu        sync.Mutex
+	seq       int
+	received  [][]types.Message
+	receives  []*sqs.ReceiveMessageInput
+	onEmpty   func()
+	batches   int
+	sent      []*sqs.SendMessageInput
+	deleted   []string
+	deleteErr func(receiptHandle string) error
+	changed   []*sqs.ChangeMessageVisibilityInput
+	queueURLs map[string]string
+	sendErr   func(*sqs.SendMessageInput) error
+	sendHook  func()
+	// receiveErrs are returned by ReceiveMessage in order before received messages.
+	receiveErrs []error
+	// batchErr fails the whole SendMessageBatch call.
+	batchErr error
+	// queueBatchErrs fail the whole SendMessageBatch call to the specific queue.
+	queueBatchErrs map[string]error
+	// queueReceived and queueReceiveErrs are received from the specific queue, prior to received and receiveErrs.
+	queueReceived    map[string][][]types.Message
+	queueReceiveErrs map[string]error
+	// queueAttributes are returned by GetQueueAttributes per queue URL.
+	queueAttributes map[string]map[string]string
+}
+
+func (c *fakeSQSClient) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sendErr != nil {
+		if err := c.sendErr(params); err != nil {
+			return nil, err
+		}
+	}
+	c.seq++
+	c.sent = append(c.sent, params)
+	return &sqs.SendMessageOutput{
+		MessageId: aws.String(fmt.Sprintf("sent-%d", c.seq)),
+	}, nil
+}
+
+func (c *fakeSQSClient) SendMessageBatch(ctx context.Context, params *sqs.SendMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageBatchOutput, error) {
+	if c.sendHook != nil {
+		c.sendHook()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.batchErr != nil {
+		return nil, c.batchErr
+	}
+	if err, ok := c.queueBatchErrs[*params.QueueUrl]; ok {
+		return nil, err
+	}
+	if len(params.Entries) > 10 {
+		return nil, fmt.Errorf("too many entries: %d", len(params.Entries))
+	}
+	c.batches++
+	output := &sqs.SendMessageBatchOutput{}
+	for _, entry := range params.Entries {
+		input := &sqs.SendMessageInput{
+			QueueUrl:               params.QueueUrl,
+			MessageBody:            entry.MessageBody,
+			MessageAttributes:      entry.MessageAttributes,
+			DelaySeconds:           entry.DelaySeconds,
+			MessageGroupId:         entry.MessageGroupId,
+			MessageDeduplicationId: entry.MessageDeduplicationId,
+		}
+		if c.sendErr != nil {
+			if err := c.sendErr(input); err != nil {
+				output.Failed = append(output.Failed, types.BatchResultErrorEntry{
+					Id:          entry.Id,
+					Code:        aws.String("InternalError"),
+					Message:     aws.String(err.Error()),
+					SenderFault: false,
+				})
+				continue
+			}
+		}
+		c.seq++
+		c.sent = append(c.sent, input)
+		output.Successful = append(output.Successful, types.SendMessageBatchResultEntry{
+			Id:        entry.Id,
+			MessageId: aws.String(fmt.Sprintf("sent-%d", c.seq)),
+		})
+	}
+	return output, nil
+}
+
+func (c *fakeSQSClient) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	c.mu.Lock()
+	c.receives = append(c.receives, params)
+	if err, ok := c.queueReceiveErrs[*params.QueueUrl]; ok {
+		c.mu.Unlock()
+		return nil, err
+	}
+	if msgs := c.queueReceived[*params.QueueUrl]; len(msgs) > 0 {
+		c.queueReceived[*params.QueueUrl] = msgs[1:]
+		c.mu.Unlock()
+		return &sqs.ReceiveMessageOutput{
+			Messages: msgs[0],
+		}, nil
+	}
+	if len(c.receiveErrs) > 0 {
+		err := c.receiveErrs[0]
+		c.receiveErrs = c.receiveErrs[1:]
+		c.mu.Unlock()
+		return nil, err
+	}
+	if len(c.received) > 0 {
+		msgs := c.received[0]
+		c.received = c.received[1:]
+		c.mu.Unlock()
+		return &sqs.ReceiveMessageOutput{
+			Messages: msgs,
+		}, nil
+	}
+	onEmpty := c.onEmpty
+	c.mu.Unlock()
+	if onEmpty != nil {
+		onEmpty()
+	}
+	// long polling
+	if params.WaitTimeSeconds > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(params.WaitTimeSeconds) * time.Second):
+		}
+	}
+	return &sqs.ReceiveMessageOutput{}, nil
+}
+
+func (c *fakeSQSClient) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deleted = append(c.deleted, *params.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (c *fakeSQSClient) DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(params.Entries) > 10 {
+		return nil, fmt.Errorf("too many entries: %d", len(params.Entries))
+	}
+	output := &sqs.DeleteMessageBatchOutput{}
+	for _, entry := range params.Entries {
+		if c.deleteErr != nil {
+			if err := c.deleteErr(*entry.ReceiptHandle); err != nil {
+				output.Failed = append(output.Failed, types.BatchResultErrorEntry{
+					Id:      entry.Id,
+					Code:    aws.String("ReceiptHandleIsInvalid"),
+					Message: aws.String(err.Error()),
+				})
+				continue
+			}
+		}
+		c.deleted = append(c.deleted, *entry.ReceiptHandle)
+		output.Successful = append(output.Successful, types.DeleteMessageBatchResultEntry{
+			Id: entry.Id,
+		})
+	}
+	return output, nil
+}
+
+func (c *fakeSQSClient) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.changed = append(c.changed, params)
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (c *fakeSQSClient) GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	return &sqs.GetQueueAttributesOutput{
+		Attributes: c.queueAttributes[*params.QueueUrl],
+	}, nil
+}
+
+func (c *fakeSQSClient) GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	queueURL, ok := c.queueURLs[*params.QueueName]
+	if !ok {
+		return nil, fmt.Errorf("queue %s does not exist", *params.QueueName)
+	}
+	return &sqs.GetQueueUrlOutput{
+		QueueUrl: aws.String(queueURL),
+	}, nil
+}
+
+func newTestMessage(id string, body string, sentTimestamp int64, attrs map[string]types.MessageAttributeValue) types.Message {
+	return types.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String("handle-" + id),
+		Body:          aws.String(body),
+		Attributes: map[string]string{
+			"ApproximateReceiveCount": "1",
+			"SentTimestamp":           fmt.Sprintf("%d", sentTimestamp),
+		},
+		MessageAttributes: attrs,
+	}
+}
+
+type fakeSNSClient struct {
+	mu        sync.Mutex
+	seq       int
+	published []*sns.PublishBatchInput
+	// failed fails the entry of the message body.
+	failed func(body string) bool
+}
+
+func (c *fakeSNSClient) PublishBatch(ctx context.Context, params *sns.PublishBatchInput, optFns ...func(*sns.Options)) (*sns.PublishBatchOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(params.PublishBatchRequestEntries) > 10 {
+		return nil, fmt.Errorf("too many entries: %d", len(params.PublishBatchRequestEntries))
+	}
+	c.published = append(c.published, params)
+	output := &sns.PublishBatchOutput{}
+	for _, entry := range params.PublishBatchRequestEntries {
+		if c.failed != nil && c.failed(*entry.Message) {
+			output.Failed = append(output.Failed, snstypes.BatchResultErrorEntry{
+				Id:      entry.Id,
+				Code:    aws.String("InternalError"),
+				Message: aws.String("something wrong"),
+			})
+			continue
+		}
+		c.seq++
+		output.Successful = append(output.Successful, snstypes.PublishBatchResultEntry{
+			Id:        entry.Id,
+			MessageId: aws.String(fmt.Sprintf("published-%d", c.seq)),
+		})
+	}
+	return output, nil
+}
+
+type fakeEventBridgeClient struct {
+	mu   sync.Mutex
+	seq  int
+	puts []*eventbridge.PutEventsInput
+	// failed fails the entry of the detail.
+	failed func(detail string) bool
+}
+
+func (c *fakeEventBridgeClient) PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(params.Entries) > 10 {
+		return nil, fmt.Errorf("too many entries: %d", len(params.Entries))
+	}
+	c.puts = append(c.puts, params)
+	output := &eventbridge.PutEventsOutput{}
+	for _, entry := range params.Entries {
+		if c.failed != nil && c.failed(*entry.Detail) {
+			output.FailedEntryCount++
+			output.Entries = append(output.Entries, ebtypes.PutEventsResultEntry{
+				ErrorCode:    aws.String("InternalFailure"),
+				ErrorMessage: aws.String("something wrong"),
+			})
+			continue
+		}
+		c.seq++
+		output.Entries = append(output.Entries, ebtypes.PutEventsResultEntry{
+			EventId: aws.String(fmt.Sprintf("event-%d", c.seq)),
+		})
+	}
+	return output, nil
+}
+
+type fakeKinesisClient struct {
+	mu   sync.Mutex
+	seq  int
+	puts []*kinesis.PutRecordsInput
+	// failed fails the record of the data.
+	failed func(data string) bool
+}
+
+func (c *fakeKinesisClient) PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(params.Records) > 500 {
+		return nil, fmt.Errorf("too many records: %d", len(params.Records))
+	}
+	c.puts = append(c.puts, params)
+	output := &kinesis.PutRecordsOutput{}
+	for _, record := range params.Records {
+		if c.failed != nil && c.failed(string(record.Data)) {
+			output.FailedRecordCount = aws.Int32(aws.ToInt32(output.FailedRecordCount) + 1)
+			output.Records = append(output.Records, kinesistypes.PutRecordsResultEntry{
+				ErrorCode:    aws.String("ProvisionedThroughputExceededException"),
+				ErrorMessage: aws.String("Rate exceeded for shard"),
+			})
+			continue
+		}
+		c.seq++
+		output.Records = append(output.Records, kinesistypes.PutRecordsResultEntry{
+			SequenceNumber: aws.String(fmt.Sprintf("%d", c.seq)),
+			ShardId:        aws.String("shardId-000000000000"),
+		})
+	}
+	return output, nil
+}
+
+type fakeS3Client struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    []*s3.PutObjectInput
+	deleted []string
+	// putErr fails PutObject.
+	putErr error
+	// putHook is called at the beginning of PutObject.
+	putHook func()
+}
+
+func (c *fakeS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if c.putHook != nil {
+		c.putHook()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.putErr != nil {
+		return nil, c.putErr
+	}
+	if params.Bucket == nil || params.Key == nil {
+		return nil, errors.New("bucket and key are required")
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.puts = append(c.puts, params)
+	if c.objects == nil {
+		c.objects = make(map[string][]byte)
+	}
+	c.objects[*params.Bucket+"/"+*params.Key] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (c *fakeS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	body, ok := c.objects[*params.Bucket+"/"+*params.Key]
+	if !ok {
+		return nil, &s3types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}, nil
+}
+
+func (c *fakeS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := *params.Bucket + "/" + *params.Key
+	c.deleted = append(c.deleted, key)
+	delete(c.objects, key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// fakeDynamoDBClient evaluates only the expressions used by DynamoDBStateStore, on the table with the partition key `key`.
+type fakeDynamoDBClient struct {
+	mu    sync.Mutex
+	items map[string]map[string]ddbtypes.AttributeValue
+	puts  int
+}
+
+func fakeDynamoDBKey(item map[string]ddbtypes.AttributeValue) string {
+	return item["key"].(*ddbtypes.AttributeValueMemberS).Value
+}
+
+func fakeDynamoDBNumber(value ddbtypes.AttributeValue) int64 {
+	n, ok := value.(*ddbtypes.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	v, _ := strconv.ParseInt(n.Value, 10, 64)
+	return v
+}
+
+func (c *fakeDynamoDBClient) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: c.items[fakeDynamoDBKey(params.Key)]}, nil
+}
+
+func (c *fakeDynamoDBClient) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.puts++
+	key := fakeDynamoDBKey(params.Item)
+	stored, exists := c.items[key]
+	var ok bool
+	switch cond := aws.ToString(params.ConditionExpression); cond {
+	case "":
+		ok = true
+	case "attribute_not_exists(#key) OR #expires_at < :now":
+		expiresAt, hasExpiresAt := stored["expires_at"]
+		ok = !exists || (hasExpiresAt && fakeDynamoDBNumber(expiresAt) < fakeDynamoDBNumber(params.ExpressionAttributeValues[":now"]))
+	case "attribute_exists(#key) AND #version = :version AND (attribute_not_exists(#expires_at) OR #expires_at >= :now)":
+		expiresAt, hasExpiresAt := stored["expires_at"]
+		ok = exists && fakeDynamoDBNumber(stored["version"]) == fakeDynamoDBNumber(params.ExpressionAttributeValues[":version"]) &&
+			(!hasExpiresAt || fakeDynamoDBNumber(expiresAt) >= fakeDynamoDBNumber(params.ExpressionAttributeValues[":now"]))
+	default:
+		return nil, fmt.Errorf("unsupported condition expression: %s", cond)
+	}
+	if !ok {
+		return nil, &ddbtypes.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+	if c.items == nil {
+		c.items = make(map[string]map[string]ddbtypes.AttributeValue)
+	}
+	c.items[key] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (c *fakeDynamoDBClient) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.items, fakeDynamoDBKey(params.Key))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
@@ -0,0 +1,153 @@
+package sqpulser
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// ErrMessageHeld is returned when the message is held in the incoming queue until its emit time.
+// The held message must not be deleted from the incoming queue.
+var ErrMessageHeld = errors.New("message held in incoming queue until emit time")
+
+const (
+	sqsMaxVisibilityTimeoutSeconds = 43200
+	messageGroupIDAttributeName    = "MessageGroupId"
+	deduplicationIDAttributeName   = "MessageDeduplicationId"
+)
+
+func isFIFOQueue(queueURL string) bool {
+	return strings.HasSuffix(queueURL, ".fifo")
+}
+
+// holdMessage keeps the message invisible in the incoming queue for the delay, e.g. until its emit time.
+// FIFO queues do not allow per-message delay, so the message is held instead of being resent.
+// The held message blocks its message group, and each hold counts as a receive against maxReceiveCount (see checkFIFOHold).
+func (app *App) holdMessage(ctx context.Context, msg *types.Message, delay time.Duration) error {
+	seconds := delaySeconds(delay)
+	if seconds > sqsMaxVisibilityTimeoutSeconds {
+		seconds = sqsMaxVisibilityTimeoutSeconds
+	}
+	if _, err := app.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(app.opt.IncomingQueueURL),
+		ReceiptHandle:     msg.ReceiptHandle,
+		VisibilityTimeout: seconds,
+	}); err != nil {
+		return fmt.Errorf("change message visibility in %s: %w", app.opt.IncomingQueueURL, err)
+	}
+	app.logf("[info][%s] hold in incoming queue for %ds, totalDelay=%s", *msg.MessageId, seconds, delay)
+	return ErrMessageHeld
+}
+
+// maxScheduleSamples bounds the pulses sampled to find the longest gap of a schedule.
+const maxScheduleSamples = 1000
+
+// scheduleGap returns the longest duration between the pulses of the schedule in the week from now,
+// which is the longest wait of a message sent just after a pulse.
+func scheduleGap(schedule Schedule, now time.Time) time.Duration {
+	if interval, ok := schedule.(IntervalSchedule); ok {
+		return interval.Interval
+	}
+	var gap time.Duration
+	prev := now
+	for i := 0; i < maxScheduleSamples && prev.Sub(now) <= 7*24*time.Hour; i++ {
+		next := schedule.Next(prev)
+		if !next.After(prev) {
+			break
+		}
+		if d := next.Sub(prev); d > gap {
+			gap = d
+		}
+		prev = next
+	}
+	return gap
+}
+
+// holdReceives returns the number of receives of a message held in the FIFO incoming queue for the delay,
+// which is a receive per hold of up to 12 hours and the last receive to emit it.
+func holdReceives(delay time.Duration) int {
+	hold := time.Duration(sqsMaxVisibilityTimeoutSeconds) * time.Second
+	return int((delay+hold-1)/hold) + 1
+}
+
+// checkFIFOHold refuses to run if the messages held in the FIFO incoming queue until their emit time
+// can be moved to the dead-letter queue by maxReceiveCount of the redrive policy, because each hold counts as a receive.
+// The longest hold is the max emit delay of the overridden emit times, or the longest gap of the schedules.
+func (app *App) checkFIFOHold(ctx context.Context) error {
+	output, err := app.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(app.opt.IncomingQueueURL),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameRedrivePolicy},
+	})
+	if err != nil {
+		app.logf("[warn] can not get redrive policy of %s, held messages may exceed maxReceiveCount: %v", app.opt.IncomingQueueURL, err)
+		return nil
+	}
+	policy, ok := output.Attributes[string(types.QueueAttributeNameRedrivePolicy)]
+	if !ok || policy == "" {
+		return nil
+	}
+	var redrive struct {
+		// MaxReceiveCount is a number or a string of a number.
+		MaxReceiveCount interface{} `json:"maxReceiveCount"`
+	}
+	if err := json.Unmarshal([]byte(policy), &redrive); err != nil {
+		return fmt.Errorf("decode redrive policy of %s: %w", app.opt.IncomingQueueURL, err)
+	}
+	maxReceiveCount, err := strconv.Atoi(fmt.Sprint(redrive.MaxReceiveCount))
+	if err != nil {
+		return fmt.Errorf("maxReceiveCount of redrive policy of %s: %w", app.opt.IncomingQueueURL, err)
+	}
+	maxDelay := app.opt.MaxEmitDelay
+	now := flextime.Now()
+	dests := append([]*destination{}, app.router.defaults...)
+	for _, dest := range app.router.destinations {
+		dests = append(dests, dest)
+	}
+	for _, dest := range dests {
+		if gap := scheduleGap(app.inLocation(dest.schedule), now); gap > maxDelay {
+			maxDelay = gap
+		}
+	}
+	if receives := holdReceives(maxDelay); receives > maxReceiveCount {
+		return fmt.Errorf("messages held in FIFO incoming queue for up to %s are received %d times, exceeding maxReceiveCount %d of its redrive policy; raise maxReceiveCount or lower max emit delay", maxDelay, receives, maxReceiveCount)
+	}
+	return nil
+}
+
+// setFIFOParameters propagates the message group id and deduplication id of the received message.
+// If the received message is not from a FIFO queue, the original message id is used instead.
+func setFIFOParameters(input *sqs.SendMessageInput, p *pendingMessage) {
+	groupID, ok := p.msg.Attributes[messageGroupIDAttributeName]
+	if !ok || groupID == "" {
+		groupID = p.original.MessageID
+	}
+	deduplicationID, ok := p.msg.Attributes[deduplicationIDAttributeName]
+	if !ok || deduplicationID == "" {
+		deduplicationID = p.original.MessageID
+	}
+	input.MessageGroupId = aws.String(groupID)
+	input.MessageDeduplicationId = aws.String(deduplicationID)
+	input.DelaySeconds = 0
+}
+
+// setAggregatedFIFOParameters sets the message group id of the first member,
+// and the deduplication id derived from all members.
+func setAggregatedFIFOParameters(input *sqs.SendMessageInput, members []*pendingMessage) {
+	setFIFOParameters(input, members[0])
+	h := sha256.New()
+	for _, p := range members {
+		fmt.Fprintln(h, p.original.MessageID)
+	}
+	input.MessageDeduplicationId = aws.String(hex.EncodeToString(h.Sum(nil)))
+}
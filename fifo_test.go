@@ -0,0 +1,207 @@
+package sqpulser_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testIncomingFIFOQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/012345678900/sqpulser-in.fifo"
+	testOutgoingFIFOQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/012345678900/sqpulser-out.fifo"
+)
+
+func TestHandleMessageFIFO(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	cases := []struct {
+		name                    string
+		incomingQueueURL        string
+		outgoingQueueURL        string
+		sentAt                  string
+		offset                  time.Duration
+		fifoAttributes          bool
+		expectedHeld            int32
+		expectedQueue           string
+		expectedDelay           int32
+		expectedGroupID         *string
+		expectedDeduplicationID *string
+	}{
+		{
+			name:             "standard to fifo, not due",
+			incomingQueueURL: testIncomingQueueURL,
+			outgoingQueueURL: testOutgoingFIFOQueueURL,
+			sentAt:           "2018-12-17T21:30:00Z",
+			expectedQueue:    testIncomingQueueURL,
+			expectedDelay:    14 * 60,
+		},
+		{
+			name:                    "standard to fifo, due",
+			incomingQueueURL:        testIncomingQueueURL,
+			outgoingQueueURL:        testOutgoingFIFOQueueURL,
+			sentAt:                  "2018-12-17T21:20:00Z",
+			expectedQueue:           testOutgoingFIFOQueueURL,
+			expectedGroupID:         aws.String("msg-1"),
+			expectedDeduplicationID: aws.String("msg-1"),
+		},
+		{
+			name:             "fifo to fifo, not due",
+			incomingQueueURL: testIncomingFIFOQueueURL,
+			outgoingQueueURL: testOutgoingFIFOQueueURL,
+			sentAt:           "2018-12-17T21:30:00Z",
+			fifoAttributes:   true,
+			expectedHeld:     14 * 60,
+		},
+		{
+			name:                    "fifo to fifo, due",
+			incomingQueueURL:        testIncomingFIFOQueueURL,
+			outgoingQueueURL:        testOutgoingFIFOQueueURL,
+			sentAt:                  "2018-12-17T21:20:00Z",
+			fifoAttributes:          true,
+			expectedQueue:           testOutgoingFIFOQueueURL,
+			expectedGroupID:         aws.String("group-1"),
+			expectedDeduplicationID: aws.String("dedup-1"),
+		},
+		{
+			name:             "fifo to standard, within max delay",
+			incomingQueueURL: testIncomingFIFOQueueURL,
+			outgoingQueueURL: testOutgoingQueueURL,
+			sentAt:           "2018-12-17T21:30:00Z",
+			fifoAttributes:   true,
+			expectedQueue:    testOutgoingQueueURL,
+			expectedDelay:    14 * 60,
+		},
+		{
+			name:             "fifo to standard, beyond max delay",
+			incomingQueueURL: testIncomingFIFOQueueURL,
+			outgoingQueueURL: testOutgoingQueueURL,
+			sentAt:           "2018-12-17T21:30:00Z",
+			offset:           2 * time.Hour,
+			fifoAttributes:   true,
+			expectedHeld:     14*60 + 2*60*60,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &fakeSQSClient{}
+			app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+				IncomingQueueURL: c.incomingQueueURL,
+				OutgoingQueueURL: c.outgoingQueueURL,
+				EmitInterval:     15 * time.Minute,
+				Offset:           c.offset,
+			})
+			require.NoError(t, err)
+			msg := newTestMessage("msg-1", "hello", Must(time.Parse(time.RFC3339, c.sentAt)).UnixMilli(), nil)
+			if c.fifoAttributes {
+				msg.Attributes["MessageGroupId"] = "group-1"
+				msg.Attributes["MessageDeduplicationId"] = "dedup-1"
+			}
+			err = app.HandleMessage(context.Background(), &msg)
+			if c.expectedHeld > 0 {
+				require.ErrorIs(t, err, sqpulser.ErrMessageHeld)
+				require.Empty(t, client.sent)
+				require.Len(t, client.changed, 1)
+				require.Equal(t, c.incomingQueueURL, *client.changed[0].QueueUrl)
+				require.Equal(t, "handle-msg-1", *client.changed[0].ReceiptHandle)
+				require.Equal(t, c.expectedHeld, client.changed[0].VisibilityTimeout)
+				return
+			}
+			require.NoError(t, err)
+			require.Empty(t, client.changed)
+			require.Len(t, client.sent, 1)
+			input := client.sent[0]
+			require.Equal(t, c.expectedQueue, *input.QueueUrl)
+			require.Equal(t, c.expectedDelay, input.DelaySeconds)
+			require.Equal(t, c.expectedGroupID, input.MessageGroupId)
+			require.Equal(t, c.expectedDeduplicationID, input.MessageDeduplicationId)
+		})
+	}
+}
+
+func TestLambdaHandlerFIFOHeld(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingFIFOQueueURL,
+		OutgoingQueueURL: testOutgoingFIFOQueueURL,
+		EmitInterval:     15 * time.Minute,
+	})
+	require.NoError(t, err)
+	held := newTestMessage("msg-1", "hello", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil)
+	due := newTestMessage("msg-2", "world", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), nil)
+	resp, err := app.LambdaHandler(context.Background(), &sqpulser.SQSEvent{
+		Records: []types.Message{held, due},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []sqpulser.BatchItemFailureItem{{ItemIdentifier: "msg-1"}}, resp.BatchItemFailures)
+	require.Len(t, client.changed, 1)
+	require.Len(t, client.sent, 1)
+	require.Equal(t, "world", *client.sent[0].MessageBody)
+}
+
+func TestNewWithClientFIFOHoldExceedsMaxReceiveCount(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	cases := []struct {
+		name         string
+		policy       string
+		schedule     string
+		maxEmitDelay time.Duration
+		errString    string
+	}{
+		{
+			name:      "default max emit delay",
+			policy:    `{"deadLetterTargetArn":"arn:aws:sqs:ap-northeast-1:012345678900:sqpulser-dlq.fifo","maxReceiveCount":5}`,
+			schedule:  "*/15 * * * *",
+			errString: "messages held in FIFO incoming queue for up to 168h0m0s are received 15 times, exceeding maxReceiveCount 5 of its redrive policy; raise maxReceiveCount or lower max emit delay",
+		},
+		{
+			name:         "weekend gap of schedule",
+			policy:       `{"deadLetterTargetArn":"arn:aws:sqs:ap-northeast-1:012345678900:sqpulser-dlq.fifo","maxReceiveCount":"5"}`,
+			schedule:     "0 9,18 * * 1-5",
+			maxEmitDelay: time.Hour,
+			errString:    "messages held in FIFO incoming queue for up to 63h0m0s are received 7 times, exceeding maxReceiveCount 5 of its redrive policy; raise maxReceiveCount or lower max emit delay",
+		},
+		{
+			name:         "within max receive count",
+			policy:       `{"deadLetterTargetArn":"arn:aws:sqs:ap-northeast-1:012345678900:sqpulser-dlq.fifo","maxReceiveCount":"5"}`,
+			schedule:     "*/15 * * * *",
+			maxEmitDelay: 48 * time.Hour,
+		},
+		{
+			name:     "without redrive policy",
+			schedule: "*/15 * * * *",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &fakeSQSClient{}
+			if c.policy != "" {
+				client.queueAttributes = map[string]map[string]string{
+					testIncomingFIFOQueueURL: {"RedrivePolicy": c.policy},
+				}
+			}
+			_, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+				IncomingQueueURL: testIncomingFIFOQueueURL,
+				OutgoingQueueURL: testOutgoingQueueURL,
+				Schedule:         Must(sqpulser.ParseSchedule(c.schedule)),
+				MaxEmitDelay:     c.maxEmitDelay,
+			})
+			if c.errString != "" {
+				require.EqualError(t, err, c.errString)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
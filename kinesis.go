@@ -0,0 +1,147 @@
+package sqpulser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+type KinesisClient interface {
+	PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error)
+}
+
+const (
+	kinesisMaxBatchRecords      = 500
+	kinesisMaxBatchPayloadSize  = 5 * 1024 * 1024
+	kinesisMaxRecordSize        = 1024 * 1024
+	kinesisMaxPartitionKeyChars = 256
+)
+
+// KinesisSink puts messages to a Kinesis data stream as records.
+// The record data is the message body, and the partition key is the string value of the partition key attribute,
+// or the original message id if the message does not have the attribute.
+// Used as a destination of App, the due messages are buffered in the state store and put once per emit window.
+type KinesisSink struct {
+	client                KinesisClient
+	stream                string
+	partitionKeyAttribute string
+}
+
+// NewKinesisSink returns the sink of the stream, which is a stream name or ARN.
+// The records are put by the stream name of the ARN, so the stream must be in the region and the account of the client.
+func NewKinesisSink(client KinesisClient, stream string, partitionKeyAttribute string) *KinesisSink {
+	return &KinesisSink{
+		client:                client,
+		stream:                stream,
+		partitionKeyAttribute: partitionKeyAttribute,
+	}
+}
+
+func (app *App) newKinesisSink(stream string, partitionKeyAttribute string) (*KinesisSink, error) {
+	if app.opt.KinesisClient == nil {
+		return nil, fmt.Errorf("Kinesis client is required to put records to %s", stream)
+	}
+	return NewKinesisSink(app.opt.KinesisClient, stream, partitionKeyAttribute), nil
+}
+
+// String implements Sink.
+func (s *KinesisSink) String() string {
+	return s.stream
+}
+
+// Emit implements Sink, it puts records by PutRecords.
+func (s *KinesisSink) Emit(ctx context.Context, msgs []*OutgoingMessage) []error {
+	errs := make([]error, len(msgs))
+	var (
+		records []kinesistypes.PutRecordsRequestEntry
+		indexes []int
+		size    int
+	)
+	flush := func() {
+		if len(records) == 0 {
+			return
+		}
+		s.putRecords(ctx, records, indexes, errs)
+		records, indexes, size = nil, nil, 0
+	}
+	for i, msg := range msgs {
+		partitionKey := s.partitionKey(msg)
+		if partitionKey == "" {
+			errs[i] = errors.New("partition key is empty")
+			continue
+		}
+		if len([]rune(partitionKey)) > kinesisMaxPartitionKeyChars {
+			errs[i] = fmt.Errorf("partition key is longer than %d characters", kinesisMaxPartitionKeyChars)
+			continue
+		}
+		recordSize := len(msg.Body) + len(partitionKey)
+		if recordSize > kinesisMaxRecordSize {
+			errs[i] = fmt.Errorf("record size %d exceeds %d bytes", recordSize, kinesisMaxRecordSize)
+			continue
+		}
+		if len(records) >= kinesisMaxBatchRecords || size+recordSize > kinesisMaxBatchPayloadSize {
+			flush()
+		}
+		records = append(records, kinesistypes.PutRecordsRequestEntry{
+			Data:         []byte(msg.Body),
+			PartitionKey: aws.String(partitionKey),
+		})
+		indexes = append(indexes, i)
+		size += recordSize
+	}
+	flush()
+	return errs
+}
+
+func (s *KinesisSink) partitionKey(msg *OutgoingMessage) string {
+	if s.partitionKeyAttribute != "" {
+		if attr, ok := msg.MessageAttributes[s.partitionKeyAttribute]; ok && aws.ToString(attr.StringValue) != "" {
+			return *attr.StringValue
+		}
+	}
+	if msg.Original != nil && msg.Original.MessageID != "" {
+		return msg.Original.MessageID
+	}
+	return msg.ID
+}
+
+// kinesisStreamName returns the stream name of the stream name or ARN (arn:aws:kinesis:<region>:<account>:stream/<name>).
+func kinesisStreamName(stream string) string {
+	if !strings.HasPrefix(stream, "arn:") {
+		return stream
+	}
+	if i := strings.LastIndex(stream, ":stream/"); i >= 0 {
+		return stream[i+len(":stream/"):]
+	}
+	return stream
+}
+
+func (s *KinesisSink) putRecords(ctx context.Context, records []kinesistypes.PutRecordsRequestEntry, indexes []int, errs []error) {
+	input := &kinesis.PutRecordsInput{
+		Records:    records,
+		StreamName: aws.String(kinesisStreamName(s.stream)),
+	}
+	output, err := s.client.PutRecords(ctx, input)
+	if err != nil {
+		for _, i := range indexes {
+			errs[i] = err
+		}
+		return
+	}
+	// the result records are in the same order as the request records.
+	for j, i := range indexes {
+		if j >= len(output.Records) {
+			errs[i] = errors.New("no result of put records entry " + strconv.Itoa(j))
+			continue
+		}
+		if result := output.Records[j]; result.ErrorCode != nil {
+			errs[i] = fmt.Errorf("%s: %s", aws.ToString(result.ErrorCode), aws.ToString(result.ErrorMessage))
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package sqpulser_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLambdaHandlerKinesis(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	kinesisClient := &fakeKinesisClient{
+		failed: func(data string) bool {
+			return data == "body-3"
+		},
+	}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL:      testIncomingQueueURL,
+		OutgoingStream:        "sqpulser-stream",
+		PartitionKeyAttribute: "UserID",
+		KinesisClient:         kinesisClient,
+		EmitInterval:          15 * time.Minute,
+		StateStore:            sqpulser.NewMemoryStateStore(),
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli()
+	resp, err := app.LambdaHandler(context.Background(), &sqpulser.SQSEvent{
+		Records: []types.Message{
+			newTestMessage("msg-1", "body-1", sentTimestamp, map[string]types.MessageAttributeValue{
+				"UserID": {DataType: aws.String("String"), StringValue: aws.String("user-1")},
+			}),
+			newTestMessage("msg-2", "body-2", sentTimestamp, nil),
+			newTestMessage("msg-3", "body-3", sentTimestamp, nil),
+			newTestMessage("msg-4", "body-4", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil),
+		},
+	})
+	require.NoError(t, err)
+	require.Empty(t, resp.BatchItemFailures)
+
+	// not due yet, resent to the incoming queue, and the due messages are buffered until the flush.
+	require.Len(t, client.sent, 2)
+	require.Len(t, flushMessages(client), 1)
+	require.Empty(t, kinesisClient.puts)
+
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")))
+	flushes := flushMessages(client)
+	require.Len(t, flushes, 1)
+	// the flush message is retried, if a record of the window fails.
+	_, err = app.LambdaHandler(context.Background(), &sqpulser.SQSEvent{Records: flushes})
+	require.EqualError(t, err, "failure message id: "+*flushes[0].MessageId)
+
+	// all buffered messages are put in one call.
+	require.Len(t, kinesisClient.puts, 1)
+	input := kinesisClient.puts[0]
+	require.Equal(t, "sqpulser-stream", *input.StreamName)
+	require.Len(t, input.Records, 3)
+	require.Equal(t, "body-1", string(input.Records[0].Data))
+	require.Equal(t, "user-1", *input.Records[0].PartitionKey)
+	require.Equal(t, "msg-2", *input.Records[1].PartitionKey)
+}
+
+func TestHandleMessagesKinesisWindow(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	kinesisClient := &fakeKinesisClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingStream:   "sqpulser-stream",
+		KinesisClient:    kinesisClient,
+		EmitInterval:     15 * time.Minute,
+		StateStore:       sqpulser.NewMemoryStateStore(),
+	})
+	require.NoError(t, err)
+	// 25 messages of the same pulse are received in 3 batches of at most 10 messages.
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli()
+	for i := 0; i < 25; i += 10 {
+		var msgs []types.Message
+		for j := i; j < i+10 && j < 25; j++ {
+			msgs = append(msgs, newTestMessage(fmt.Sprintf("msg-%d", j), fmt.Sprintf("body-%d", j), sentTimestamp, nil))
+		}
+		require.Equal(t, make([]error, len(msgs)), app.HandleMessages(context.Background(), msgs))
+	}
+	require.Empty(t, kinesisClient.puts)
+
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")))
+	flushes := flushMessages(client)
+	require.Len(t, flushes, 1)
+	require.Equal(t, []error{nil}, app.HandleMessages(context.Background(), flushes))
+	require.Len(t, kinesisClient.puts, 1)
+	require.Len(t, kinesisClient.puts[0].Records, 25)
+	for i, record := range kinesisClient.puts[0].Records {
+		require.Equal(t, fmt.Sprintf("body-%d", i), string(record.Data))
+	}
+
+	// the window has been flushed.
+	require.Equal(t, []error{nil}, app.HandleMessages(context.Background(), flushes))
+	require.Len(t, kinesisClient.puts, 1)
+}
+
+func TestNewWithClientKinesisWithoutStateStore(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingStream:   "sqpulser-stream",
+		KinesisClient:    &fakeKinesisClient{},
+		EmitInterval:     15 * time.Minute,
+	})
+	require.EqualError(t, err, "sqpulser-stream requires state store or state table, to emit messages once per emit window")
+}
+
+func TestKinesisSinkBatch(t *testing.T) {
+	kinesisClient := &fakeKinesisClient{}
+	sink := sqpulser.NewKinesisSink(kinesisClient, "arn:aws:kinesis:ap-northeast-1:012345678900:stream/sqpulser-stream", "Key")
+	msgs := make([]*sqpulser.OutgoingMessage, 0, 1002)
+	for i := 0; i < 1000; i++ {
+		msgs = append(msgs, &sqpulser.OutgoingMessage{
+			ID:       fmt.Sprintf("msg-%d", i),
+			Body:     "body",
+			Original: &sqpulser.OriginalAttributes{MessageID: fmt.Sprintf("original-%d", i)},
+		})
+	}
+	msgs = append(msgs,
+		&sqpulser.OutgoingMessage{ID: "too-large", Body: strings.Repeat("x", 1024*1024)},
+		&sqpulser.OutgoingMessage{ID: "too-long-key", Body: "body", MessageAttributes: map[string]types.MessageAttributeValue{
+			"Key": {DataType: aws.String("String"), StringValue: aws.String(strings.Repeat("k", 257))},
+		}},
+	)
+	errs := sink.Emit(context.Background(), msgs)
+	require.Equal(t, make([]error, 1000), errs[:1000])
+	require.EqualError(t, errs[1000], "record size 1048585 exceeds 1048576 bytes")
+	require.EqualError(t, errs[1001], "partition key is longer than 256 characters")
+	require.Len(t, kinesisClient.puts, 2)
+	require.Equal(t, "sqpulser-stream", *kinesisClient.puts[0].StreamName)
+	require.Len(t, kinesisClient.puts[0].Records, 500)
+	require.Len(t, kinesisClient.puts[1].Records, 500)
+	require.Equal(t, "original-0", *kinesisClient.puts[0].Records[0].PartitionKey)
+}
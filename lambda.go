@@ -2,16 +2,44 @@ package sqpulser
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 )
 
 type SQSEvent struct {
 	Records []types.Message
+	// EventSourceARNs is the event source ARN of each record, used to dispatch records to pipelines.
+	EventSourceARNs []string `json:"-"`
 }
+
+// UnmarshalJSON implements json.Unmarshaler, to keep the event source ARN of each record.
+func (e *SQSEvent) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Records []json.RawMessage
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	e.Records = make([]types.Message, len(raw.Records))
+	e.EventSourceARNs = make([]string, len(raw.Records))
+	for i, record := range raw.Records {
+		if err := json.Unmarshal(record, &e.Records[i]); err != nil {
+			return err
+		}
+		var source struct {
+			EventSourceARN string `json:"eventSourceARN"`
+		}
+		if err := json.Unmarshal(record, &source); err != nil {
+			return err
+		}
+		e.EventSourceARNs[i] = source.EventSourceARN
+	}
+	return nil
+}
+
 type SQSBatchResponse struct {
 	BatchItemFailures []BatchItemFailureItem `json:"batchItemFailures,omitempty"`
 }
@@ -28,22 +56,22 @@ func (app *App) LambdaHandler(ctx context.Context, event *SQSEvent) (*SQSBatchRe
 		if record.MessageId == nil {
 			return nil, errors.New("message id is empty, maybe not sqs event")
 		}
-		func() {
-			defer func() {
-				if err := recover(); err != nil {
-					log.Printf("[error][%s] handle message panic %v", *record.MessageId, err)
-					resp.BatchItemFailures = append(resp.BatchItemFailures, BatchItemFailureItem{
-						ItemIdentifier: *record.MessageId,
-					})
-				}
-			}()
-			if err := app.HandleMessage(ctx, &record); err != nil {
-				log.Printf("[error][%s] %v", *record.MessageId, err)
-				resp.BatchItemFailures = append(resp.BatchItemFailures, BatchItemFailureItem{
-					ItemIdentifier: *record.MessageId,
-				})
+	}
+	// panics are recovered per message or per request in handleMessages, so that the sent messages are not retried.
+	errs, reports := app.handleMessages(ctx, event.Records, event.EventSourceARNs)
+	for _, report := range reports {
+		report.app.writeEMF(report)
+	}
+	app.cleanupLargePayloadRecords(ctx, event.Records, errs, reports)
+	for i, record := range event.Records {
+		if errs[i] != nil {
+			if !errors.Is(errs[i], ErrMessageHeld) {
+				app.logf("[error][%s] %v", *record.MessageId, errs[i])
 			}
-		}()
+			resp.BatchItemFailures = append(resp.BatchItemFailures, BatchItemFailureItem{
+				ItemIdentifier: *record.MessageId,
+			})
+		}
 	}
 	if len(event.Records) == 1 && len(resp.BatchItemFailures) == 1 {
 		//no batch
@@ -51,3 +79,21 @@ func (app *App) LambdaHandler(ctx context.Context, event *SQSEvent) (*SQSBatchRe
 	}
 	return resp, nil
 }
+
+// cleanupLargePayloadRecords deletes the succeeded records having large payloads to clean up from the incoming queue, and then the payloads.
+// The other succeeded records are deleted by the Lambda service after the invocation.
+func (app *App) cleanupLargePayloadRecords(ctx context.Context, records []types.Message, errs []error, reports []*handleReport) {
+	for _, report := range reports {
+		if len(report.cleanups) == 0 {
+			continue
+		}
+		var msgs []types.Message
+		for i, record := range records {
+			if errs[i] == nil && len(report.cleanups[*record.MessageId]) > 0 {
+				msgs = append(msgs, record)
+			}
+		}
+		deleted := report.app.deleteBatch(ctx, msgs)
+		report.app.cleanupLargePayloads(ctx, []*handleReport{report}, deleted)
+	}
+}
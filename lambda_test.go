@@ -1,9 +1,12 @@
 package sqpulser_test
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/Songmu/flextime"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/mashiike/sqpulser"
@@ -73,6 +76,51 @@ func TestSQSEventUnmarshal(t *testing.T) {
 				MD5OfBody: aws.String("098f6bcd4621d373cade4e832627b4f6"),
 			},
 		},
+		EventSourceARNs: []string{"arn:aws:sqs:us-east-2:123456789012:my-queue"},
 	}
 	require.EqualValues(t, expected, &actual)
 }
+
+func TestLambdaHandlerPanic(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		SNSClient: &fakeSNSClient{
+			failed: func(body string) bool {
+				panic("something wrong")
+			},
+		},
+		Routing: &sqpulser.RoutingConfig{
+			Destinations: []*sqpulser.DestinationConfig{
+				{Name: "reports", QueueURL: testReportsQueueURL},
+				{Name: "alerts", TopicARN: testOutgoingTopicARN},
+			},
+			Rules: []*sqpulser.RoutingRule{
+				{Attributes: map[string]string{"Team": "report"}, Destinations: []string{"reports"}},
+				{Attributes: map[string]string{"Team": "alert"}, Destinations: []string{"alerts"}},
+			},
+		},
+	})
+	require.NoError(t, err)
+	team := func(name string) map[string]types.MessageAttributeValue {
+		return map[string]types.MessageAttributeValue{
+			"Team": {DataType: aws.String("String"), StringValue: aws.String(name)},
+		}
+	}
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli()
+	resp, err := app.LambdaHandler(context.Background(), &sqpulser.SQSEvent{
+		Records: []types.Message{
+			newTestMessage("msg-1", "body-1", sentTimestamp, team("report")),
+			newTestMessage("msg-2", "body-2", sentTimestamp, team("alert")),
+		},
+	})
+	require.NoError(t, err)
+	// only the message emitted to the panicked sink is retried, the message sent to the queue is not.
+	require.Equal(t, []sqpulser.BatchItemFailureItem{{ItemIdentifier: "msg-2"}}, resp.BatchItemFailures)
+	require.Len(t, client.sent, 1)
+	require.Equal(t, testReportsQueueURL, *client.sent[0].QueueUrl)
+}
@@ -0,0 +1,95 @@
+package sqpulser
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// ExpiresAtAttributeKey specifies the deadline of the delivery in RFC3339.
+	ExpiresAtAttributeKey = "SqpulserExpiresAt"
+	// LateAttributeKey is set to `true` on the message delivered after its deadline by LatePolicyDeliver.
+	LateAttributeKey = "SqpulserLate"
+)
+
+// LatePolicy decides what to do with the message which is due after its deadline.
+type LatePolicy string
+
+const (
+	// LatePolicyDeliver delivers the late message with the SqpulserLate attribute.
+	LatePolicyDeliver LatePolicy = "deliver"
+	// LatePolicyDrop deletes the late message without delivery.
+	LatePolicyDrop LatePolicy = "drop"
+	// LatePolicyDeadLetter sends the late message to the dead-letter queue.
+	LatePolicyDeadLetter LatePolicy = "dead-letter"
+)
+
+// ParseLatePolicy parses the late policy string.
+func ParseLatePolicy(str string) (LatePolicy, error) {
+	switch p := LatePolicy(strings.ToLower(str)); p {
+	case "":
+		return LatePolicyDeliver, nil
+	case LatePolicyDeliver, LatePolicyDrop, LatePolicyDeadLetter:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown late policy `%s`", str)
+	}
+}
+
+// lateness returns the reason if the message is past its deadline,
+// which is MaxLateness after the emit time or the time of the SqpulserExpiresAt attribute, whichever is earlier.
+// MaxLateness is checked only on the due message.
+func (app *App) lateness(p *pendingMessage) (string, error) {
+	now := flextime.Now()
+	if str, ok, err := stringAttributeValue(p.msg, ExpiresAtAttributeKey); err != nil {
+		return "", err
+	} else if ok {
+		expiresAt, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return "", fmt.Errorf("%s attribute value parse failed: %w", ExpiresAtAttributeKey, err)
+		}
+		if now.After(expiresAt) {
+			return fmt.Sprintf("expired at %s", expiresAt.Format(time.RFC3339)), nil
+		}
+	}
+	if app.opt.MaxLateness > 0 && p.delay == 0 {
+		if late := now.Sub(p.emitTime); late > app.opt.MaxLateness {
+			return fmt.Sprintf("late %s exceeds max lateness %s", late, app.opt.MaxLateness), nil
+		}
+	}
+	return "", nil
+}
+
+// expire applies the late policy to the message past its deadline.
+// It is called on every receive, so that the message expired before its emit time is not resent until the emit time.
+// It returns true if the message is not delivered, with the request to the dead-letter queue if any.
+func (app *App) expire(p *pendingMessage) (*sendRequest, bool, error) {
+	reason, err := app.lateness(p)
+	if err != nil || reason == "" {
+		return nil, false, err
+	}
+	switch app.opt.LatePolicy {
+	case LatePolicyDrop:
+		app.logf("[warn][%s] %s, drop the message", *p.msg.MessageId, reason)
+		return nil, true, nil
+	case LatePolicyDeadLetter:
+		req, err := app.newDeadLetterRequest(p, reason)
+		return req, true, err
+	default:
+		app.logf("[warn][%s] %s, deliver the message as late", *p.msg.MessageId, reason)
+		p.late = true
+		return nil, false, nil
+	}
+}
+
+func setLateAttribute(attributes map[string]types.MessageAttributeValue) {
+	attributes[LateAttributeKey] = types.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String("true"),
+	}
+}
@@ -0,0 +1,175 @@
+package sqpulser_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func newLateTestMessages() []types.Message {
+	expiresAt := func(value string) map[string]types.MessageAttributeValue {
+		return map[string]types.MessageAttributeValue{
+			sqpulser.ExpiresAtAttributeKey: {DataType: aws.String("String"), StringValue: aws.String(value)},
+		}
+	}
+	return []types.Message{
+		// emitted at 21:15, 16 minutes late.
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:10:00Z")).UnixMilli(), nil),
+		// emitted at 21:30, 1 minute late.
+		newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-3", "body-3", Must(time.Parse(time.RFC3339, "2018-12-17T21:25:00Z")).UnixMilli(), expiresAt("2018-12-17T21:29:00Z")),
+		newTestMessage("msg-4", "body-4", Must(time.Parse(time.RFC3339, "2018-12-17T21:25:00Z")).UnixMilli(), expiresAt("tomorrow")),
+	}
+}
+
+func TestHandleMessagesLatePolicy(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	cases := []struct {
+		policy   sqpulser.LatePolicy
+		expected []string
+		queueURL string
+	}{
+		{policy: sqpulser.LatePolicyDeliver, expected: []string{"body-1", "body-2", "body-3"}, queueURL: testOutgoingQueueURL},
+		{policy: sqpulser.LatePolicyDrop, expected: []string{"body-2"}, queueURL: testOutgoingQueueURL},
+		{policy: sqpulser.LatePolicyDeadLetter, expected: []string{"body-1", "body-2", "body-3"}, queueURL: testDeadLetterQueueURL},
+	}
+	for _, c := range cases {
+		t.Run(string(c.policy), func(t *testing.T) {
+			client := &fakeSQSClient{}
+			app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+				IncomingQueueURL:   testIncomingQueueURL,
+				OutgoingQueueURL:   testOutgoingQueueURL,
+				EmitInterval:       15 * time.Minute,
+				MaxLateness:        10 * time.Minute,
+				LatePolicy:         c.policy,
+				DeadLetterQueueURL: testDeadLetterQueueURL,
+			})
+			require.NoError(t, err)
+			errs := app.HandleMessages(context.Background(), newLateTestMessages())
+			require.NoError(t, errs[0])
+			require.NoError(t, errs[1])
+			require.NoError(t, errs[2])
+			require.EqualError(t, errs[3], `SqpulserExpiresAt attribute value parse failed: parsing time "tomorrow" as "2006-01-02T15:04:05Z07:00": cannot parse "tomorrow" as "2006"`)
+
+			var bodies []string
+			for _, input := range client.sent {
+				bodies = append(bodies, *input.MessageBody)
+				late, ok := input.MessageAttributes[sqpulser.LateAttributeKey]
+				switch *input.MessageBody {
+				case "body-2":
+					require.Equal(t, testOutgoingQueueURL, *input.QueueUrl)
+					require.False(t, ok)
+				case "body-1", "body-3":
+					require.Equal(t, c.queueURL, *input.QueueUrl)
+					if c.policy == sqpulser.LatePolicyDeliver {
+						require.Equal(t, "true", *late.StringValue)
+					} else {
+						require.Contains(t, input.MessageAttributes, sqpulser.DeadLetterReasonAttributeKey)
+					}
+				}
+			}
+			require.ElementsMatch(t, c.expected, bodies)
+		})
+	}
+}
+
+func TestHandleMessagesExpiresBeforeEmitTime(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL:   testIncomingQueueURL,
+		OutgoingQueueURL:   testOutgoingQueueURL,
+		EmitInterval:       time.Hour,
+		MaxLateness:        time.Minute,
+		LatePolicy:         sqpulser.LatePolicyDeadLetter,
+		DeadLetterQueueURL: testDeadLetterQueueURL,
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli()
+	expiresAt := func(value string) map[string]types.MessageAttributeValue {
+		return map[string]types.MessageAttributeValue{
+			sqpulser.ExpiresAtAttributeKey: {DataType: aws.String("String"), StringValue: aws.String(value)},
+		}
+	}
+	// not due until 22:00.
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", sentTimestamp, expiresAt("2018-12-17T21:30:00Z")),
+		newTestMessage("msg-2", "body-2", sentTimestamp, expiresAt("2018-12-17T21:45:00Z")),
+	})
+	require.Equal(t, make([]error, 2), errs)
+	require.Len(t, client.sent, 2)
+	for _, input := range client.sent {
+		switch *input.MessageBody {
+		case "body-1":
+			// expired, not resent until the emit time.
+			require.Equal(t, testDeadLetterQueueURL, *input.QueueUrl)
+			require.Equal(t, "expired at 2018-12-17T21:30:00Z", *input.MessageAttributes[sqpulser.DeadLetterReasonAttributeKey].StringValue)
+		case "body-2":
+			require.Equal(t, testIncomingQueueURL, *input.QueueUrl)
+		}
+	}
+}
+
+func TestHandleMessagesLateAggregate(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		MaxLateness:      10 * time.Minute,
+		AggregateFormat:  sqpulser.AggregateFormatJSON,
+		StateStore:       sqpulser.NewMemoryStateStore(),
+	})
+	require.NoError(t, err)
+	errs := app.HandleMessages(context.Background(), newLateTestMessages()[:2])
+	require.Equal(t, make([]error, 2), errs)
+	flushes := flushMessages(client)
+	require.Len(t, flushes, 2)
+
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")))
+	errs = app.HandleMessages(context.Background(), flushes)
+	require.Equal(t, make([]error, 2), errs)
+	require.Len(t, client.sent, 4)
+	entries, err := sqpulser.AggregateFormatJSON.DecodeAggregatedBody(*client.sent[2].MessageBody)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "true", *entries[0].MessageAttributes[sqpulser.LateAttributeKey].StringValue)
+	entries, err = sqpulser.AggregateFormatJSON.DecodeAggregatedBody(*client.sent[3].MessageBody)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.NotContains(t, entries[0].MessageAttributes, sqpulser.LateAttributeKey)
+}
+
+func TestNewWithClientUnknownLatePolicy(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		LatePolicy:       "ignore",
+	})
+	require.EqualError(t, err, "unknown late policy `ignore`")
+}
+
+func TestNewWithClientLatePolicyDeadLetterWithoutQueue(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		MaxLateness:      10 * time.Minute,
+		LatePolicy:       sqpulser.LatePolicyDeadLetter,
+	})
+	require.EqualError(t, err, "late policy dead-letter requires dead-letter queue url or name")
+}
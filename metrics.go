@@ -0,0 +1,296 @@
+package sqpulser
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons of dropped messages, which are deleted from the incoming queue without delivery.
+const (
+	dropReasonDuplicate  = "duplicate"
+	dropReasonExpired    = "expired"
+	dropReasonDeadLetter = "dead_letter"
+)
+
+// handleReport is the outcome of HandleMessages.
+// Emitted, extended and dropped are counted per destination of the messages, others are per message.
+type handleReport struct {
+	app       *App
+	received  int
+	firstTime int
+	emitted   int
+	// extended is the number of messages resent to or held in the incoming queue.
+	extended int
+	dropped  map[string]int
+	failed   map[string]int
+	// lateness is the max duration from the emit time to the actual emission.
+	lateness time.Duration
+	// maxRemainingDelay is the max duration until the emit time of the extended messages.
+	maxRemainingDelay time.Duration
+	duration          time.Duration
+	// cleanups are the large payloads to delete after the received message is deleted, by the message id.
+	cleanups map[string][]*S3Pointer
+}
+
+func newHandleReport(app *App, received int) *handleReport {
+	return &handleReport{
+		app:      app,
+		received: received,
+		dropped:  make(map[string]int),
+		failed:   make(map[string]int),
+	}
+}
+
+// observeRemaining records the delay until the emit time of an extended message.
+func (r *handleReport) observeRemaining(delay time.Duration) {
+	if delay > r.maxRemainingDelay {
+		r.maxRemainingDelay = delay
+	}
+}
+
+// failures returns the number of the failed messages.
+func (r *handleReport) failures() int {
+	var n int
+	for _, count := range r.failed {
+		n += count
+	}
+	return n
+}
+
+// collect counts the results of the send requests and the errors of the messages.
+func (r *handleReport) collect(requests []*sendRequest, errs []error) {
+	app, now := r.app, flextime.Now()
+	for _, req := range requests {
+		for _, p := range req.members {
+			if errs[p.index] != nil {
+				continue
+			}
+			queueURL := aws.ToString(req.input.QueueUrl)
+			switch {
+			case req.sink == nil && queueURL == app.opt.IncomingQueueURL:
+				r.extended++
+				r.observeRemaining(p.delay)
+			case req.sink == nil && queueURL == app.opt.DeadLetterQueueURL:
+				r.dropped[dropReasonDeadLetter]++
+			default:
+				r.emitted++
+				lateness := now.Add(time.Duration(req.input.DelaySeconds) * time.Second).Sub(p.emitTime)
+				if lateness > r.lateness {
+					r.lateness = lateness
+				}
+			}
+		}
+	}
+	for _, err := range errs {
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrMessageHeld):
+			r.extended++
+		case errors.Is(err, ErrSafeguardViolation):
+			r.failed["safeguard"]++
+		default:
+			r.failed[classifyError(err).String()]++
+		}
+	}
+}
+
+// metrics is the Prometheus metrics shared by the app and its pipelines, labeled by the incoming queue name.
+type metrics struct {
+	registry       *prometheus.Registry
+	received       *prometheus.CounterVec
+	emitted        *prometheus.CounterVec
+	extended       *prometheus.CounterVec
+	dropped        *prometheus.CounterVec
+	failed         *prometheus.CounterVec
+	deleteFailures *prometheus.CounterVec
+	handleDuration *prometheus.HistogramVec
+	lateness       *prometheus.GaugeVec
+	nextPulse      *prometheus.Desc
+
+	mu   sync.Mutex
+	apps []*App
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sqpulser_messages_received_total",
+			Help: "Number of messages received from the incoming queue.",
+		}, []string{"queue"}),
+		emitted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sqpulser_messages_emitted_total",
+			Help: "Number of messages emitted to the outgoing destinations.",
+		}, []string{"queue"}),
+		extended: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sqpulser_messages_extended_total",
+			Help: "Number of messages resent to or held in the incoming queue until the emit time.",
+		}, []string{"queue"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sqpulser_messages_dropped_total",
+			Help: "Number of messages deleted without emission, by reason.",
+		}, []string{"queue", "reason"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sqpulser_messages_failed_total",
+			Help: "Number of messages failed to handle, by reason.",
+		}, []string{"queue", "reason"}),
+		deleteFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sqpulser_delete_failures_total",
+			Help: "Number of handled messages failed to delete from the incoming queue.",
+		}, []string{"queue"}),
+		handleDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sqpulser_handle_duration_seconds",
+			Help:    "Latency of handling a batch of received messages.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"queue"}),
+		lateness: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sqpulser_emit_lateness_seconds",
+			Help: "Max duration from the emit time to the actual emission, in the last handled batch.",
+		}, []string{"queue"}),
+		nextPulse: prometheus.NewDesc(
+			"sqpulser_next_pulse_seconds",
+			"Seconds until the next pulse of the emit schedule.",
+			[]string{"queue"}, nil,
+		),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.received, m.emitted, m.extended, m.dropped, m.failed, m.deleteFailures, m.handleDuration, m.lateness,
+		m,
+	)
+	return m
+}
+
+// watch adds the app to the targets of the next pulse gauge.
+func (m *metrics) watch(app *App) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apps = append(m.apps, app)
+}
+
+// Describe implements prometheus.Collector for the next pulse gauge.
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.nextPulse
+}
+
+// Collect implements prometheus.Collector for the next pulse gauge.
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := flextime.Now()
+	for _, app := range m.apps {
+		next, ok := app.nextPulse(now)
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(m.nextPulse, prometheus.GaugeValue, next.Sub(now).Seconds(), app.metricsQueue())
+	}
+}
+
+// nextPulse returns the earliest next pulse of the destinations after now.
+func (app *App) nextPulse(now time.Time) (time.Time, bool) {
+	if app.router == nil {
+		return time.Time{}, false
+	}
+	var next time.Time
+	dests := append([]*destination{}, app.router.defaults...)
+	for _, dest := range app.router.destinations {
+		dests = append(dests, dest)
+	}
+	for _, dest := range dests {
+		if dest.schedule == nil {
+			continue
+		}
+		t := app.inLocation(dest.schedule).Next(now)
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next, !next.IsZero()
+}
+
+func (app *App) metricsQueue() string {
+	return queueName(app.opt.IncomingQueueURL)
+}
+
+// observe records the report of HandleMessages.
+func (m *metrics) observe(r *handleReport) {
+	if m == nil {
+		return
+	}
+	queue := r.app.metricsQueue()
+	m.received.WithLabelValues(queue).Add(float64(r.received))
+	m.emitted.WithLabelValues(queue).Add(float64(r.emitted))
+	m.extended.WithLabelValues(queue).Add(float64(r.extended))
+	for reason, n := range r.dropped {
+		m.dropped.WithLabelValues(queue, reason).Add(float64(n))
+	}
+	for reason, n := range r.failed {
+		m.failed.WithLabelValues(queue, reason).Add(float64(n))
+	}
+	m.handleDuration.WithLabelValues(queue).Observe(r.duration.Seconds())
+	if r.emitted > 0 {
+		m.lateness.WithLabelValues(queue).Set(r.lateness.Seconds())
+	}
+}
+
+func (m *metrics) deleteFailed(app *App, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.deleteFailures.WithLabelValues(app.metricsQueue()).Add(float64(n))
+}
+
+// MetricsHandler returns the HTTP handler of the Prometheus metrics. If Option.MetricsAddr is empty, it returns 404.
+func (app *App) MetricsHandler() http.Handler {
+	if app.metrics == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(app.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// metricsShutdownTimeout is the timeout to shut down the metrics server after polling stops.
+const metricsShutdownTimeout = 5 * time.Second
+
+// serveMetrics serves the metrics on Option.MetricsAddr until ctx is done.
+func (app *App) serveMetrics(ctx context.Context) error {
+	ln, err := net.Listen("tcp", app.opt.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", app.MetricsHandler())
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	app.logf("[info] serve metrics: http://%s/metrics", ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.logf("[error] serve metrics: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			app.logf("[warn] shutdown metrics server: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,182 @@
+package sqpulser_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func scrapeMetrics(t *testing.T, app *sqpulser.App) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	app.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
+
+func TestHandleMessagesMetrics(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     time.Hour,
+		MaxHops:          1,
+		LatePolicy:       sqpulser.LatePolicyDrop,
+		MetricsAddr:      "127.0.0.1:0",
+	})
+	require.NoError(t, err)
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T20:50:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-3", "body-3", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+			sqpulser.HopCountAttributeKey: {DataType: aws.String("Number"), StringValue: aws.String("1")},
+		}),
+		newTestMessage("msg-4", "body-4", Must(time.Parse(time.RFC3339, "2018-12-17T20:50:00Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+			sqpulser.ExpiresAtAttributeKey: {DataType: aws.String("String"), StringValue: aws.String("2018-12-17T21:10:00Z")},
+		}),
+	})
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.ErrorIs(t, errs[2], sqpulser.ErrSafeguardViolation)
+	require.NoError(t, errs[3])
+
+	body := scrapeMetrics(t, app)
+	for _, expected := range []string{
+		`sqpulser_messages_received_total{queue="sqpulser-in"} 4`,
+		`sqpulser_messages_emitted_total{queue="sqpulser-in"} 1`,
+		`sqpulser_messages_extended_total{queue="sqpulser-in"} 1`,
+		`sqpulser_messages_dropped_total{queue="sqpulser-in",reason="expired"} 1`,
+		`sqpulser_messages_failed_total{queue="sqpulser-in",reason="safeguard"} 1`,
+		`sqpulser_handle_duration_seconds_count{queue="sqpulser-in"} 1`,
+		// msg-1 is emitted at 21:31 for the pulse of 21:00.
+		`sqpulser_emit_lateness_seconds{queue="sqpulser-in"} 1860`,
+		`sqpulser_next_pulse_seconds{queue="sqpulser-in"} 1740`,
+	} {
+		require.Contains(t, body, expected)
+	}
+}
+
+func TestRunMetrics(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	client := &fakeSQSClient{
+		received: [][]types.Message{
+			{
+				newTestMessage("msg-1", "body-1", sentTimestamp, nil),
+				newTestMessage("msg-2", "body-2", sentTimestamp, nil),
+				newTestMessage("msg-3", "body-3", sentTimestamp, nil),
+			},
+		},
+		sendErr: func(input *sqs.SendMessageInput) error {
+			if *input.MessageBody == "body-2" {
+				return errors.New("something wrong")
+			}
+			return nil
+		},
+		deleteErr: func(receiptHandle string) error {
+			if receiptHandle == "handle-msg-3" {
+				return errors.New("invalid")
+			}
+			return nil
+		},
+		onEmpty: cancel,
+	}
+	app, err := sqpulser.NewWithClient(ctx, client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		MetricsAddr:      "127.0.0.1:0",
+	})
+	require.NoError(t, err)
+	require.NoError(t, app.Run(ctx))
+
+	body := scrapeMetrics(t, app)
+	for _, expected := range []string{
+		`sqpulser_messages_received_total{queue="sqpulser-in"} 3`,
+		`sqpulser_messages_emitted_total{queue="sqpulser-in"} 2`,
+		`sqpulser_messages_failed_total{queue="sqpulser-in",reason="transient"} 1`,
+		`sqpulser_delete_failures_total{queue="sqpulser-in"} 1`,
+	} {
+		require.Contains(t, body, expected)
+	}
+}
+
+func TestRunMetricsAddrInUse(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	app, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		MetricsAddr:      server.Listener.Addr().String(),
+	})
+	require.NoError(t, err)
+	err = app.Run(context.Background())
+	require.ErrorContains(t, err, "serve metrics on "+server.Listener.Addr().String())
+}
+
+func TestMetricsHandlerDisabled(t *testing.T) {
+	app, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+	})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	app.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPipelinesMetrics(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	app, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		EmitInterval: 15 * time.Minute,
+		MetricsAddr:  "127.0.0.1:0",
+		Pipelines: []*sqpulser.Option{
+			{IncomingQueueURL: testReportsInQueueURL, OutgoingQueueURL: testReportsOutQueueURL},
+			{IncomingQueueURL: testBatchesInQueueURL, OutgoingQueueURL: testBatchesOutQueueURL, EmitInterval: time.Hour},
+		},
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	_, err = app.LambdaHandler(context.Background(), &sqpulser.SQSEvent{
+		Records: []types.Message{
+			newTestMessage("msg-1", "body-1", sentTimestamp, nil),
+		},
+		EventSourceARNs: []string{
+			"arn:aws:sqs:ap-northeast-1:123456789012:reports-in",
+		},
+	})
+	require.NoError(t, err)
+
+	// pipelines share the metrics of the app, labeled by the incoming queue.
+	body := scrapeMetrics(t, app)
+	for _, expected := range []string{
+		`sqpulser_messages_received_total{queue="reports-in"} 1`,
+		`sqpulser_next_pulse_seconds{queue="reports-in"} 840`,
+		`sqpulser_next_pulse_seconds{queue="batches-in"} 1740`,
+	} {
+		require.Contains(t, body, expected)
+	}
+	require.NotContains(t, body, `sqpulser_messages_received_total{queue="batches-in"}`)
+}
@@ -0,0 +1,150 @@
+package sqpulser
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Message attributes that producers can set to override the schedule per message.
+const (
+	// EmitIntervalAttributeKey overrides the emit interval, the value is a duration string such as `1h`.
+	EmitIntervalAttributeKey = "SqpulserEmitInterval"
+	// OffsetAttributeKey overrides the emit offset, the value is a duration string such as `5m`.
+	OffsetAttributeKey = "SqpulserOffset"
+	// EmitAtAttributeKey specifies the absolute emit time in RFC3339.
+	EmitAtAttributeKey = "SqpulserEmitAt"
+	// DelayAttributeKey specifies the emit time relative to the original sent time, the value is a duration string such as `36h`.
+	DelayAttributeKey = "SqpulserDelay"
+)
+
+// DefaultMaxEmitDelay is the default max duration from the sent time to the emit time overridden by message attributes.
+const DefaultMaxEmitDelay = 7 * 24 * time.Hour
+
+// scheduleOverride is the schedule overridden by message attributes.
+type scheduleOverride struct {
+	emitInterval time.Duration
+	offset       time.Duration
+	emitAt       time.Time
+	delay        time.Duration
+	hasDelay     bool
+}
+
+// extructScheduleOverride extructs the schedule override from message attributes.
+// If the message has no override attributes, it returns nil.
+func extructScheduleOverride(msg *types.Message) (*scheduleOverride, error) {
+	override := &scheduleOverride{}
+	var found bool
+	if str, ok, err := stringAttributeValue(msg, EmitAtAttributeKey); err != nil {
+		return nil, err
+	} else if ok {
+		emitAt, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return nil, fmt.Errorf("%s attribute value parse failed: %w", EmitAtAttributeKey, err)
+		}
+		override.emitAt, found = emitAt, true
+	}
+	if str, ok, err := stringAttributeValue(msg, DelayAttributeKey); err != nil {
+		return nil, err
+	} else if ok {
+		delay, err := time.ParseDuration(str)
+		if err != nil {
+			return nil, fmt.Errorf("%s attribute value parse failed: %w", DelayAttributeKey, err)
+		}
+		if delay < 0 {
+			return nil, fmt.Errorf("%s attribute value must not be negative: %s", DelayAttributeKey, delay)
+		}
+		override.delay, override.hasDelay, found = delay, true, true
+	}
+	if str, ok, err := stringAttributeValue(msg, EmitIntervalAttributeKey); err != nil {
+		return nil, err
+	} else if ok {
+		interval, err := time.ParseDuration(str)
+		if err != nil {
+			return nil, fmt.Errorf("%s attribute value parse failed: %w", EmitIntervalAttributeKey, err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("%s attribute value must be positive: %s", EmitIntervalAttributeKey, interval)
+		}
+		override.emitInterval, found = interval, true
+	}
+	if str, ok, err := stringAttributeValue(msg, OffsetAttributeKey); err != nil {
+		return nil, err
+	} else if ok {
+		offset, err := time.ParseDuration(str)
+		if err != nil {
+			return nil, fmt.Errorf("%s attribute value parse failed: %w", OffsetAttributeKey, err)
+		}
+		override.offset, found = offset, true
+	}
+	if !found {
+		return nil, nil
+	}
+	return override, nil
+}
+
+func stringAttributeValue(msg *types.Message, key string) (string, bool, error) {
+	if msg.MessageAttributes == nil {
+		return "", false, nil
+	}
+	value, ok := msg.MessageAttributes[key]
+	if !ok {
+		return "", false, nil
+	}
+	if value.DataType == nil || !strings.HasPrefix(*value.DataType, "String") {
+		return "", false, fmt.Errorf("%s attribute type is missmatch:%s", key, aws.ToString(value.DataType))
+	}
+	if value.StringValue == nil || *value.StringValue == "" {
+		return "", false, fmt.Errorf("%s attribute value is empty", key)
+	}
+	return *value.StringValue, true, nil
+}
+
+// messageSchedule returns the schedule for the message, considering the schedule override attributes.
+func (app *App) messageSchedule(msg *types.Message, original *OriginalAttributes, dest *destination) (Schedule, error) {
+	override, err := extructScheduleOverride(msg)
+	if err != nil {
+		return nil, err
+	}
+	if override == nil {
+		return app.inLocation(dest.schedule), nil
+	}
+	var schedule Schedule
+	switch {
+	case !override.emitAt.IsZero():
+		schedule = fixedSchedule(override.emitAt)
+	case override.hasDelay:
+		schedule = fixedSchedule(original.SentTime().Add(override.delay))
+	case override.emitInterval > 0:
+		if app.opt.MinEmitInterval > 0 && override.emitInterval < app.opt.MinEmitInterval {
+			return nil, fmt.Errorf("%s attribute value %s is less than min emit interval %s", EmitIntervalAttributeKey, override.emitInterval, app.opt.MinEmitInterval)
+		}
+		if app.opt.MaxEmitInterval > 0 && override.emitInterval > app.opt.MaxEmitInterval {
+			return nil, fmt.Errorf("%s attribute value %s is greater than max emit interval %s", EmitIntervalAttributeKey, override.emitInterval, app.opt.MaxEmitInterval)
+		}
+		schedule = app.inLocation(IntervalSchedule{
+			Interval: override.emitInterval,
+			Offset:   override.offset,
+		})
+	default:
+		if interval, ok := dest.schedule.(IntervalSchedule); ok {
+			schedule = app.inLocation(IntervalSchedule{
+				Interval: interval.Interval,
+				Offset:   override.offset,
+			})
+			break
+		}
+		schedule = offsetSchedule{
+			schedule: app.inLocation(dest.schedule),
+			offset:   override.offset,
+		}
+	}
+	emitTime := original.ScheduledEmitTime(schedule)
+	if delay := emitTime.Sub(original.SentTime()); delay > app.opt.MaxEmitDelay {
+		return nil, fmt.Errorf("overridden emit time %s is %s after sent time, greater than max emit delay %s", emitTime.UTC().Format(time.RFC3339), delay, app.opt.MaxEmitDelay)
+	}
+	return schedule, nil
+}
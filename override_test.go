@@ -0,0 +1,161 @@
+package sqpulser_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMessageScheduleOverride(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	stringAttr := func(v string) types.MessageAttributeValue {
+		return types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+	cases := []struct {
+		name          string
+		schedule      string
+		attrs         map[string]types.MessageAttributeValue
+		errString     string
+		expectedQueue string
+		expectedDelay int32
+	}{
+		{
+			name: "no override",
+			attrs: map[string]types.MessageAttributeValue{
+				"Foo": stringAttr("bar"),
+			},
+			expectedQueue: testOutgoingQueueURL,
+			expectedDelay: 0,
+		},
+		{
+			name: "emit interval",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.EmitIntervalAttributeKey: stringAttr("1h"),
+			},
+			expectedQueue: testIncomingQueueURL,
+			expectedDelay: 900,
+		},
+		{
+			name: "emit interval and offset",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.EmitIntervalAttributeKey: stringAttr("10m"),
+				sqpulser.OffsetAttributeKey:       stringAttr("2m"),
+			},
+			expectedQueue: testOutgoingQueueURL,
+			expectedDelay: 1 * 60,
+		},
+		{
+			name: "offset",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.OffsetAttributeKey: stringAttr("5m"),
+			},
+			expectedQueue: testOutgoingQueueURL,
+			expectedDelay: 4 * 60,
+		},
+		{
+			name:     "offset with cron schedule",
+			schedule: "0 * * * *",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.OffsetAttributeKey: stringAttr("-20m"),
+			},
+			expectedQueue: testOutgoingQueueURL,
+			expectedDelay: 9 * 60,
+		},
+		{
+			name: "emit at",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.EmitAtAttributeKey: stringAttr("2018-12-18T06:40:00+09:00"),
+			},
+			expectedQueue: testOutgoingQueueURL,
+			expectedDelay: 9 * 60,
+		},
+		{
+			name: "emit interval less than min",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.EmitIntervalAttributeKey: stringAttr("30s"),
+			},
+			errString: "message schedule: SqpulserEmitInterval attribute value 30s is less than min emit interval 1m0s",
+		},
+		{
+			name: "emit interval greater than max",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.EmitIntervalAttributeKey: stringAttr("48h"),
+			},
+			errString: "message schedule: SqpulserEmitInterval attribute value 48h0m0s is greater than max emit interval 24h0m0s",
+		},
+		{
+			name: "emit at greater than max emit delay",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.EmitAtAttributeKey: stringAttr("2018-12-30T00:00:00Z"),
+			},
+			errString: "message schedule: overridden emit time 2018-12-30T00:00:00Z is 290h40m0s after sent time, greater than max emit delay 168h0m0s",
+		},
+		{
+			name: "offset greater than default max emit delay",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.OffsetAttributeKey: stringAttr("200h"),
+			},
+			errString: "message schedule: overridden emit time 2018-12-26T05:30:00Z is 200h10m0s after sent time, greater than max emit delay 168h0m0s",
+		},
+		{
+			name: "invalid emit at",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.EmitAtAttributeKey: stringAttr("tomorrow"),
+			},
+			errString: `message schedule: SqpulserEmitAt attribute value parse failed: parsing time "tomorrow" as "2006-01-02T15:04:05Z07:00": cannot parse "tomorrow" as "2006"`,
+		},
+		{
+			name: "invalid attribute type",
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.EmitIntervalAttributeKey: {DataType: aws.String("Number"), StringValue: aws.String("60")},
+			},
+			errString: "message schedule: SqpulserEmitInterval attribute type is missmatch:Number",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &fakeSQSClient{}
+			opt := &sqpulser.Option{
+				IncomingQueueURL: testIncomingQueueURL,
+				OutgoingQueueURL: testOutgoingQueueURL,
+				EmitInterval:     15 * time.Minute,
+				MinEmitInterval:  time.Minute,
+				MaxEmitInterval:  24 * time.Hour,
+			}
+			if c.schedule != "" {
+				opt.Schedule = Must(sqpulser.ParseSchedule(c.schedule))
+			}
+			app, err := sqpulser.NewWithClient(context.Background(), client, opt)
+			require.NoError(t, err)
+			msg := newTestMessage("msg-1", "hello", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), c.attrs)
+			err = app.HandleMessage(context.Background(), &msg)
+			if c.errString != "" {
+				require.EqualError(t, err, c.errString)
+				require.Empty(t, client.sent)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, client.sent, 1)
+			require.Equal(t, c.expectedQueue, *client.sent[0].QueueUrl)
+			require.Equal(t, c.expectedDelay, client.sent[0].DelaySeconds)
+		})
+	}
+}
+
+func TestNewWithClientNegativeMaxEmitDelay(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		MaxEmitDelay:     -time.Hour,
+	})
+	require.EqualError(t, err, "max emit delay -1h0m0s must be positive")
+}
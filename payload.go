@@ -0,0 +1,223 @@
+package sqpulser
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// ExtendedPayloadSizeAttributeKey is the size of the payload stored in S3, set by the Amazon SQS Extended Client.
+	ExtendedPayloadSizeAttributeKey = "ExtendedPayloadSize"
+	// LegacyExtendedPayloadSizeAttributeKey is the one set by the older versions of the Amazon SQS Extended Client.
+	LegacyExtendedPayloadSizeAttributeKey = "SQSLargePayloadSize"
+
+	s3PointerClass = "software.amazon.payloadoffloading.PayloadS3Pointer"
+)
+
+// LargePayloadOption is the option of the large payload support by the Amazon SQS Extended Client convention,
+// in which the body is stored in S3 and the message has an S3 pointer body.
+// S3 pointer bodies are passed through untouched when messages are sent to SQS queues.
+type LargePayloadOption struct {
+	// Resolve replaces S3 pointer bodies with the payloads when messages are emitted to destinations other than SQS queues.
+	Resolve bool
+	// Bucket is the bucket to which bodies larger than Threshold are offloaded when messages are sent to SQS queues.
+	// If empty, bodies are not offloaded.
+	Bucket string
+	// Threshold is the message size in bytes, including attributes, above which the body is offloaded. default is 262144.
+	Threshold int
+	// Cleanup deletes the payloads in S3 after they are resolved and emitted to all the destinations,
+	// and the received message is deleted from the incoming queue, i.e. by Run and LambdaHandler but not by HandleMessages.
+	Cleanup bool
+}
+
+// S3Pointer is the body of the message whose payload is stored in S3.
+type S3Pointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// ParseS3Pointer parses the S3 pointer body, `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"...","s3Key":"..."}]`.
+// It returns false if the body is not an S3 pointer.
+func ParseS3Pointer(body string) (*S3Pointer, bool) {
+	body = strings.TrimSpace(body)
+	if !strings.HasPrefix(body, "[") || !strings.Contains(body, s3PointerClass) {
+		return nil, false
+	}
+	var pair []json.RawMessage
+	if err := json.Unmarshal([]byte(body), &pair); err != nil || len(pair) != 2 {
+		return nil, false
+	}
+	var class string
+	if err := json.Unmarshal(pair[0], &class); err != nil || class != s3PointerClass {
+		return nil, false
+	}
+	var pointer S3Pointer
+	if err := json.Unmarshal(pair[1], &pointer); err != nil || pointer.Bucket == "" || pointer.Key == "" {
+		return nil, false
+	}
+	return &pointer, true
+}
+
+// String returns the S3 pointer body.
+func (p *S3Pointer) String() string {
+	encoded, _ := json.Marshal([]interface{}{s3PointerClass, p})
+	return string(encoded)
+}
+
+func (opt *LargePayloadOption) threshold() int {
+	if opt.Threshold <= 0 {
+		return sqsMaxMessageSize
+	}
+	return opt.Threshold
+}
+
+// checkLargePayload validates the large payload option.
+func (app *App) checkLargePayload() error {
+	lp := &app.opt.LargePayload
+	if (lp.Resolve || lp.Bucket != "") && app.opt.S3Client == nil {
+		return errors.New("S3 client is required for large payloads")
+	}
+	if lp.Cleanup && !lp.Resolve {
+		return errors.New("large payload cleanup requires resolving large payloads")
+	}
+	return nil
+}
+
+// offloadLargePayload stores the body of the request in S3 and replaces it with the S3 pointer,
+// if the message is larger than the threshold. The body already being an S3 pointer is not offloaded again.
+func (app *App) offloadLargePayload(ctx context.Context, req *sendRequest) error {
+	lp := &app.opt.LargePayload
+	if lp.Bucket == "" || sendMessageInputSize(req.input) <= lp.threshold() {
+		return nil
+	}
+	body := aws.ToString(req.input.MessageBody)
+	if _, ok := ParseS3Pointer(body); ok {
+		return nil
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	pointer := &S3Pointer{
+		Bucket: lp.Bucket,
+		Key:    hex.EncodeToString(id[:]),
+	}
+	_, err := app.opt.S3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(pointer.Bucket),
+		Key:           aws.String(pointer.Key),
+		Body:          strings.NewReader(body),
+		ContentLength: int64(len(body)),
+	})
+	if err != nil {
+		return fmt.Errorf("offload large payload to s3://%s/%s: %w", pointer.Bucket, pointer.Key, err)
+	}
+	attributes := make(map[string]types.MessageAttributeValue, len(req.input.MessageAttributes)+1)
+	for key, value := range req.input.MessageAttributes {
+		attributes[key] = value
+	}
+	attributes[ExtendedPayloadSizeAttributeKey] = types.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(len(body))),
+	}
+	req.input.MessageBody = aws.String(pointer.String())
+	req.input.MessageAttributes = attributes
+	req.offloaded = pointer
+	for _, p := range req.members {
+		app.logf("[info][%s] offload large payload of %d bytes to s3://%s/%s", *p.msg.MessageId, len(body), pointer.Bucket, pointer.Key)
+	}
+	return nil
+}
+
+// resolveLargePayload replaces the S3 pointer body of the message with the payload, and returns the pointer.
+// If the body is not an S3 pointer, it returns nil.
+func (app *App) resolveLargePayload(ctx context.Context, msg *OutgoingMessage) (*S3Pointer, error) {
+	if !app.opt.LargePayload.Resolve {
+		return nil, nil
+	}
+	pointer, ok := ParseS3Pointer(msg.Body)
+	if !ok {
+		return nil, nil
+	}
+	output, err := app.opt.S3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(pointer.Bucket),
+		Key:    aws.String(pointer.Key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get large payload s3://%s/%s: %w", pointer.Bucket, pointer.Key, err)
+	}
+	defer output.Body.Close()
+	payload, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read large payload s3://%s/%s: %w", pointer.Bucket, pointer.Key, err)
+	}
+	attributes := make(map[string]types.MessageAttributeValue, len(msg.MessageAttributes))
+	for key, value := range msg.MessageAttributes {
+		if key == ExtendedPayloadSizeAttributeKey || key == LegacyExtendedPayloadSizeAttributeKey {
+			continue
+		}
+		attributes[key] = value
+	}
+	msg.Body = string(payload)
+	msg.MessageAttributes = attributes
+	return pointer, nil
+}
+
+// deleteLargePayload deletes the payload in S3. The failure is only logged, and the payload is left in S3.
+func (app *App) deleteLargePayload(ctx context.Context, msgID string, pointer *S3Pointer) {
+	_, err := app.opt.S3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(pointer.Bucket),
+		Key:    aws.String(pointer.Key),
+	})
+	if err != nil {
+		app.logf("[warn][%s] failed to delete large payload s3://%s/%s: %v", msgID, pointer.Bucket, pointer.Key, err)
+		return
+	}
+	app.logf("[info][%s] delete large payload s3://%s/%s", msgID, pointer.Bucket, pointer.Key)
+}
+
+// largePayloadCleanups returns the resolved payloads of the received messages which are emitted to all the destinations,
+// by the message id. A payload emitted to several destinations is deleted once.
+func (app *App) largePayloadCleanups(msgs []types.Message, requests []*sendRequest, errs []error) map[string][]*S3Pointer {
+	if !app.opt.LargePayload.Cleanup {
+		return nil
+	}
+	cleanups := make(map[string][]*S3Pointer)
+	seen := make(map[string]bool)
+	for _, req := range requests {
+		if req.resolved == nil {
+			continue
+		}
+		index := req.members[0].index
+		if errs[index] != nil {
+			continue
+		}
+		msgID := *msgs[index].MessageId
+		if key := msgID + "\n" + req.resolved.String(); !seen[key] {
+			seen[key] = true
+			cleanups[msgID] = append(cleanups[msgID], req.resolved)
+		}
+	}
+	return cleanups
+}
+
+// cleanupLargePayloads deletes the resolved payloads of the messages deleted from the incoming queue.
+func (app *App) cleanupLargePayloads(ctx context.Context, reports []*handleReport, deleted []types.Message) {
+	for _, report := range reports {
+		for _, msg := range deleted {
+			for _, pointer := range report.cleanups[*msg.MessageId] {
+				report.app.deleteLargePayload(ctx, *msg.MessageId, pointer)
+			}
+		}
+	}
+}
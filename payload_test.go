@@ -0,0 +1,239 @@
+package sqpulser_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+const testS3PointerBody = `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"payloads","s3Key":"3f2a"}]`
+
+func TestParseS3Pointer(t *testing.T) {
+	pointer, ok := sqpulser.ParseS3Pointer(testS3PointerBody)
+	require.True(t, ok)
+	require.Equal(t, &sqpulser.S3Pointer{Bucket: "payloads", Key: "3f2a"}, pointer)
+	require.Equal(t, testS3PointerBody, pointer.String())
+
+	for _, body := range []string{
+		"body",
+		`[1,2]`,
+		`["software.amazon.payloadoffloading.PayloadS3Pointer"]`,
+		`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"payloads"}]`,
+		`["other.Pointer",{"s3BucketName":"payloads","s3Key":"software.amazon.payloadoffloading.PayloadS3Pointer"}]`,
+	} {
+		_, ok := sqpulser.ParseS3Pointer(body)
+		require.False(t, ok, body)
+	}
+}
+
+func TestHandleMessagesLargePayloadPassThrough(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	s3Client := &fakeS3Client{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     time.Hour,
+		S3Client:         s3Client,
+		LargePayload: sqpulser.LargePayloadOption{
+			Resolve: true,
+			Bucket:  "payloads",
+		},
+	})
+	require.NoError(t, err)
+	size := map[string]types.MessageAttributeValue{
+		sqpulser.ExtendedPayloadSizeAttributeKey: {DataType: aws.String("Number"), StringValue: aws.String("300000")},
+	}
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", testS3PointerBody, Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), size),
+	})
+	require.Equal(t, []error{nil}, errs)
+	require.Len(t, client.sent, 1)
+	require.Equal(t, testIncomingQueueURL, *client.sent[0].QueueUrl)
+	require.Equal(t, testS3PointerBody, *client.sent[0].MessageBody)
+	require.Equal(t, "300000", *client.sent[0].MessageAttributes[sqpulser.ExtendedPayloadSizeAttributeKey].StringValue)
+	require.Empty(t, s3Client.puts)
+	require.Empty(t, s3Client.deleted)
+}
+
+func TestHandleMessagesLargePayloadOffload(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{
+		sendErr: func(input *sqs.SendMessageInput) error {
+			if *input.QueueUrl == testOutgoingQueueURL {
+				return errors.New("something wrong")
+			}
+			return nil
+		},
+	}
+	s3Client := &fakeS3Client{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     time.Hour,
+		S3Client:         s3Client,
+		LargePayload: sqpulser.LargePayloadOption{
+			Bucket:    "payloads",
+			Threshold: 1024,
+		},
+	})
+	require.NoError(t, err)
+	large := strings.Repeat("x", 2000)
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", large, Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-2", "small", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-3", large, Must(time.Parse(time.RFC3339, "2018-12-17T20:30:00Z")).UnixMilli(), nil),
+	})
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.Error(t, errs[2])
+
+	require.Len(t, client.sent, 2)
+	pointer, ok := sqpulser.ParseS3Pointer(*client.sent[0].MessageBody)
+	require.True(t, ok)
+	require.Equal(t, "payloads", pointer.Bucket)
+	require.Equal(t, "2000", *client.sent[0].MessageAttributes[sqpulser.ExtendedPayloadSizeAttributeKey].StringValue)
+	require.Equal(t, "msg-1", *client.sent[0].MessageAttributes[sqpulser.OriginalMessageIDAttributeKey].StringValue)
+	require.Equal(t, "small", *client.sent[1].MessageBody)
+
+	// the payload of msg-3 is deleted because it failed to be sent.
+	require.Len(t, s3Client.puts, 2)
+	require.Len(t, s3Client.deleted, 1)
+	require.Equal(t, []byte(large), s3Client.objects["payloads/"+pointer.Key])
+	require.Len(t, s3Client.objects, 1)
+}
+
+func TestHandleMessagesLargePayloadResolve(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	snsClient := &fakeSNSClient{}
+	s3Client := &fakeS3Client{
+		objects: map[string][]byte{
+			"payloads/3f2a": []byte("large payload"),
+		},
+	}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingTopicARN: testOutgoingTopicARN,
+		SNSClient:        snsClient,
+		EmitInterval:     15 * time.Minute,
+		S3Client:         s3Client,
+		LargePayload: sqpulser.LargePayloadOption{
+			Resolve: true,
+			Cleanup: true,
+		},
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli()
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", testS3PointerBody, sentTimestamp, map[string]types.MessageAttributeValue{
+			sqpulser.LegacyExtendedPayloadSizeAttributeKey: {DataType: aws.String("Number"), StringValue: aws.String("13")},
+		}),
+		newTestMessage("msg-2", `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"payloads","s3Key":"missing"}]`, sentTimestamp, nil),
+	})
+	require.NoError(t, errs[0])
+	require.Error(t, errs[1])
+	require.Contains(t, errs[1].Error(), "get large payload s3://payloads/missing")
+
+	require.Len(t, snsClient.published, 1)
+	entries := snsClient.published[0].PublishBatchRequestEntries
+	require.Len(t, entries, 1)
+	require.Equal(t, "large payload", *entries[0].Message)
+	require.NotContains(t, entries[0].MessageAttributes, sqpulser.LegacyExtendedPayloadSizeAttributeKey)
+	// the caller of HandleMessages deletes the messages, so the payloads are kept.
+	require.Empty(t, s3Client.deleted)
+}
+
+func TestLambdaHandlerLargePayloadCleanup(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	snsClient := &fakeSNSClient{}
+	ebFailed := true
+	ebClient := &fakeEventBridgeClient{
+		failed: func(string) bool { return ebFailed },
+	}
+	s3Client := &fakeS3Client{
+		objects: map[string][]byte{
+			"payloads/3f2a": []byte(`{"large":"payload"}`),
+		},
+	}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL:  testIncomingQueueURL,
+		EmitInterval:      15 * time.Minute,
+		SNSClient:         snsClient,
+		EventBridgeClient: ebClient,
+		S3Client:          s3Client,
+		Routing: &sqpulser.RoutingConfig{
+			Destinations: []*sqpulser.DestinationConfig{
+				{Name: "topic", TopicARN: testOutgoingTopicARN},
+				{Name: "bus", EventBusName: "sqpulser-bus"},
+			},
+			Default: []string{"topic", "bus"},
+		},
+		LargePayload: sqpulser.LargePayloadOption{
+			Resolve: true,
+			Cleanup: true,
+		},
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli()
+	event := &sqpulser.SQSEvent{
+		Records: []types.Message{
+			newTestMessage("msg-1", testS3PointerBody, sentTimestamp, nil),
+			newTestMessage("msg-2", `{"id":2}`, sentTimestamp, nil),
+		},
+	}
+
+	// the payload is kept until all the destinations succeed.
+	resp, err := app.LambdaHandler(context.Background(), event)
+	require.NoError(t, err)
+	require.Len(t, resp.BatchItemFailures, 2)
+	require.Len(t, snsClient.published, 1)
+	require.Empty(t, client.deleted)
+	require.Empty(t, s3Client.deleted)
+
+	// the payload is kept while the message is left in the incoming queue.
+	ebFailed = false
+	client.deleteErr = func(string) error { return errors.New("something wrong") }
+	resp, err = app.LambdaHandler(context.Background(), event)
+	require.NoError(t, err)
+	require.Empty(t, resp.BatchItemFailures)
+	require.Empty(t, s3Client.deleted)
+
+	// the payload emitted to two destinations is deleted once, after the message is deleted.
+	client.deleteErr = nil
+	resp, err = app.LambdaHandler(context.Background(), event)
+	require.NoError(t, err)
+	require.Empty(t, resp.BatchItemFailures)
+	require.Equal(t, []string{"handle-msg-1"}, client.deleted)
+	require.Equal(t, []string{"payloads/3f2a"}, s3Client.deleted)
+}
+
+func TestNewWithClientLargePayloadWithoutClient(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		LargePayload: sqpulser.LargePayloadOption{
+			Bucket: "payloads",
+		},
+	})
+	require.EqualError(t, err, "S3 client is required for large payloads")
+}
@@ -0,0 +1,396 @@
+package sqpulser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// PipelineConfig is a pipeline in the pipelines config file.
+// The zero value fields are inherited from the command line options.
+type PipelineConfig struct {
+	Name              string         `json:"name,omitempty"`
+	IncomingQueueURL  string         `json:"in_queue_url,omitempty"`
+	IncomingQueueName string         `json:"in,omitempty"`
+	OutgoingQueueURL  string         `json:"out_queue_url,omitempty"`
+	OutgoingQueueName string         `json:"out,omitempty"`
+	OutgoingTopicARN  string         `json:"out_topic_arn,omitempty"`
+	OutgoingEventBus  string         `json:"out_event_bus,omitempty"`
+	OutgoingWebhook   string         `json:"out_webhook_url,omitempty"`
+	OutgoingStream    string         `json:"out_stream,omitempty"`
+	OutgoingBucket    string         `json:"out_bucket,omitempty"`
+	DeadLetterURL     string         `json:"dead_letter_queue_url,omitempty"`
+	DeadLetterName    string         `json:"dead_letter,omitempty"`
+	DedupKey          string         `json:"dedup_key,omitempty"`
+	StateTable        string         `json:"state_table,omitempty"`
+	EmitInterval      string         `json:"emit_interval,omitempty"`
+	Offset            string         `json:"offset,omitempty"`
+	Schedule          string         `json:"schedule,omitempty"`
+	Aggregate         string         `json:"aggregate,omitempty"`
+	Routing           *RoutingConfig `json:"routing,omitempty"`
+}
+
+// LoadPipelinesConfig loads the list of pipelines from a JSON file, and returns them as options of Option.Pipelines.
+func LoadPipelinesConfig(path string) ([]*Option, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfgs []*PipelineConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfgs); err != nil {
+		return nil, fmt.Errorf("parse pipelines config %s: %w", path, err)
+	}
+	opts := make([]*Option, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		opt, err := cfg.option()
+		if err != nil {
+			return nil, fmt.Errorf("pipelines[%d]: %w", i, err)
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+func (cfg *PipelineConfig) option() (*Option, error) {
+	opt := &Option{
+		Name:                 cfg.Name,
+		IncomingQueueURL:     cfg.IncomingQueueURL,
+		IncomingQueueName:    cfg.IncomingQueueName,
+		OutgoingQueueURL:     cfg.OutgoingQueueURL,
+		OutgoingQueueName:    cfg.OutgoingQueueName,
+		OutgoingTopicARN:     cfg.OutgoingTopicARN,
+		OutgoingEventBusName: cfg.OutgoingEventBus,
+		OutgoingWebhookURL:   cfg.OutgoingWebhook,
+		OutgoingStream:       cfg.OutgoingStream,
+		OutgoingBucket:       cfg.OutgoingBucket,
+		DeadLetterQueueURL:   cfg.DeadLetterURL,
+		DeadLetterQueueName:  cfg.DeadLetterName,
+		DedupKey:             cfg.DedupKey,
+		StateTable:           cfg.StateTable,
+		Routing:              cfg.Routing,
+	}
+	var err error
+	if cfg.EmitInterval != "" {
+		if opt.EmitInterval, err = time.ParseDuration(cfg.EmitInterval); err != nil {
+			return nil, fmt.Errorf("emit_interval: %w", err)
+		}
+	}
+	if cfg.Offset != "" {
+		if opt.Offset, err = time.ParseDuration(cfg.Offset); err != nil {
+			return nil, fmt.Errorf("offset: %w", err)
+		}
+	}
+	if cfg.Schedule != "" {
+		if opt.Schedule, err = ParseSchedule(cfg.Schedule); err != nil {
+			return nil, fmt.Errorf("schedule: %w", err)
+		}
+	}
+	if cfg.Aggregate != "" {
+		if opt.AggregateFormat, err = ParseAggregateFormat(cfg.Aggregate); err != nil {
+			return nil, fmt.Errorf("aggregate: %w", err)
+		}
+	}
+	return opt, nil
+}
+
+// pipelineOption returns the option of the pipeline, inheriting the zero value fields from the parent.
+func pipelineOption(parent *Option, opt *Option) *Option {
+	merged := *opt
+	if merged.Name == "" {
+		merged.Name = merged.IncomingQueueName
+	}
+	if merged.Name == "" {
+		merged.Name = queueName(merged.IncomingQueueURL)
+	}
+	if merged.OutgoingQueueURL == "" && merged.OutgoingQueueName == "" && merged.outgoingSinkCount() == 0 && merged.Routing == nil {
+		merged.OutgoingQueueURL = parent.OutgoingQueueURL
+		merged.OutgoingQueueName = parent.OutgoingQueueName
+		merged.OutgoingTopicARN = parent.OutgoingTopicARN
+		merged.OutgoingEventBusName = parent.OutgoingEventBusName
+		merged.OutgoingWebhookURL = parent.OutgoingWebhookURL
+		merged.OutgoingStream = parent.OutgoingStream
+		merged.OutgoingBucket = parent.OutgoingBucket
+		merged.Routing = parent.Routing
+	}
+	if merged.EventSource == "" {
+		merged.EventSource = parent.EventSource
+	}
+	if merged.EventDetailType == "" {
+		merged.EventDetailType = parent.EventDetailType
+	}
+	if merged.SNSClient == nil {
+		merged.SNSClient = parent.SNSClient
+	}
+	if merged.EventBridgeClient == nil {
+		merged.EventBridgeClient = parent.EventBridgeClient
+	}
+	if merged.Webhook == (WebhookOption{}) {
+		merged.Webhook = parent.Webhook
+	}
+	if merged.HTTPClient == nil {
+		merged.HTTPClient = parent.HTTPClient
+	}
+	if merged.PartitionKeyAttribute == "" {
+		merged.PartitionKeyAttribute = parent.PartitionKeyAttribute
+	}
+	if merged.KinesisClient == nil {
+		merged.KinesisClient = parent.KinesisClient
+	}
+	if merged.S3KeyTemplate == "" {
+		merged.S3KeyTemplate = parent.S3KeyTemplate
+	}
+	if !merged.S3Gzip {
+		merged.S3Gzip = parent.S3Gzip
+	}
+	if merged.S3Client == nil {
+		merged.S3Client = parent.S3Client
+	}
+	if merged.LargePayload == (LargePayloadOption{}) {
+		merged.LargePayload = parent.LargePayload
+	}
+	if merged.MaxHops == 0 {
+		merged.MaxHops = parent.MaxHops
+	}
+	if merged.MaxTotalDelay == 0 {
+		merged.MaxTotalDelay = parent.MaxTotalDelay
+	}
+	if merged.MaxLateness == 0 {
+		merged.MaxLateness = parent.MaxLateness
+	}
+	if merged.LatePolicy == "" {
+		merged.LatePolicy = parent.LatePolicy
+	}
+	if merged.CatchUp == "" {
+		merged.CatchUp = parent.CatchUp
+	}
+	if merged.CatchUpStart.IsZero() {
+		merged.CatchUpStart = parent.CatchUpStart
+	}
+	if merged.Spread == (SpreadOption{}) {
+		merged.Spread = parent.Spread
+	}
+	if merged.DedupKey == "" {
+		merged.DedupKey = parent.DedupKey
+	}
+	if merged.DedupKeep == "" {
+		merged.DedupKeep = parent.DedupKeep
+	}
+	if merged.StateStore == nil && merged.StateTable == "" {
+		merged.StateStore = parent.StateStore
+		merged.StateTable = parent.StateTable
+	}
+	if merged.DynamoDBClient == nil {
+		merged.DynamoDBClient = parent.DynamoDBClient
+	}
+	if !merged.EMF.Disabled && merged.EMF.Namespace == "" && merged.EMF.Writer == nil {
+		merged.EMF = parent.EMF
+	}
+	if merged.DeadLetterQueueURL == "" && merged.DeadLetterQueueName == "" {
+		merged.DeadLetterQueueURL = parent.DeadLetterQueueURL
+		merged.DeadLetterQueueName = parent.DeadLetterQueueName
+	}
+	if merged.Schedule == nil && merged.EmitInterval == 0 {
+		merged.Schedule = parent.Schedule
+		merged.EmitInterval = parent.EmitInterval
+		merged.Offset = parent.Offset
+	}
+	if merged.Location == nil {
+		merged.Location = parent.Location
+	}
+	if merged.AggregateFormat == AggregateFormatNone {
+		merged.AggregateFormat = parent.AggregateFormat
+	}
+	if merged.FlushDelay == 0 {
+		merged.FlushDelay = parent.FlushDelay
+	}
+	if merged.MinEmitInterval == 0 {
+		merged.MinEmitInterval = parent.MinEmitInterval
+	}
+	if merged.MaxEmitInterval == 0 {
+		merged.MaxEmitInterval = parent.MaxEmitInterval
+	}
+	if merged.MaxEmitDelay == 0 {
+		merged.MaxEmitDelay = parent.MaxEmitDelay
+	}
+	if merged.Concurrency == 0 {
+		merged.Concurrency = parent.Concurrency
+	}
+	return &merged
+}
+
+func (app *App) newPipelines(ctx context.Context) error {
+	if app.opt.IncomingQueueURL != "" || app.opt.IncomingQueueName != "" {
+		return errors.New("incoming queue can not be used with pipelines, define it in each pipeline instead")
+	}
+	names := make(map[string]bool, len(app.opt.Pipelines))
+	for i, opt := range app.opt.Pipelines {
+		if len(opt.Pipelines) > 0 {
+			return fmt.Errorf("pipelines[%d]: nested pipelines are not supported", i)
+		}
+		pipeline, err := NewWithClient(ctx, app.client, pipelineOption(app.opt, opt))
+		if err != nil {
+			return fmt.Errorf("pipelines[%d]: %w", i, err)
+		}
+		if names[pipeline.name] {
+			return fmt.Errorf("pipelines[%d]: pipeline `%s` is duplicated", i, pipeline.name)
+		}
+		names[pipeline.name] = true
+		if app.metrics != nil {
+			pipeline.metrics = app.metrics
+			app.metrics.watch(pipeline)
+		}
+		app.pipelines = append(app.pipelines, pipeline)
+	}
+	return nil
+}
+
+// queueName returns the queue name from the queue url or the queue arn.
+func queueName(queueURLOrARN string) string {
+	if i := strings.LastIndexAny(queueURLOrARN, "/:"); i >= 0 {
+		return queueURLOrARN[i+1:]
+	}
+	return queueURLOrARN
+}
+
+// logf writes the log with the pipeline name after the log level, e.g. `[info][pipeline] message`.
+func (app *App) logf(format string, args ...interface{}) {
+	if app.name != "" && strings.HasPrefix(format, "[") {
+		if i := strings.IndexByte(format, ']'); i > 0 {
+			format = format[:i+1] + "[" + strings.ReplaceAll(app.name, "%", "%%") + "]" + format[i+1:]
+		}
+	}
+	log.Printf(format, args...)
+}
+
+// runPipelines runs all pipelines concurrently.
+// A pipeline stopped by an error does not stop the others, and the error is returned after all pipelines stop.
+func (app *App) runPipelines(ctx context.Context, receiveCtx context.Context) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+		first  error
+	)
+	for _, pipeline := range app.pipelines {
+		wg.Add(1)
+		go func(pipeline *App) {
+			defer wg.Done()
+			err := func() (err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						err = fmt.Errorf("panic: %v", r)
+					}
+				}()
+				return pipeline.run(ctx, receiveCtx)
+			}()
+			if err == nil {
+				return
+			}
+			pipeline.logf("[error] pipeline stopped: %v", err)
+			mu.Lock()
+			defer mu.Unlock()
+			failed = append(failed, pipeline.name)
+			if first == nil {
+				first = fmt.Errorf("pipeline %s: %w", pipeline.name, err)
+			}
+		}(pipeline)
+	}
+	wg.Wait()
+	if len(failed) > 1 {
+		return fmt.Errorf("%d pipelines failed (%s), first error: %w", len(failed), strings.Join(failed, ", "), first)
+	}
+	return first
+}
+
+// handlePipelineMessages dispatches the messages to the pipeline of the event source queue.
+func (app *App) handlePipelineMessages(ctx context.Context, msgs []types.Message, eventSourceARNs []string) ([]error, []*handleReport) {
+	errs := make([]error, len(msgs))
+	indexes := make(map[*App][]int, len(app.pipelines))
+	var order []*App
+	for i := range msgs {
+		var arn string
+		if i < len(eventSourceARNs) {
+			arn = eventSourceARNs[i]
+		}
+		pipeline := app.lookupPipeline(arn)
+		if pipeline == nil {
+			errs[i] = fmt.Errorf("no pipeline for event source `%s`", arn)
+			continue
+		}
+		if _, ok := indexes[pipeline]; !ok {
+			order = append(order, pipeline)
+		}
+		indexes[pipeline] = append(indexes[pipeline], i)
+	}
+	reports := make([]*handleReport, 0, len(order))
+	for _, pipeline := range order {
+		idx := indexes[pipeline]
+		batch := make([]types.Message, 0, len(idx))
+		for _, i := range idx {
+			batch = append(batch, msgs[i])
+		}
+		pipelineErrs, pipelineReports := pipeline.handleMessages(ctx, batch, nil)
+		for j, err := range pipelineErrs {
+			errs[idx[j]] = err
+		}
+		reports = append(reports, pipelineReports...)
+	}
+	return errs, reports
+}
+
+// lookupPipeline returns the pipeline whose incoming queue is the event source.
+func (app *App) lookupPipeline(eventSourceARN string) *App {
+	if eventSourceARN == "" {
+		if len(app.pipelines) == 1 {
+			return app.pipelines[0]
+		}
+		return nil
+	}
+	for _, pipeline := range app.pipelines {
+		if matchQueueARN(pipeline.opt.IncomingQueueURL, eventSourceARN) {
+			return pipeline
+		}
+	}
+	return nil
+}
+
+// matchQueueARN returns true if the queue url is of the queue arn, e.g.
+// https://sqs.ap-northeast-1.amazonaws.com/123456789012/name and arn:aws:sqs:ap-northeast-1:123456789012:name.
+// If the region is not found in the host of the url, e.g. a local endpoint, only the account and the name are compared.
+func matchQueueARN(queueURL string, queueARN string) bool {
+	// arn:partition:sqs:region:account:name
+	parts := strings.Split(queueARN, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sqs" {
+		return false
+	}
+	region, account, name := parts[3], parts[4], parts[5]
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return false
+	}
+	if strings.Trim(u.Path, "/") != account+"/"+name {
+		return false
+	}
+	labels := strings.Split(u.Hostname(), ".")
+	switch {
+	case len(labels) > 2 && labels[0] == "sqs":
+		// sqs.region.amazonaws.com
+		return labels[1] == region
+	case len(labels) > 2 && labels[1] == "queue":
+		// legacy endpoint, region.queue.amazonaws.com
+		return labels[0] == region
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package sqpulser_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testReportsInQueueURL  = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/reports-in"
+	testReportsOutQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/reports-out"
+	testBatchesInQueueURL  = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/batches-in"
+	testBatchesOutQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/batches-out"
+)
+
+func TestLambdaHandlerPipelines(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	pipelines, err := sqpulser.LoadPipelinesConfig("testdata/pipelines.json")
+	require.NoError(t, err)
+	client := &fakeSQSClient{
+		queueURLs: map[string]string{
+			"batches-out": testBatchesOutQueueURL,
+		},
+	}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		EmitInterval: 15 * time.Minute,
+		Pipelines:    pipelines,
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	resp, err := app.LambdaHandler(context.Background(), &sqpulser.SQSEvent{
+		Records: []types.Message{
+			newTestMessage("msg-1", "body-1", sentTimestamp, nil),
+			newTestMessage("msg-2", "body-2", sentTimestamp, nil),
+			newTestMessage("msg-3", "body-3", sentTimestamp, nil),
+		},
+		EventSourceARNs: []string{
+			"arn:aws:sqs:ap-northeast-1:123456789012:reports-in",
+			"arn:aws:sqs:ap-northeast-1:123456789012:batches-in",
+			"arn:aws:sqs:ap-northeast-1:123456789012:unknown-in",
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []sqpulser.BatchItemFailureItem{{ItemIdentifier: "msg-3"}}, resp.BatchItemFailures)
+	require.Len(t, client.sent, 2)
+	// reports pipeline emits at 22:00, resent to its incoming queue.
+	require.Equal(t, testReportsInQueueURL, *client.sent[0].QueueUrl)
+	require.Equal(t, "body-1", *client.sent[0].MessageBody)
+	require.EqualValues(t, 900, client.sent[0].DelaySeconds)
+	// batches pipeline inherits the emit interval, emits at 21:45.
+	require.Equal(t, testBatchesOutQueueURL, *client.sent[1].QueueUrl)
+	require.Equal(t, "body-2", *client.sent[1].MessageBody)
+	require.EqualValues(t, 14*60, client.sent[1].DelaySeconds)
+}
+
+func TestLambdaHandlerPipelinesSameQueueName(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	const (
+		testUSReportsInQueueURL  = "https://sqs.us-east-1.amazonaws.com/210987654321/reports-in"
+		testUSReportsOutQueueURL = "https://sqs.us-east-1.amazonaws.com/210987654321/reports-out"
+	)
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		EmitInterval: 15 * time.Minute,
+		Pipelines: []*sqpulser.Option{
+			{Name: "tokyo", IncomingQueueURL: testReportsInQueueURL, OutgoingQueueURL: testReportsOutQueueURL},
+			{Name: "virginia", IncomingQueueURL: testUSReportsInQueueURL, OutgoingQueueURL: testUSReportsOutQueueURL},
+		},
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	resp, err := app.LambdaHandler(context.Background(), &sqpulser.SQSEvent{
+		Records: []types.Message{
+			newTestMessage("msg-1", "body-1", sentTimestamp, nil),
+			newTestMessage("msg-2", "body-2", sentTimestamp, nil),
+			newTestMessage("msg-3", "body-3", sentTimestamp, nil),
+		},
+		EventSourceARNs: []string{
+			"arn:aws:sqs:us-east-1:210987654321:reports-in",
+			"arn:aws:sqs:ap-northeast-1:123456789012:reports-in",
+			// the same queue name in another account.
+			"arn:aws:sqs:ap-northeast-1:999999999999:reports-in",
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []sqpulser.BatchItemFailureItem{{ItemIdentifier: "msg-3"}}, resp.BatchItemFailures)
+	require.Len(t, client.sent, 2)
+	require.Equal(t, testUSReportsOutQueueURL, *client.sent[0].QueueUrl)
+	require.Equal(t, "body-1", *client.sent[0].MessageBody)
+	require.Equal(t, testReportsOutQueueURL, *client.sent[1].QueueUrl)
+	require.Equal(t, "body-2", *client.sent[1].MessageBody)
+}
+
+func TestRunPipelinesFailureIsolation(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	client := &fakeSQSClient{
+		queueReceiveErrs: map[string]error{
+			testReportsInQueueURL: &smithy.GenericAPIError{Code: "AWS.SimpleQueueService.NonExistentQueue", Message: "The specified queue does not exist"},
+		},
+		queueReceived: map[string][][]types.Message{
+			testBatchesInQueueURL: {
+				{newTestMessage("msg-1", "body-1", sentTimestamp, nil)},
+			},
+		},
+	}
+	client.onEmpty = func() {
+		// keep the batches pipeline running until the reports pipeline fails.
+		for {
+			client.mu.Lock()
+			var failed bool
+			for _, input := range client.receives {
+				failed = failed || aws.ToString(input.QueueUrl) == testReportsInQueueURL
+			}
+			client.mu.Unlock()
+			if failed {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	app, err := sqpulser.NewWithClient(ctx, client, &sqpulser.Option{
+		EmitInterval: 15 * time.Minute,
+		Pipelines: []*sqpulser.Option{
+			{IncomingQueueURL: testReportsInQueueURL, OutgoingQueueURL: testReportsOutQueueURL},
+			{IncomingQueueURL: testBatchesInQueueURL, OutgoingQueueURL: testBatchesOutQueueURL},
+		},
+	})
+	require.NoError(t, err)
+	err = app.Run(ctx)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "pipeline reports-in:")
+	var apiErr smithy.APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, "AWS.SimpleQueueService.NonExistentQueue", apiErr.ErrorCode())
+	require.Len(t, client.sent, 1)
+	require.Equal(t, testBatchesOutQueueURL, *client.sent[0].QueueUrl)
+	require.Equal(t, []string{"handle-msg-1"}, client.deleted)
+}
@@ -0,0 +1,122 @@
+package sqpulser
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/smithy-go"
+)
+
+// errorClass is the classification of errors returned from AWS API calls.
+type errorClass int
+
+const (
+	// errorClassTransient is a temporary error such as network errors and server errors, which is retried.
+	errorClassTransient errorClass = iota
+	// errorClassThrottling is an error caused by exceeding request rate, which is retried.
+	errorClassThrottling
+	// errorClassPermanent is an error that will not be solved by retrying, such as non-existent queue and access denied.
+	errorClassPermanent
+	// errorClassCanceled is an error caused by context cancellation.
+	errorClassCanceled
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case errorClassThrottling:
+		return "throttling"
+	case errorClassPermanent:
+		return "permanent"
+	case errorClassCanceled:
+		return "canceled"
+	default:
+		return "transient"
+	}
+}
+
+var throttlingErrorCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"TooManyRequestsException":               true,
+	"RequestLimitExceeded":                   true,
+	"ProvisionedThroughputExceededException": true,
+	"SlowDown":                               true,
+	"OverLimit":                              true,
+	"KMS.ThrottlingException":                true,
+}
+
+var permanentErrorCodes = map[string]bool{
+	"AWS.SimpleQueueService.NonExistentQueue":     true,
+	"QueueDoesNotExist":                           true,
+	"AWS.SimpleQueueService.QueueDeletedRecently": true,
+	"AccessDenied":                                true,
+	"AccessDeniedException":                       true,
+	"KMS.AccessDeniedException":                   true,
+	"KMS.DisabledException":                       true,
+	"KMS.NotFoundException":                       true,
+	"InvalidClientTokenId":                        true,
+	"UnrecognizedClientException":                 true,
+	"InvalidAddress":                              true,
+	"AWS.SimpleQueueService.UnsupportedOperation": true,
+}
+
+// classifyError classifies the error to decide whether to retry.
+// Unknown errors are classified as transient.
+func classifyError(err error) errorClass {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return errorClassCanceled
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch code := apiErr.ErrorCode(); {
+		case throttlingErrorCodes[code]:
+			return errorClassThrottling
+		case permanentErrorCodes[code]:
+			return errorClassPermanent
+		}
+	}
+	return errorClassTransient
+}
+
+const (
+	retryBaseInterval = time.Second
+	retryMaxInterval  = time.Minute
+)
+
+// backoff computes the exponential backoff intervals with jitter.
+type backoff struct {
+	attempt int
+}
+
+// next returns the next interval, which is randomized between half and full of the exponential interval.
+func (b *backoff) next() time.Duration {
+	interval := retryMaxInterval
+	if b.attempt < 16 {
+		if i := retryBaseInterval << b.attempt; i < retryMaxInterval {
+			interval = i
+		}
+	}
+	b.attempt++
+	half := interval / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// sleepContext sleeps for d, and returns false if ctx is done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-flextime.After(d):
+		return true
+	}
+}
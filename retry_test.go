@@ -0,0 +1,161 @@
+package sqpulser_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRetry(t *testing.T) {
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	cases := []struct {
+		name        string
+		receiveErrs []error
+		batchErr    error
+		errCode     string
+		failed      bool
+		sent        int
+		minWait     time.Duration
+	}{
+		{
+			name: "throttling",
+			receiveErrs: []error{
+				&smithy.GenericAPIError{Code: "OverLimit", Message: "too many requests"},
+				&smithy.GenericAPIError{Code: "ThrottlingException", Message: "rate exceeded"},
+			},
+			sent:    1,
+			minWait: 1500 * time.Millisecond,
+		},
+		{
+			name: "transient network error",
+			receiveErrs: []error{
+				&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+				&smithy.GenericAPIError{Code: "InternalError", Message: "internal error"},
+				errors.New("unexpected EOF"),
+			},
+			sent:    1,
+			minWait: 3500 * time.Millisecond,
+		},
+		{
+			name: "non-existent incoming queue",
+			receiveErrs: []error{
+				&smithy.GenericAPIError{Code: "AWS.SimpleQueueService.NonExistentQueue", Message: "The specified queue does not exist"},
+			},
+			errCode: "AWS.SimpleQueueService.NonExistentQueue",
+		},
+		{
+			name: "access denied",
+			receiveErrs: []error{
+				&smithy.GenericAPIError{Code: "AccessDenied", Message: "Access to the resource is denied"},
+			},
+			errCode: "AccessDenied",
+		},
+		{
+			name:     "non-existent outgoing queue",
+			batchErr: &smithy.GenericAPIError{Code: "AWS.SimpleQueueService.NonExistentQueue", Message: "The specified queue does not exist"},
+			// fails only the message, which is not deleted.
+			failed: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start := Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z"))
+			restore := flextime.Fix(start)
+			defer restore()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client := &fakeSQSClient{
+				receiveErrs: c.receiveErrs,
+				batchErr:    c.batchErr,
+				received: [][]types.Message{
+					{newTestMessage("msg-1", "body-1", sentTimestamp, nil)},
+				},
+				onEmpty: cancel,
+			}
+			app, err := sqpulser.NewWithClient(ctx, client, &sqpulser.Option{
+				IncomingQueueURL: testIncomingQueueURL,
+				OutgoingQueueURL: testOutgoingQueueURL,
+				EmitInterval:     15 * time.Minute,
+			})
+			require.NoError(t, err)
+			err = app.Run(ctx)
+			if c.failed {
+				require.NoError(t, err)
+				require.Empty(t, client.sent)
+				require.Empty(t, client.deleted)
+				return
+			}
+			if c.errCode == "" {
+				require.NoError(t, err)
+				require.Len(t, client.sent, c.sent)
+				require.Equal(t, []string{"handle-msg-1"}, client.deleted)
+				require.GreaterOrEqual(t, flextime.Now().Sub(start), c.minWait, "backoff")
+				return
+			}
+			require.Error(t, err)
+			var apiErr smithy.APIError
+			require.True(t, errors.As(err, &apiErr))
+			require.Equal(t, c.errCode, apiErr.ErrorCode())
+			require.Empty(t, client.deleted)
+		})
+	}
+}
+
+func TestRunPermanentErrorOfMessage(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	const testAlertsQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/alerts"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	team := func(name string) map[string]types.MessageAttributeValue {
+		return map[string]types.MessageAttributeValue{
+			"Team": {DataType: aws.String("String"), StringValue: aws.String(name)},
+		}
+	}
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	client := &fakeSQSClient{
+		received: [][]types.Message{
+			{
+				newTestMessage("msg-1", "body-1", sentTimestamp, team("report")),
+				newTestMessage("msg-2", "body-2", sentTimestamp, team("alert")),
+			},
+			{
+				newTestMessage("msg-3", "body-3", sentTimestamp, team("alert")),
+			},
+		},
+		queueBatchErrs: map[string]error{
+			testReportsQueueURL: &smithy.GenericAPIError{Code: "AWS.SimpleQueueService.NonExistentQueue", Message: "The specified queue does not exist"},
+		},
+		onEmpty: cancel,
+	}
+	app, err := sqpulser.NewWithClient(ctx, client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		Routing: &sqpulser.RoutingConfig{
+			Destinations: []*sqpulser.DestinationConfig{
+				{Name: "reports", QueueURL: testReportsQueueURL},
+				{Name: "alerts", QueueURL: testAlertsQueueURL},
+			},
+			Rules: []*sqpulser.RoutingRule{
+				{Attributes: map[string]string{"Team": "report"}, Destinations: []string{"reports"}},
+				{Attributes: map[string]string{"Team": "alert"}, Destinations: []string{"alerts"}},
+			},
+		},
+	})
+	require.NoError(t, err)
+	// the permanent error of the message to the non-existent queue does not stop polling.
+	require.NoError(t, app.Run(ctx))
+	require.Len(t, client.sent, 2)
+	require.Equal(t, []string{"handle-msg-2", "handle-msg-3"}, client.deleted)
+}
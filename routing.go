@@ -0,0 +1,397 @@
+package sqpulser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// DestinationAttributeKey records the destination name of the routed message,
+// so that the routing rules are evaluated only once, when the message is received for the first time.
+const DestinationAttributeKey = "SqpulserDestination"
+
+// ErrNoRoute is returned when the message matches no routing rule and no default destination is configured.
+// The rejected message is not deleted from the incoming queue, so it is moved to the dead-letter queue by the redrive policy.
+var ErrNoRoute = errors.New("no routing rule matched and no default destination")
+
+// RoutingConfig is the routing table that selects outgoing destinations for each message.
+type RoutingConfig struct {
+	Destinations []*DestinationConfig `json:"destinations"`
+	// Rules are evaluated in order, and the first matched rule selects destinations.
+	Rules []*RoutingRule `json:"rules"`
+	// Default is the destination names for messages matching no rule. If empty, such messages are rejected.
+	Default []string `json:"default,omitempty"`
+}
+
+// DestinationConfig is an outgoing queue or other destination with its own schedule.
+type DestinationConfig struct {
+	Name      string `json:"name"`
+	QueueURL  string `json:"queue_url,omitempty"`
+	QueueName string `json:"queue_name,omitempty"`
+	TopicARN  string `json:"topic_arn,omitempty"`
+	// EventBusName is the EventBridge event bus name or ARN.
+	// EventSource and EventDetailType default to the ones of Option.
+	EventBusName    string `json:"event_bus,omitempty"`
+	EventSource     string `json:"event_source,omitempty"`
+	EventDetailType string `json:"event_detail_type,omitempty"`
+	// WebhookURL is the HTTP endpoint. The other webhook options are the ones of Option.
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// Stream is the Kinesis data stream name or ARN. PartitionKeyAttribute defaults to the one of Option.
+	Stream                string `json:"stream,omitempty"`
+	PartitionKeyAttribute string `json:"partition_key_attribute,omitempty"`
+	// Bucket is the S3 bucket. KeyTemplate defaults to the one of Option, and gzip is enabled if either Gzip or the one of Option is true.
+	Bucket      string `json:"bucket,omitempty"`
+	KeyTemplate string `json:"key_template,omitempty"`
+	Gzip        bool   `json:"gzip,omitempty"`
+	// Schedule is the schedule spec parsed by ParseSchedule. If empty, the schedule of Option is used.
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// RoutingRule matches messages by message attributes and the JSON body. All conditions must match.
+// A rule without conditions matches any message.
+type RoutingRule struct {
+	Name string `json:"name,omitempty"`
+	// Attributes matches the string values of message attributes.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Body matches the values in the JSON body selected by JSONPath such as `$.detail.type`.
+	Body         map[string]string `json:"body,omitempty"`
+	Destinations []string          `json:"destinations"`
+}
+
+// LoadRoutingConfig loads the routing config from a JSON file.
+func LoadRoutingConfig(path string) (*RoutingConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg RoutingConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse routing config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// destination is where messages are emitted.
+type destination struct {
+	// name is empty if routing is not configured.
+	name     string
+	queueURL string
+	// sink is set if messages are emitted to the sink instead of queueURL.
+	sink Sink
+	// schedule is not in the location of Option.
+	schedule Schedule
+}
+
+func (dest *destination) String() string {
+	if dest.sink != nil {
+		return dest.sink.String()
+	}
+	return dest.queueURL
+}
+
+type routingRule struct {
+	name         string
+	attributes   map[string]string
+	body         []*bodyCondition
+	destinations []*destination
+}
+
+type bodyCondition struct {
+	path  string
+	steps []jsonPathStep
+	value string
+}
+
+// router selects destinations of messages.
+type router struct {
+	destinations map[string]*destination
+	rules        []*routingRule
+	defaults     []*destination
+	// matchBody is true if any rule has body conditions.
+	matchBody bool
+	logf      func(format string, args ...interface{})
+}
+
+func (app *App) newRouter(ctx context.Context, cfg *RoutingConfig, defaultSchedule Schedule) (*router, error) {
+	r := &router{
+		destinations: make(map[string]*destination, len(cfg.Destinations)),
+		logf:         app.logf,
+	}
+	if len(cfg.Destinations) == 0 {
+		return nil, errors.New("routing config has no destinations")
+	}
+	for _, d := range cfg.Destinations {
+		if d.Name == "" {
+			return nil, errors.New("destination name is required")
+		}
+		if _, ok := r.destinations[d.Name]; ok {
+			return nil, fmt.Errorf("destination `%s` is duplicated", d.Name)
+		}
+		dest := &destination{
+			name:     d.Name,
+			queueURL: d.QueueURL,
+			schedule: defaultSchedule,
+		}
+		sink, err := app.newDestinationSink(d)
+		if err != nil {
+			return nil, fmt.Errorf("destination `%s`: %w", d.Name, err)
+		}
+		dest.sink = sink
+		if sink == nil && dest.queueURL == "" {
+			if d.QueueName == "" {
+				return nil, fmt.Errorf("destination `%s`: either queue url, queue name or other destination is required", d.Name)
+			}
+			app.logf("[info] try get destination `%s` queue url: queue name `%s`", d.Name, d.QueueName)
+			output, err := app.client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+				QueueName: aws.String(d.QueueName),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("can not get destination `%s` queue url: %w", d.Name, err)
+			}
+			dest.queueURL = *output.QueueUrl
+		}
+		if d.Schedule != "" {
+			s, err := ParseSchedule(d.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("destination `%s` schedule: %w", d.Name, err)
+			}
+			dest.schedule = s
+		}
+		if dest.schedule == nil {
+			return nil, fmt.Errorf("destination `%s` has no schedule", d.Name)
+		}
+		r.destinations[d.Name] = dest
+	}
+	for i, rule := range cfg.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rules[%d]", i)
+		}
+		if len(rule.Destinations) == 0 {
+			return nil, fmt.Errorf("routing rule `%s` has no destinations", name)
+		}
+		dests, err := r.lookup(rule.Destinations)
+		if err != nil {
+			return nil, fmt.Errorf("routing rule `%s`: %w", name, err)
+		}
+		compiled := &routingRule{
+			name:         name,
+			attributes:   rule.Attributes,
+			destinations: dests,
+		}
+		for path, value := range rule.Body {
+			steps, err := parseJSONPath(path)
+			if err != nil {
+				return nil, fmt.Errorf("routing rule `%s`: %w", name, err)
+			}
+			compiled.body = append(compiled.body, &bodyCondition{
+				path:  path,
+				steps: steps,
+				value: value,
+			})
+			r.matchBody = true
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	defaults, err := r.lookup(cfg.Default)
+	if err != nil {
+		return nil, fmt.Errorf("routing default: %w", err)
+	}
+	r.defaults = defaults
+	return r, nil
+}
+
+func (r *router) lookup(names []string) ([]*destination, error) {
+	dests := make([]*destination, 0, len(names))
+	for _, name := range names {
+		dest, ok := r.destinations[name]
+		if !ok {
+			return nil, fmt.Errorf("destination `%s` is not defined", name)
+		}
+		dests = append(dests, dest)
+	}
+	return dests, nil
+}
+
+// destination returns the destination of the name. The empty name is the destination without routing.
+func (r *router) destination(name string) (*destination, error) {
+	if r.destinations == nil {
+		if name != "" || len(r.defaults) == 0 {
+			return nil, fmt.Errorf("destination `%s` is not defined", name)
+		}
+		return r.defaults[0], nil
+	}
+	dest, ok := r.destinations[name]
+	if !ok {
+		return nil, fmt.Errorf("destination `%s` is not defined", name)
+	}
+	return dest, nil
+}
+
+// isHopCopy returns true if the message is resent to the incoming queue by sqpulser,
+// which has the original message id and the hop count written on the resend.
+func isHopCopy(msg *types.Message) bool {
+	_, hasOriginal := msg.MessageAttributes[OriginalMessageIDAttributeKey]
+	_, hasHopCount := msg.MessageAttributes[HopCountAttributeKey]
+	return hasOriginal && hasHopCount
+}
+
+// route returns destinations of the message.
+// The message resent to the incoming queue has already been routed by DestinationAttributeKey.
+// DestinationAttributeKey of the other messages, e.g. set by producers, is ignored.
+func (r *router) route(msg *types.Message) ([]*destination, error) {
+	if r.destinations == nil {
+		// routing is not configured.
+		return r.defaults, nil
+	}
+	if attr, ok := msg.MessageAttributes[DestinationAttributeKey]; ok {
+		name := aws.ToString(attr.StringValue)
+		if isHopCopy(msg) {
+			dest, ok := r.destinations[name]
+			if !ok {
+				return nil, fmt.Errorf("%s attribute value `%s` is not defined destination", DestinationAttributeKey, name)
+			}
+			return []*destination{dest}, nil
+		}
+		r.logf("[warn][%s] ignore %s attribute `%s` of the message not resent by sqpulser", *msg.MessageId, DestinationAttributeKey, name)
+	}
+	var body interface{}
+	if r.matchBody {
+		if err := json.Unmarshal([]byte(aws.ToString(msg.Body)), &body); err != nil {
+			r.logf("[debug][%s] body is not JSON, body conditions do not match: %v", *msg.MessageId, err)
+			body = nil
+		}
+	}
+	for _, rule := range r.rules {
+		if rule.match(msg, body) {
+			r.logf("[info][%s] match routing rule `%s`", *msg.MessageId, rule.name)
+			return rule.destinations, nil
+		}
+	}
+	if len(r.defaults) == 0 {
+		return nil, ErrNoRoute
+	}
+	r.logf("[info][%s] match no routing rule, route to default", *msg.MessageId)
+	return r.defaults, nil
+}
+
+func (rule *routingRule) match(msg *types.Message, body interface{}) bool {
+	for key, expected := range rule.attributes {
+		attr, ok := msg.MessageAttributes[key]
+		if !ok || attr.StringValue == nil || *attr.StringValue != expected {
+			return false
+		}
+	}
+	for _, cond := range rule.body {
+		if body == nil {
+			return false
+		}
+		value, ok := lookupJSONPath(body, cond.steps)
+		if !ok {
+			return false
+		}
+		str, ok := jsonScalarString(value)
+		if !ok || str != cond.value {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonPathStep is a step of JSONPath, either an object key or an array index.
+type jsonPathStep struct {
+	key   string
+	index int
+	isKey bool
+}
+
+// parseJSONPath parses a subset of JSONPath: `$`, `.key`, `['key']` and `[index]`.
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSONPath `%s` must start with `$`", path)
+	}
+	var steps []jsonPathStep
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("JSONPath `%s` has empty key", path)
+			}
+			steps = append(steps, jsonPathStep{key: rest[:end], isKey: true})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath `%s` has unclosed bracket", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, jsonPathStep{key: inner[1 : len(inner)-1], isKey: true})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("JSONPath `%s` has invalid index `%s`", path, inner)
+			}
+			steps = append(steps, jsonPathStep{index: index})
+		default:
+			return nil, fmt.Errorf("JSONPath `%s` has unexpected character `%c`", path, rest[0])
+		}
+	}
+	return steps, nil
+}
+
+func lookupJSONPath(v interface{}, steps []jsonPathStep) (interface{}, bool) {
+	for _, step := range steps {
+		if step.isKey {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = obj[step.key]; !ok {
+				return nil, false
+			}
+			continue
+		}
+		arr, ok := v.([]interface{})
+		if !ok || step.index >= len(arr) {
+			return nil, false
+		}
+		v = arr[step.index]
+	}
+	return v, true
+}
+
+// jsonScalarString returns the string representation of the JSON scalar value to compare with the rule value.
+func jsonScalarString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case nil:
+		return "null", true
+	default:
+		return "", false
+	}
+}
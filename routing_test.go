@@ -0,0 +1,298 @@
+package sqpulser_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testReportsQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/reports"
+	testBatchesQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/batches"
+	testOthersQueueURL  = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/others"
+)
+
+func TestHandleMessagesRouting(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	stringAttr := func(v string) types.MessageAttributeValue {
+		return types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+	type sent struct {
+		queueURL    string
+		delay       int32
+		destination string
+	}
+	cases := []struct {
+		name     string
+		body     string
+		attrs    map[string]types.MessageAttributeValue
+		expected []sent
+	}{
+		{
+			name: "attribute rule",
+			body: `{}`,
+			attrs: map[string]types.MessageAttributeValue{
+				"Team": stringAttr("report"),
+			},
+			expected: []sent{
+				{queueURL: testIncomingQueueURL, delay: 900, destination: "reports"},
+			},
+		},
+		{
+			name: "body rule with multiple destinations",
+			body: `{"detail":{"severity":"critical"},"tags":["alert","db"]}`,
+			expected: []sent{
+				{queueURL: testIncomingQueueURL, delay: 900, destination: "reports"},
+				{queueURL: testBatchesQueueURL, delay: 14 * 60},
+			},
+		},
+		{
+			name: "body rule unmatched",
+			body: `{"detail":{"severity":"critical"},"tags":["info"]}`,
+			expected: []sent{
+				{queueURL: testOthersQueueURL, delay: 14 * 60},
+			},
+		},
+		{
+			name: "not JSON body",
+			body: `critical alert`,
+			expected: []sent{
+				{queueURL: testOthersQueueURL, delay: 14 * 60},
+			},
+		},
+		{
+			name: "already routed",
+			body: `{"detail":{"severity":"critical"},"tags":["alert"]}`,
+			attrs: map[string]types.MessageAttributeValue{
+				"Team":                                 stringAttr("report"),
+				sqpulser.DestinationAttributeKey:       stringAttr("batches"),
+				sqpulser.OriginalMessageIDAttributeKey: stringAttr("original-1"),
+				sqpulser.OriginalMessageSentTimestampAttributeKey: {
+					DataType:    aws.String("Number"),
+					StringValue: aws.String("1545082200000"), // 2018-12-17T21:30:00Z
+				},
+				sqpulser.HopCountAttributeKey: {DataType: aws.String("Number"), StringValue: aws.String("1")},
+			},
+			expected: []sent{
+				{queueURL: testBatchesQueueURL, delay: 14 * 60},
+			},
+		},
+		{
+			name: "destination set by producer",
+			body: `{}`,
+			attrs: map[string]types.MessageAttributeValue{
+				"Team":                           stringAttr("report"),
+				sqpulser.DestinationAttributeKey: stringAttr("batches"),
+			},
+			expected: []sent{
+				{queueURL: testIncomingQueueURL, delay: 900, destination: "reports"},
+			},
+		},
+		{
+			name: "destination set by producer without hop count",
+			body: `{}`,
+			attrs: map[string]types.MessageAttributeValue{
+				sqpulser.DestinationAttributeKey:       stringAttr("batches"),
+				sqpulser.OriginalMessageIDAttributeKey: stringAttr("original-1"),
+				sqpulser.OriginalMessageSentTimestampAttributeKey: {
+					DataType:    aws.String("Number"),
+					StringValue: aws.String("1545082200000"), // 2018-12-17T21:30:00Z
+				},
+			},
+			expected: []sent{
+				{queueURL: testOthersQueueURL, delay: 14 * 60},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := sqpulser.LoadRoutingConfig("testdata/routing.json")
+			require.NoError(t, err)
+			client := &fakeSQSClient{
+				queueURLs: map[string]string{
+					"batches": testBatchesQueueURL,
+				},
+			}
+			app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+				IncomingQueueURL: testIncomingQueueURL,
+				EmitInterval:     15 * time.Minute,
+				Routing:          cfg,
+			})
+			require.NoError(t, err)
+			msg := newTestMessage("msg-1", c.body, Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), c.attrs)
+			require.NoError(t, app.HandleMessage(context.Background(), &msg))
+			actual := make([]sent, 0, len(client.sent))
+			for _, input := range client.sent {
+				require.Equal(t, c.body, *input.MessageBody)
+				s := sent{
+					queueURL: *input.QueueUrl,
+					delay:    input.DelaySeconds,
+				}
+				if s.queueURL == testIncomingQueueURL {
+					s.destination = *input.MessageAttributes[sqpulser.DestinationAttributeKey].StringValue
+				} else {
+					// the destination is used only while the message is resent to the incoming queue.
+					require.NotContains(t, input.MessageAttributes, sqpulser.DestinationAttributeKey)
+				}
+				actual = append(actual, s)
+			}
+			require.ElementsMatch(t, c.expected, actual)
+		})
+	}
+}
+
+func TestHandleMessagesRoutingNoRoute(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		Routing: &sqpulser.RoutingConfig{
+			Destinations: []*sqpulser.DestinationConfig{
+				{Name: "reports", QueueURL: testReportsQueueURL},
+			},
+			Rules: []*sqpulser.RoutingRule{
+				{Attributes: map[string]string{"Team": "report"}, Destinations: []string{"reports"}},
+			},
+		},
+	})
+	require.NoError(t, err)
+	msg := newTestMessage("msg-1", "body", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil)
+	err = app.HandleMessage(context.Background(), &msg)
+	require.ErrorIs(t, err, sqpulser.ErrNoRoute)
+	require.Empty(t, client.sent)
+}
+
+func TestRoutingConfigInvalid(t *testing.T) {
+	cases := []struct {
+		name      string
+		opt       *sqpulser.Option
+		errString string
+	}{
+		{
+			name: "undefined destination",
+			opt: &sqpulser.Option{
+				EmitInterval: 15 * time.Minute,
+				Routing: &sqpulser.RoutingConfig{
+					Destinations: []*sqpulser.DestinationConfig{
+						{Name: "reports", QueueURL: testReportsQueueURL},
+					},
+					Rules: []*sqpulser.RoutingRule{
+						{Name: "team", Attributes: map[string]string{"Team": "a"}, Destinations: []string{"team-a"}},
+					},
+				},
+			},
+			errString: "routing: routing rule `team`: destination `team-a` is not defined",
+		},
+		{
+			name: "invalid JSONPath",
+			opt: &sqpulser.Option{
+				EmitInterval: 15 * time.Minute,
+				Routing: &sqpulser.RoutingConfig{
+					Destinations: []*sqpulser.DestinationConfig{
+						{Name: "reports", QueueURL: testReportsQueueURL},
+					},
+					Rules: []*sqpulser.RoutingRule{
+						{Body: map[string]string{"$.tags[x]": "a"}, Destinations: []string{"reports"}},
+					},
+				},
+			},
+			errString: "routing: routing rule `rules[0]`: JSONPath `$.tags[x]` has invalid index `x`",
+		},
+		{
+			name: "no schedule",
+			opt: &sqpulser.Option{
+				Routing: &sqpulser.RoutingConfig{
+					Destinations: []*sqpulser.DestinationConfig{
+						{Name: "reports", QueueURL: testReportsQueueURL},
+					},
+				},
+			},
+			errString: "routing: destination `reports` has no schedule",
+		},
+		{
+			name: "with outgoing queue",
+			opt: &sqpulser.Option{
+				OutgoingQueueURL: testOutgoingQueueURL,
+				EmitInterval:     15 * time.Minute,
+				Routing: &sqpulser.RoutingConfig{
+					Destinations: []*sqpulser.DestinationConfig{
+						{Name: "reports", QueueURL: testReportsQueueURL},
+					},
+				},
+			},
+			errString: "outgoing queue can not be used with routing, define destinations in routing config instead",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.opt.IncomingQueueURL = testIncomingQueueURL
+			_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, c.opt)
+			require.EqualError(t, err, c.errString)
+		})
+	}
+}
+
+func TestHandleMessagesRoutingFIFOFanOut(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	incomingQueueURL := "https://sqs.ap-northeast-1.amazonaws.com/123456789012/incoming.fifo"
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: incomingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		Routing: &sqpulser.RoutingConfig{
+			Destinations: []*sqpulser.DestinationConfig{
+				{Name: "reports", QueueURL: testReportsQueueURL, Schedule: "@hourly"},
+				{Name: "batches", QueueURL: testBatchesQueueURL},
+			},
+			Default: []string{"batches", "reports"},
+		},
+	})
+	require.NoError(t, err)
+	msg := newTestMessage("msg-1", "body", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil)
+	msg.Attributes["MessageGroupId"] = "group-1"
+	msg.Attributes["MessageDeduplicationId"] = "dedup-1"
+	require.NoError(t, app.HandleMessage(context.Background(), &msg))
+	require.Len(t, client.sent, 2)
+	// due within the max delay seconds, sent to the standard queue directly.
+	require.Equal(t, testBatchesQueueURL, *client.sent[0].QueueUrl)
+	require.EqualValues(t, 14*60, client.sent[0].DelaySeconds)
+	// a copy for each destination is held when received again.
+	require.Equal(t, incomingQueueURL, *client.sent[1].QueueUrl)
+	require.Equal(t, "group-1", *client.sent[1].MessageGroupId)
+	require.Equal(t, "dedup-1-reports", *client.sent[1].MessageDeduplicationId)
+	require.Equal(t, "reports", *client.sent[1].MessageAttributes[sqpulser.DestinationAttributeKey].StringValue)
+	require.Empty(t, client.changed)
+}
+
+func TestHandleMessageStripDestinationAttribute(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+	})
+	require.NoError(t, err)
+	msg := newTestMessage("msg-1", "body", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+		sqpulser.DestinationAttributeKey: {DataType: aws.String("String"), StringValue: aws.String("batches")},
+	})
+	require.NoError(t, app.HandleMessage(context.Background(), &msg))
+	require.Len(t, client.sent, 1)
+	require.Equal(t, testOutgoingQueueURL, *client.sent[0].QueueUrl)
+	require.NotContains(t, client.sent[0].MessageAttributes, sqpulser.DestinationAttributeKey)
+}
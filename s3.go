@@ -0,0 +1,180 @@
+package sqpulser
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type S3Client interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// DefaultS3KeyTemplate is the object key template of S3Sink, `.gz` is appended if gzip is enabled.
+const DefaultS3KeyTemplate = `{{.EmitTime | date "2006/01/02/15"}}/{{.PulseID}}.jsonl`
+
+// S3ObjectKeyData is the data of the object key template.
+type S3ObjectKeyData struct {
+	// EmitTime is the emit time of the window, in Option.Location or UTC,
+	// so that every host writes the same window under the same key regardless of its local time zone.
+	EmitTime time.Time
+	// PulseID identifies the object in the window.
+	// It is derived from the emit time and the message ids, so that retries of the same messages overwrite the same object.
+	PulseID string
+}
+
+var s3KeyTemplateFuncs = template.FuncMap{
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+}
+
+// ParseS3KeyTemplate parses the object key template of S3Sink. If str is empty, DefaultS3KeyTemplate is used.
+// The template has the `date` function formatting time by Go layout, e.g. `prefix/{{.EmitTime | date "2006/01/02"}}/{{.PulseID}}.jsonl`.
+func ParseS3KeyTemplate(str string, compress bool) (*template.Template, error) {
+	if str == "" {
+		str = DefaultS3KeyTemplate
+		if compress {
+			str += ".gz"
+		}
+	}
+	tmpl, err := template.New("key").Funcs(s3KeyTemplateFuncs).Option("missingkey=error").Parse(str)
+	if err != nil {
+		return nil, fmt.Errorf("parse S3 key template: %w", err)
+	}
+	// validate the template with a sample data.
+	if err := tmpl.Execute(&strings.Builder{}, &S3ObjectKeyData{}); err != nil {
+		return nil, fmt.Errorf("execute S3 key template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// S3Sink writes the messages of the same emit time into one S3 object as JSON Lines of MessageEnvelope, optionally gzip compressed.
+// Used as a destination of App, the due messages are buffered in the state store and written once per emit window.
+type S3Sink struct {
+	client      S3Client
+	bucket      string
+	keyTemplate *template.Template
+	compress    bool
+	location    *time.Location
+}
+
+// NewS3Sink returns the sink of the bucket. keyTemplate is parsed by ParseS3KeyTemplate.
+// loc is the time zone of the emit time of the key template, nil means UTC.
+func NewS3Sink(client S3Client, bucket string, keyTemplate *template.Template, compress bool, loc *time.Location) *S3Sink {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return &S3Sink{
+		client:      client,
+		bucket:      bucket,
+		keyTemplate: keyTemplate,
+		compress:    compress,
+		location:    loc,
+	}
+}
+
+func (app *App) newS3Sink(bucket string, keyTemplate string, compress bool) (*S3Sink, error) {
+	if app.opt.S3Client == nil {
+		return nil, fmt.Errorf("S3 client is required to put objects to %s", bucket)
+	}
+	if app.opt.AggregateFormat != AggregateFormatNone {
+		return nil, fmt.Errorf("aggregate can not be used with S3 bucket %s", bucket)
+	}
+	tmpl, err := ParseS3KeyTemplate(keyTemplate, compress)
+	if err != nil {
+		return nil, err
+	}
+	// the same time zone as the emit times.
+	return NewS3Sink(app.opt.S3Client, bucket, tmpl, compress, app.opt.Location), nil
+}
+
+// String implements Sink.
+func (s *S3Sink) String() string {
+	return "s3://" + s.bucket
+}
+
+// Emit implements Sink, it puts an object per emit time.
+func (s *S3Sink) Emit(ctx context.Context, msgs []*OutgoingMessage) []error {
+	errs := make([]error, len(msgs))
+	windows := make(map[int64][]int)
+	var keys []int64
+	for i, msg := range msgs {
+		key := msg.EmitTime.UnixMilli()
+		if _, ok := windows[key]; !ok {
+			keys = append(keys, key)
+		}
+		windows[key] = append(windows[key], i)
+	}
+	for _, key := range keys {
+		indexes := windows[key]
+		window := make([]*OutgoingMessage, 0, len(indexes))
+		for _, i := range indexes {
+			window = append(window, msgs[i])
+		}
+		if err := s.putObject(ctx, window); err != nil {
+			for _, i := range indexes {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+func (s *S3Sink) putObject(ctx context.Context, msgs []*OutgoingMessage) error {
+	hash := sha256.New()
+	var b bytes.Buffer
+	for _, msg := range msgs {
+		hash.Write([]byte(msg.ID + "\n"))
+		encoded, err := json.Marshal(newMessageEnvelope(msg))
+		if err != nil {
+			return fmt.Errorf("marshal message %s: %w", msg.ID, err)
+		}
+		b.Write(encoded)
+		b.WriteByte('\n')
+	}
+	data := &S3ObjectKeyData{
+		EmitTime: msgs[0].EmitTime.In(s.location),
+		PulseID:  fmt.Sprintf("%d-%s", msgs[0].EmitTime.Unix(), hex.EncodeToString(hash.Sum(nil))[:16]),
+	}
+	var key strings.Builder
+	if err := s.keyTemplate.Execute(&key, data); err != nil {
+		return fmt.Errorf("execute S3 key template: %w", err)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key.String()),
+		ContentType: aws.String("application/x-ndjson"),
+	}
+	body := b.Bytes()
+	if s.compress {
+		var compressed bytes.Buffer
+		w := gzip.NewWriter(&compressed)
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		input.ContentType = aws.String("application/gzip")
+		body = compressed.Bytes()
+	}
+	input.Body = bytes.NewReader(body)
+	input.ContentLength = int64(len(body))
+	if _, err := s.client.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("put object %s: %w", key.String(), err)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package sqpulser_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMessagesS3(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:46:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	s3Client := &fakeS3Client{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingBucket:   "sqpulser-lake",
+		S3KeyTemplate:    `events/{{.EmitTime | date "2006/01/02/15"}}/{{.PulseID}}.jsonl.gz`,
+		S3Gzip:           true,
+		S3Client:         s3Client,
+		EmitInterval:     15 * time.Minute,
+		StateStore:       sqpulser.NewMemoryStateStore(),
+	})
+	require.NoError(t, err)
+	msgs := []types.Message{
+		newTestMessage("msg-1", `{"id":1}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+			"Foo": {DataType: aws.String("String"), StringValue: aws.String("bar")},
+		}),
+		newTestMessage("msg-2", `{"id":2}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:40:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-3", `{"id":3}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:25:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-4", `{"id":4}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:45:00Z")).UnixMilli(), nil),
+	}
+	errs := app.HandleMessages(context.Background(), msgs)
+	require.Equal(t, make([]error, 4), errs)
+	// a window received in separate batches.
+	errs = app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-5", `{"id":5}`, Must(time.Parse(time.RFC3339, "2018-12-17T21:28:00Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, []error{nil}, errs)
+
+	// due messages are buffered until the flush of their window.
+	require.Empty(t, s3Client.puts)
+	flushes := flushMessages(client)
+	require.Len(t, flushes, 2)
+	// not due yet, resent to the incoming queue.
+	require.Len(t, client.sent, 3)
+	require.Equal(t, `{"id":4}`, *client.sent[2].MessageBody)
+
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:47:00Z")))
+	errs = app.HandleMessages(context.Background(), flushes)
+	require.Equal(t, make([]error, 2), errs)
+
+	// one object per emit window.
+	require.Len(t, s3Client.puts, 2)
+	input := s3Client.puts[0]
+	require.Equal(t, "sqpulser-lake", *input.Bucket)
+	require.True(t, strings.HasPrefix(*input.Key, "events/2018/12/17/21/1545082200-"), *input.Key)
+	require.True(t, strings.HasSuffix(*input.Key, ".jsonl.gz"), *input.Key)
+	require.Equal(t, "application/gzip", *input.ContentType)
+	lines := readJSONLines(t, s3Client.objects["sqpulser-lake/"+*input.Key], true)
+	require.Equal(t, []*sqpulser.MessageEnvelope{
+		{
+			MessageID:     "msg-1",
+			SentTimestamp: 1545081600000,
+			EmitTimestamp: 1545082200000,
+			Body:          `{"id":1}`,
+			MessageAttributes: map[string]sqpulser.AggregatedAttribute{
+				"Foo": {DataType: "String", StringValue: aws.String("bar")},
+			},
+		},
+		{
+			MessageID:     "msg-3",
+			SentTimestamp: 1545081900000,
+			EmitTimestamp: 1545082200000,
+			Body:          `{"id":3}`,
+		},
+		{
+			MessageID:     "msg-5",
+			SentTimestamp: 1545082080000,
+			EmitTimestamp: 1545082200000,
+			Body:          `{"id":5}`,
+		},
+	}, lines)
+	require.True(t, strings.HasPrefix(*s3Client.puts[1].Key, "events/2018/12/17/21/1545083100-"), *s3Client.puts[1].Key)
+
+	// the window has been flushed.
+	errs = app.HandleMessages(context.Background(), flushes)
+	require.Equal(t, make([]error, 2), errs)
+	require.Len(t, s3Client.puts, 2)
+}
+
+func TestHandleMessagesS3StateTable(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	s3Client := &fakeS3Client{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingBucket:   "sqpulser-lake",
+		S3Client:         s3Client,
+		EmitInterval:     15 * time.Minute,
+		// the members are read by the strongly consistent get of the window record, not by an index of the table.
+		StateTable:     "sqpulser-state",
+		DynamoDBClient: &fakeDynamoDBClient{},
+	})
+	require.NoError(t, err)
+	receive := func(id string, sent string) []error {
+		return app.HandleMessages(context.Background(), []types.Message{
+			newTestMessage(id, `{"id":"`+id+`"}`, Must(time.Parse(time.RFC3339, sent)).UnixMilli(), nil),
+		})
+	}
+	require.Equal(t, []error{nil}, receive("msg-1", "2018-12-17T21:20:00Z"))
+
+	// buffered just before the flush.
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")))
+	require.Equal(t, []error{nil}, receive("msg-2", "2018-12-17T21:25:00Z"))
+	flushes := flushMessages(client)
+	require.Len(t, flushes, 1)
+
+	// msg-3 joins the window while the object is written.
+	var joinErrs []error
+	s3Client.putHook = func() {
+		s3Client.putHook = nil
+		joinErrs = receive("msg-3", "2018-12-17T21:26:00Z")
+	}
+	errs := app.HandleMessages(context.Background(), flushes)
+	require.Equal(t, []error{nil}, joinErrs)
+	require.ErrorIs(t, errs[0], sqpulser.ErrMessageHeld)
+	require.Len(t, s3Client.puts, 1)
+	lines := readJSONLines(t, s3Client.objects["sqpulser-lake/"+*s3Client.puts[0].Key], false)
+	require.Len(t, lines, 2)
+	require.Equal(t, "msg-1", lines[0].MessageID)
+	require.Equal(t, "msg-2", lines[1].MessageID)
+
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:33:00Z")))
+	errs = app.HandleMessages(context.Background(), flushes)
+	require.Equal(t, []error{nil}, errs)
+	require.Len(t, s3Client.puts, 2)
+	lines = readJSONLines(t, s3Client.objects["sqpulser-lake/"+*s3Client.puts[1].Key], false)
+	require.Len(t, lines, 1)
+	require.Equal(t, "msg-3", lines[0].MessageID)
+	require.True(t, strings.HasPrefix(*s3Client.puts[1].Key, "2018/12/17/21/1545082200-"), *s3Client.puts[1].Key)
+	require.NotEqual(t, *s3Client.puts[0].Key, *s3Client.puts[1].Key)
+}
+
+func TestNewWithClientS3WithoutStateStore(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingBucket:   "sqpulser-lake",
+		S3Client:         &fakeS3Client{},
+		EmitInterval:     15 * time.Minute,
+	})
+	require.EqualError(t, err, "s3://sqpulser-lake requires state store or state table, to emit messages once per emit window")
+}
+
+func TestS3SinkPulseID(t *testing.T) {
+	s3Client := &fakeS3Client{}
+	tmpl, err := sqpulser.ParseS3KeyTemplate("", false)
+	require.NoError(t, err)
+	sink := sqpulser.NewS3Sink(s3Client, "sqpulser-lake", tmpl, false, nil)
+	emitTime := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z"))
+	msgs := []*sqpulser.OutgoingMessage{
+		{ID: "msg-1", Body: "body-1", EmitTime: emitTime},
+		{ID: "msg-2", Body: "body-2", EmitTime: emitTime},
+	}
+	require.Equal(t, make([]error, 2), sink.Emit(context.Background(), msgs))
+	// retry of the same messages overwrites the same object.
+	require.Equal(t, make([]error, 2), sink.Emit(context.Background(), msgs))
+	require.Equal(t, make([]error, 1), sink.Emit(context.Background(), msgs[:1]))
+	require.Len(t, s3Client.puts, 3)
+	require.Equal(t, *s3Client.puts[0].Key, *s3Client.puts[1].Key)
+	require.NotEqual(t, *s3Client.puts[0].Key, *s3Client.puts[2].Key)
+	require.Len(t, s3Client.objects, 2)
+	require.Equal(t, "application/x-ndjson", *s3Client.puts[0].ContentType)
+	lines := readJSONLines(t, s3Client.objects["sqpulser-lake/"+*s3Client.puts[0].Key], false)
+	require.Len(t, lines, 2)
+	require.Equal(t, "body-2", lines[1].Body)
+
+	s3Client.putErr = errors.New("AccessDenied")
+	errs := sink.Emit(context.Background(), msgs)
+	require.Error(t, errs[0])
+	require.Contains(t, errs[0].Error(), "AccessDenied")
+	require.Equal(t, errs[0], errs[1])
+}
+
+func TestS3SinkKeyTimeZone(t *testing.T) {
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.FixedZone("PST", -8*60*60)
+
+	tmpl, err := sqpulser.ParseS3KeyTemplate("", false)
+	require.NoError(t, err)
+	// the emit time restored from the state store is in the local time zone.
+	emitTime := time.UnixMilli(Must(time.Parse(time.RFC3339, "2018-12-17T01:30:00Z")).UnixMilli())
+	msgs := []*sqpulser.OutgoingMessage{{ID: "msg-1", Body: "body-1", EmitTime: emitTime}}
+	for _, c := range []struct {
+		loc    *time.Location
+		prefix string
+	}{
+		{loc: nil, prefix: "2018/12/17/01/"},
+		{loc: time.FixedZone("JST", 9*60*60), prefix: "2018/12/17/10/"},
+	} {
+		s3Client := &fakeS3Client{}
+		sink := sqpulser.NewS3Sink(s3Client, "sqpulser-lake", tmpl, false, c.loc)
+		require.Equal(t, make([]error, 1), sink.Emit(context.Background(), msgs))
+		require.True(t, strings.HasPrefix(*s3Client.puts[0].Key, c.prefix), *s3Client.puts[0].Key)
+	}
+}
+
+func TestParseS3KeyTemplate(t *testing.T) {
+	_, err := sqpulser.ParseS3KeyTemplate("{{.Unknown}}", false)
+	require.Error(t, err)
+	_, err = sqpulser.ParseS3KeyTemplate("{{.EmitTime | date}", false)
+	require.Error(t, err)
+}
+
+func TestNewWithClientS3Aggregate(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingBucket:   "sqpulser-lake",
+		S3Client:         &fakeS3Client{},
+		EmitInterval:     15 * time.Minute,
+		AggregateFormat:  sqpulser.AggregateFormatNDJSON,
+		StateStore:       sqpulser.NewMemoryStateStore(),
+	})
+	require.EqualError(t, err, "aggregate can not be used with S3 bucket sqpulser-lake")
+}
+
+func readJSONLines(t *testing.T, data []byte, compressed bool) []*sqpulser.MessageEnvelope {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(data)
+	if compressed {
+		zr, err := gzip.NewReader(r)
+		require.NoError(t, err)
+		r = zr
+	}
+	dec := json.NewDecoder(r)
+	var lines []*sqpulser.MessageEnvelope
+	for dec.More() {
+		var line sqpulser.MessageEnvelope
+		require.NoError(t, dec.Decode(&line))
+		lines = append(lines, &line)
+	}
+	return lines
+}
@@ -0,0 +1,101 @@
+package sqpulser
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// HopCountAttributeKey is the number of times the message has been resent to the incoming queue.
+	HopCountAttributeKey = "SqpulserHopCount"
+	// DeadLetterReasonAttributeKey records why the message is sent to the dead-letter queue.
+	DeadLetterReasonAttributeKey = "SqpulserDeadLetterReason"
+)
+
+// ErrSafeguardViolation is returned when the message violates MaxHops or MaxTotalDelay and no dead-letter queue is configured.
+// The rejected message is not deleted from the incoming queue, so it is moved to the dead-letter queue by the redrive policy.
+var ErrSafeguardViolation = errors.New("safeguard violation")
+
+// hopCount returns the hop count of the received message.
+func (p *pendingMessage) hopCount() (int, error) {
+	attr, ok := p.msg.MessageAttributes[HopCountAttributeKey]
+	if !ok {
+		return 0, nil
+	}
+	hops, err := strconv.Atoi(aws.ToString(attr.StringValue))
+	if err != nil || hops < 0 {
+		return 0, fmt.Errorf("invalid %s attribute `%s`", HopCountAttributeKey, aws.ToString(attr.StringValue))
+	}
+	return hops, nil
+}
+
+// totalDelay returns the duration from the original sent time to the emit time.
+// The original sent time in the future is not trusted, and the current time is used instead.
+func (p *pendingMessage) totalDelay() time.Duration {
+	since := p.original.SentTime()
+	if now := flextime.Now(); since.After(now) {
+		since = now
+	}
+	return p.emitTime.Sub(since)
+}
+
+// checkTotalDelay returns the reason if the pending message exceeds MaxTotalDelay.
+func (app *App) checkTotalDelay(p *pendingMessage) string {
+	if app.opt.MaxTotalDelay <= 0 || p.delay == 0 {
+		return ""
+	}
+	if total := p.totalDelay(); total > app.opt.MaxTotalDelay {
+		return fmt.Sprintf("total delay %s exceeds max total delay %s", total, app.opt.MaxTotalDelay)
+	}
+	return ""
+}
+
+// countHop increments the hop count of the message resent to the incoming queue,
+// and returns the reason if it exceeds MaxHops.
+func (app *App) countHop(input *sqs.SendMessageInput, p *pendingMessage) (string, error) {
+	hops, err := p.hopCount()
+	if err != nil {
+		return "", err
+	}
+	hops++
+	if app.opt.MaxHops > 0 && hops > app.opt.MaxHops {
+		return fmt.Sprintf("hop count %d exceeds max hops %d", hops, app.opt.MaxHops), nil
+	}
+	input.MessageAttributes[HopCountAttributeKey] = types.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(hops)),
+	}
+	return "", nil
+}
+
+// newDeadLetterRequest sends the message to the dead-letter queue with the reason.
+// If no dead-letter queue is configured, it returns ErrSafeguardViolation.
+func (app *App) newDeadLetterRequest(p *pendingMessage, reason string) (*sendRequest, error) {
+	if app.opt.DeadLetterQueueURL == "" {
+		return nil, fmt.Errorf("%w: %s", ErrSafeguardViolation, reason)
+	}
+	app.logf("[warn][%s] %s, send to dead-letter queue %s", *p.msg.MessageId, reason, app.opt.DeadLetterQueueURL)
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(app.opt.DeadLetterQueueURL),
+		MessageBody:       p.msg.Body,
+		MessageAttributes: p.messageAttributes(),
+	}
+	input.MessageAttributes[DeadLetterReasonAttributeKey] = types.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(reason),
+	}
+	if isFIFOQueue(app.opt.DeadLetterQueueURL) {
+		setFIFOParameters(input, p)
+	}
+	return &sendRequest{
+		input:   input,
+		members: []*pendingMessage{p},
+	}, nil
+}
@@ -0,0 +1,175 @@
+package sqpulser_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+const testDeadLetterQueueURL = "https://sqs.ap-northeast-1.amazonaws.com/123456789012/sqpulser-dlq"
+
+func TestHandleMessagesMaxHops(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{
+		queueURLs: map[string]string{
+			"sqpulser-dlq": testDeadLetterQueueURL,
+		},
+	}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL:    testIncomingQueueURL,
+		OutgoingQueueURL:    testOutgoingQueueURL,
+		EmitInterval:        time.Hour,
+		MaxHops:             2,
+		DeadLetterQueueName: "sqpulser-dlq",
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli()
+	hopCount := func(value string) map[string]types.MessageAttributeValue {
+		return map[string]types.MessageAttributeValue{
+			sqpulser.HopCountAttributeKey: {DataType: aws.String("Number"), StringValue: aws.String(value)},
+		}
+	}
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", sentTimestamp, nil),
+		newTestMessage("msg-2", "body-2", sentTimestamp, hopCount("1")),
+		newTestMessage("msg-3", "body-3", sentTimestamp, hopCount("2")),
+		newTestMessage("msg-4", "body-4", sentTimestamp, hopCount("two")),
+	})
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.NoError(t, errs[2])
+	require.EqualError(t, errs[3], "invalid SqpulserHopCount attribute `two`")
+
+	require.Len(t, client.sent, 3)
+	for i, expected := range []string{"1", "2"} {
+		require.Equal(t, testIncomingQueueURL, *client.sent[i].QueueUrl)
+		require.Equal(t, expected, *client.sent[i].MessageAttributes[sqpulser.HopCountAttributeKey].StringValue)
+	}
+	dead := client.sent[2]
+	require.Equal(t, testDeadLetterQueueURL, *dead.QueueUrl)
+	require.Equal(t, "body-3", *dead.MessageBody)
+	require.EqualValues(t, 0, dead.DelaySeconds)
+	require.Equal(t, "hop count 3 exceeds max hops 2", *dead.MessageAttributes[sqpulser.DeadLetterReasonAttributeKey].StringValue)
+	require.Equal(t, "2", *dead.MessageAttributes[sqpulser.HopCountAttributeKey].StringValue)
+	require.Equal(t, "msg-3", *dead.MessageAttributes[sqpulser.OriginalMessageIDAttributeKey].StringValue)
+}
+
+func TestHandleMessagesMaxHopsFractionalDelay(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339Nano, "2018-12-17T21:30:00.5Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	snsClient := &fakeSNSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingTopicARN: testOutgoingTopicARN,
+		SNSClient:        snsClient,
+		EmitInterval:     time.Hour,
+		// 29m59.5s until 22:00 takes exactly 2 hops of 900s, without an extra hop by rounding.
+		MaxHops: 2,
+	})
+	require.NoError(t, err)
+	msg := newTestMessage("msg-1", "body-1", flextime.Now().UnixMilli(), nil)
+	for hop := 1; ; hop++ {
+		require.NoError(t, app.HandleMessage(context.Background(), &msg))
+		if len(snsClient.published) > 0 {
+			break
+		}
+		require.LessOrEqual(t, hop, 2)
+		require.Len(t, client.sent, hop)
+		input := client.sent[hop-1]
+		require.Equal(t, testIncomingQueueURL, *input.QueueUrl)
+		require.EqualValues(t, 900, input.DelaySeconds)
+		flextime.Fix(flextime.Now().Add(time.Duration(input.DelaySeconds) * time.Second))
+		msg = newTestMessage(fmt.Sprintf("sent-%d", hop), *input.MessageBody, flextime.Now().UnixMilli(), input.MessageAttributes)
+	}
+	require.Len(t, client.sent, 2)
+	require.Equal(t, "2", *client.sent[1].MessageAttributes[sqpulser.HopCountAttributeKey].StringValue)
+	require.Equal(t, "body-1", *snsClient.published[0].PublishBatchRequestEntries[0].Message)
+}
+
+func TestHandleMessagesMaxTotalDelay(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     time.Hour,
+		MaxTotalDelay:    30 * time.Minute,
+	})
+	require.NoError(t, err)
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), nil),
+	})
+	require.NoError(t, errs[0])
+	require.True(t, errors.Is(errs[1], sqpulser.ErrSafeguardViolation), errs[1])
+	require.EqualError(t, errs[1], "safeguard violation: total delay 40m0s exceeds max total delay 30m0s")
+
+	// the violated message is left in the incoming queue for the redrive policy.
+	require.Len(t, client.sent, 1)
+	require.Equal(t, "body-1", *client.sent[0].MessageBody)
+}
+
+func TestHandleMessagesTooManyMessageAttributes(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+	})
+	require.NoError(t, err)
+	producerAttributes := func(n int) map[string]types.MessageAttributeValue {
+		attrs := make(map[string]types.MessageAttributeValue, n)
+		for i := 0; i < n; i++ {
+			attrs[fmt.Sprintf("Attr%d", i)] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("value")}
+		}
+		return attrs
+	}
+	delayed := producerAttributes(8)
+	delayed[sqpulser.DelayAttributeKey] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("1h")}
+	resent := producerAttributes(8)
+	resent[sqpulser.OriginalMessageIDAttributeKey] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("original-3")}
+	resent[sqpulser.OriginalMessageSentTimestampAttributeKey] = types.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String("1545081600000"), // 2018-12-17T21:20:00Z
+	}
+	resent[sqpulser.HopCountAttributeKey] = types.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String("1")}
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		// due, but the original attributes make 11 attributes.
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), producerAttributes(9)),
+		// resent to the incoming queue with the hop count.
+		newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")).UnixMilli(), delayed),
+		// the hop count is not delivered.
+		newTestMessage("msg-3", "body-3", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), resent),
+		newTestMessage("msg-4", "body-4", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), nil),
+	})
+	require.ErrorIs(t, errs[0], sqpulser.ErrTooManyMessageAttributes)
+	require.EqualError(t, errs[0], "too many message attributes: 11 message attributes including 2 added by sqpulser, exceed 10 of SQS")
+	require.EqualError(t, errs[1], "too many message attributes: 12 message attributes including 3 added by sqpulser, exceed 10 of SQS")
+	require.NoError(t, errs[2])
+	require.NoError(t, errs[3])
+
+	require.Len(t, client.sent, 2)
+	require.Equal(t, testOutgoingQueueURL, *client.sent[0].QueueUrl)
+	require.Equal(t, "body-3", *client.sent[0].MessageBody)
+	require.Len(t, client.sent[0].MessageAttributes, 10)
+	require.NotContains(t, client.sent[0].MessageAttributes, sqpulser.HopCountAttributeKey)
+	require.Equal(t, "original-3", *client.sent[0].MessageAttributes[sqpulser.OriginalMessageIDAttributeKey].StringValue)
+	require.Equal(t, "body-4", *client.sent[1].MessageBody)
+}
@@ -0,0 +1,345 @@
+package sqpulser
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule represents when messages are emitted.
+type Schedule interface {
+	// Next returns the next emit time after the given time.
+	// If there is no next emit time, it returns zero time.
+	Next(t time.Time) time.Time
+}
+
+// InLocation returns a schedule that computes emit times in the wall clock of loc.
+func InLocation(schedule Schedule, loc *time.Location) Schedule {
+	return &locationSchedule{
+		schedule: schedule,
+		loc:      loc,
+	}
+}
+
+type locationSchedule struct {
+	schedule Schedule
+	loc      *time.Location
+}
+
+// Next implements Schedule.
+func (s *locationSchedule) Next(t time.Time) time.Time {
+	return s.schedule.Next(t.In(s.loc))
+}
+
+// ImmediateSchedule emits messages immediately, without waiting for any pulse.
+// It is used for the delay mode, in which messages are delayed only by the SqpulserDelay or SqpulserEmitAt attribute.
+type ImmediateSchedule struct{}
+
+// Next implements Schedule, it returns the given time as is.
+func (ImmediateSchedule) Next(t time.Time) time.Time {
+	return t
+}
+
+// fixedSchedule emits messages at the fixed time.
+type fixedSchedule time.Time
+
+// Next implements Schedule.
+func (s fixedSchedule) Next(time.Time) time.Time {
+	return time.Time(s)
+}
+
+// offsetSchedule shifts emit times of the schedule by offset.
+type offsetSchedule struct {
+	schedule Schedule
+	offset   time.Duration
+}
+
+// Next implements Schedule.
+func (s offsetSchedule) Next(t time.Time) time.Time {
+	next := s.schedule.Next(t)
+	if next.IsZero() {
+		return next
+	}
+	return next.Add(s.offset)
+}
+
+// IntervalSchedule emits messages at every Interval, shifted by Offset.
+// The interval is truncated in the wall clock of the location of the given time.
+type IntervalSchedule struct {
+	Interval time.Duration
+	Offset   time.Duration
+}
+
+// Next implements Schedule.
+func (s IntervalSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	wall := wallClock(t)
+	next := wall.Truncate(s.Interval).Add(s.Interval).Add(s.Offset)
+	emitTime := resolveWallClock(next, loc)
+	// in a repeated hour, the first occurrence of next may be before t.
+	for !emitTime.After(t) && next.After(wall) {
+		next = next.Add(s.Interval)
+		emitTime = resolveWallClock(next, loc)
+	}
+	return emitTime
+}
+
+// wallClock returns the wall clock of t as UTC time.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// resolveWallClock returns the time of the wall clock w (represented as UTC time) in loc.
+// A skipped wall clock (e.g. 02:30 at the start of daylight saving time) is shifted forward by the length of the gap,
+// and a repeated wall clock (e.g. 01:30 at the end of daylight saving time) resolves to its first occurrence.
+func resolveWallClock(w time.Time, loc *time.Location) time.Time {
+	if loc == time.UTC {
+		return w
+	}
+	_, offsetBefore := time.Unix(w.Unix()-86400, 0).In(loc).Zone()
+	_, offsetAfter := time.Unix(w.Unix()+86400, 0).In(loc).Zone()
+	before := w.Add(-time.Duration(offsetBefore) * time.Second).In(loc)
+	after := w.Add(-time.Duration(offsetAfter) * time.Second).In(loc)
+	switch {
+	case wallClock(before).Equal(w):
+		if wallClock(after).Equal(w) && after.Before(before) {
+			return after
+		}
+		return before
+	case wallClock(after).Equal(w):
+		return after
+	default:
+		return before
+	}
+}
+
+// CronSchedule emits messages at the times that match a cron expression.
+type CronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+}
+
+const cronSearchLimitYears = 5
+
+// Next implements Schedule.
+// The cron expression is matched against the wall clock of the location of the given time.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	w := wallClock(t)
+	limit := w.Year() + cronSearchLimitYears
+	for {
+		w = s.nextWallClock(w, limit)
+		if w.IsZero() {
+			return w
+		}
+		// in a repeated hour, the first occurrence of w may be before t.
+		if emitTime := resolveWallClock(w, loc); emitTime.After(t) {
+			return emitTime
+		}
+	}
+}
+
+// nextWallClock searches the next matched wall clock after w.
+func (s *CronSchedule) nextWallClock(w time.Time, limit int) time.Time {
+	w = w.Add(time.Second - time.Duration(w.Nanosecond())*time.Nanosecond)
+	for w.Year() <= limit {
+		if s.month&(1<<uint(w.Month())) == 0 {
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.matchDay(w) {
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.hour&(1<<uint(w.Hour())) == 0 {
+			w = time.Date(w.Year(), w.Month(), w.Day(), w.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.minute&(1<<uint(w.Minute())) == 0 {
+			w = time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute()+1, 0, 0, time.UTC)
+			continue
+		}
+		if s.second&(1<<uint(w.Second())) == 0 {
+			w = w.Add(time.Second)
+			continue
+		}
+		return w
+	}
+	return time.Time{}
+}
+
+func (s *CronSchedule) matchDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	// As in the standard cron, when both day of month and day of week are restricted,
+	// either of them matches.
+	if s.dom&cronStarBit != 0 || s.dow&cronStarBit != 0 {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+const cronStarBit = 1 << 63
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronSecondField = cronField{min: 0, max: 59}
+	cronMinuteField = cronField{min: 0, max: 59}
+	cronHourField   = cronField{min: 0, max: 23}
+	cronDomField    = cronField{min: 1, max: 31}
+	cronMonthField  = cronField{min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDowField = cronField{min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseSchedule parses a schedule spec.
+// The spec is a standard 5 fields cron expression (minute hour day-of-month month day-of-week),
+// 6 fields one with leading seconds, or one of the macros such as `@hourly`, `@daily` and `@every 15m`.
+// `@immediate` returns ImmediateSchedule.
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, errors.New("schedule spec is empty")
+	}
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("parse @every interval: %w", err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("@every interval must be positive: %s", interval)
+		}
+		return IntervalSchedule{Interval: interval}, nil
+	}
+	if strings.EqualFold(spec, "@immediate") {
+		return ImmediateSchedule{}, nil
+	}
+	if strings.HasPrefix(spec, "@") {
+		expr, ok := cronMacros[strings.ToLower(spec)]
+		if !ok {
+			return nil, fmt.Errorf("unknown schedule macro `%s`", spec)
+		}
+		spec = expr
+	}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("cron expression `%s` must have 5 or 6 fields, but %d fields", spec, len(fields))
+	}
+	s := &CronSchedule{}
+	var err error
+	if s.second, err = cronSecondField.parse(fields[0]); err != nil {
+		return nil, fmt.Errorf("second field: %w", err)
+	}
+	if s.minute, err = cronMinuteField.parse(fields[1]); err != nil {
+		return nil, fmt.Errorf("minute field: %w", err)
+	}
+	if s.hour, err = cronHourField.parse(fields[2]); err != nil {
+		return nil, fmt.Errorf("hour field: %w", err)
+	}
+	if s.dom, err = cronDomField.parse(fields[3]); err != nil {
+		return nil, fmt.Errorf("day of month field: %w", err)
+	}
+	if s.month, err = cronMonthField.parse(fields[4]); err != nil {
+		return nil, fmt.Errorf("month field: %w", err)
+	}
+	if s.dow, err = cronDowField.parse(fields[5]); err != nil {
+		return nil, fmt.Errorf("day of week field: %w", err)
+	}
+	// 7 is also Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	return s, nil
+}
+
+func (f cronField) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		b, err := f.parsePart(part)
+		if err != nil {
+			return 0, err
+		}
+		bits |= b
+	}
+	return bits, nil
+}
+
+func (f cronField) parsePart(part string) (uint64, error) {
+	rangeExpr, stepExpr, hasStep := strings.Cut(part, "/")
+	step := 1
+	if hasStep {
+		var err error
+		step, err = strconv.Atoi(stepExpr)
+		if err != nil || step <= 0 {
+			return 0, fmt.Errorf("invalid step `%s`", part)
+		}
+	}
+	var start, end int
+	var star bool
+	switch rangeExpr {
+	case "*", "?":
+		start, end, star = f.min, f.max, !hasStep
+	default:
+		lowExpr, highExpr, isRange := strings.Cut(rangeExpr, "-")
+		var err error
+		if start, err = f.value(lowExpr); err != nil {
+			return 0, err
+		}
+		end = start
+		if isRange {
+			if end, err = f.value(highExpr); err != nil {
+				return 0, err
+			}
+		} else if hasStep {
+			end = f.max
+		}
+		if start > end {
+			return 0, fmt.Errorf("invalid range `%s`", part)
+		}
+	}
+	var bits uint64
+	for i := start; i <= end; i += step {
+		bits |= 1 << uint(i)
+	}
+	if star {
+		bits |= cronStarBit
+	}
+	return bits, nil
+}
+
+func (f cronField) value(expr string) (int, error) {
+	if v, ok := f.names[strings.ToLower(expr)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(expr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value `%s`", expr)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value `%d` out of range [%d, %d]", v, f.min, f.max)
+	}
+	return v, nil
+}
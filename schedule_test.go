@@ -0,0 +1,265 @@
+package sqpulser_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSchedule(t *testing.T) {
+	cases := []struct {
+		spec     string
+		from     string
+		expected []string
+	}{
+		{
+			spec: "0 9,18 * * 1-5",
+			from: "2022-08-12T10:00:00Z", // Friday
+			expected: []string{
+				"2022-08-12T18:00:00Z",
+				"2022-08-15T09:00:00Z",
+				"2022-08-15T18:00:00Z",
+			},
+		},
+		{
+			spec: "*/15 * * * *",
+			from: "2018-12-17T21:20:49Z",
+			expected: []string{
+				"2018-12-17T21:30:00Z",
+				"2018-12-17T21:45:00Z",
+				"2018-12-17T22:00:00Z",
+			},
+		},
+		{
+			spec: "30 0 9 * * MON",
+			from: "2022-08-15T09:00:30Z",
+			expected: []string{
+				"2022-08-22T09:00:30Z",
+			},
+		},
+		{
+			spec: "0 0 1,15 * 0",
+			from: "2022-08-01T00:00:00Z",
+			expected: []string{
+				"2022-08-07T00:00:00Z",
+				"2022-08-14T00:00:00Z",
+				"2022-08-15T00:00:00Z",
+			},
+		},
+		{
+			spec: "0 0 29 2 *",
+			from: "2022-08-01T00:00:00Z",
+			expected: []string{
+				"2024-02-29T00:00:00Z",
+			},
+		},
+		{
+			spec: "@hourly",
+			from: "2022-08-10T12:14:30Z",
+			expected: []string{
+				"2022-08-10T13:00:00Z",
+				"2022-08-10T14:00:00Z",
+			},
+		},
+		{
+			spec: "@daily",
+			from: "2022-08-10T12:14:30Z",
+			expected: []string{
+				"2022-08-11T00:00:00Z",
+			},
+		},
+		{
+			spec: "@every 1h",
+			from: "2022-08-10T12:14:30Z",
+			expected: []string{
+				"2022-08-10T13:00:00Z",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.spec, func(t *testing.T) {
+			s, err := sqpulser.ParseSchedule(c.spec)
+			require.NoError(t, err)
+			next := Must(time.Parse(time.RFC3339, c.from))
+			for _, expected := range c.expected {
+				next = s.Next(next)
+				require.EqualValues(t, expected, next.Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestParseScheduleFailed(t *testing.T) {
+	cases := []struct {
+		spec      string
+		errString string
+	}{
+		{spec: "", errString: "schedule spec is empty"},
+		{spec: "@fortnightly", errString: "unknown schedule macro `@fortnightly`"},
+		{spec: "* * * *", errString: "cron expression `* * * *` must have 5 or 6 fields, but 4 fields"},
+		{spec: "60 * * * *", errString: "minute field: value `60` out of range [0, 59]"},
+		{spec: "0 18-9 * * *", errString: "hour field: invalid range `18-9`"},
+		{spec: "0 0 * * foo", errString: "day of week field: invalid value `foo`"},
+		{spec: "*/0 * * * *", errString: "minute field: invalid step `*/0`"},
+	}
+	for _, c := range cases {
+		t.Run(c.spec, func(t *testing.T) {
+			_, err := sqpulser.ParseSchedule(c.spec)
+			require.EqualError(t, err, c.errString)
+		})
+	}
+}
+
+func TestIntervalSchedule(t *testing.T) {
+	cases := []struct {
+		schedule sqpulser.IntervalSchedule
+		from     string
+		expected string
+	}{
+		{
+			schedule: sqpulser.IntervalSchedule{Interval: 15 * time.Minute},
+			from:     "2018-12-17T21:20:49Z",
+			expected: "2018-12-17T21:30:00Z",
+		},
+		{
+			schedule: sqpulser.IntervalSchedule{Interval: 15 * time.Minute, Offset: 5 * time.Minute},
+			from:     "2018-12-17T21:20:49Z",
+			expected: "2018-12-17T21:35:00Z",
+		},
+		{
+			schedule: sqpulser.IntervalSchedule{Interval: time.Hour},
+			from:     "2018-12-17T21:00:00Z",
+			expected: "2018-12-17T22:00:00Z",
+		},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s__%s", c.from, c.schedule.Interval), func(t *testing.T) {
+			actual := c.schedule.Next(Must(time.Parse(time.RFC3339, c.from)))
+			require.EqualValues(t, c.expected, actual.Format(time.RFC3339))
+		})
+	}
+}
+
+func TestScheduleInLocation(t *testing.T) {
+	tokyo := Must(time.LoadLocation("Asia/Tokyo"))
+	newYork := Must(time.LoadLocation("America/New_York"))
+	cases := []struct {
+		name     string
+		schedule sqpulser.Schedule
+		loc      *time.Location
+		from     string
+		expected []string
+	}{
+		{
+			name:     "interval 24h in Asia/Tokyo",
+			schedule: sqpulser.IntervalSchedule{Interval: 24 * time.Hour},
+			loc:      tokyo,
+			from:     "2022-08-10T12:00:00Z",
+			expected: []string{
+				"2022-08-10T15:00:00Z",
+				"2022-08-11T15:00:00Z",
+			},
+		},
+		{
+			name:     "interval 24h with offset in Asia/Tokyo",
+			schedule: sqpulser.IntervalSchedule{Interval: 24 * time.Hour, Offset: 9 * time.Hour},
+			loc:      tokyo,
+			from:     "2022-08-10T12:00:00Z",
+			expected: []string{
+				"2022-08-11T00:00:00Z",
+			},
+		},
+		{
+			name:     "cron in Asia/Tokyo",
+			schedule: Must(sqpulser.ParseSchedule("0 9,18 * * 1-5")),
+			loc:      tokyo,
+			from:     "2022-08-12T10:00:00Z", // Friday 19:00 JST
+			expected: []string{
+				"2022-08-15T00:00:00Z",
+				"2022-08-15T09:00:00Z",
+			},
+		},
+		{
+			name:     "interval 1h across skipped hour",
+			schedule: sqpulser.IntervalSchedule{Interval: time.Hour},
+			loc:      newYork,
+			from:     "2022-03-13T06:30:00Z", // 01:30 EST
+			expected: []string{
+				"2022-03-13T07:00:00Z", // 03:00 EDT
+				"2022-03-13T08:00:00Z", // 04:00 EDT
+			},
+		},
+		{
+			name:     "interval 1h with offset in skipped hour",
+			schedule: sqpulser.IntervalSchedule{Interval: time.Hour, Offset: 30 * time.Minute},
+			loc:      newYork,
+			from:     "2022-03-13T06:45:00Z", // 01:45 EST
+			expected: []string{
+				"2022-03-13T07:30:00Z", // 02:30 EST does not exist, shifted to 03:30 EDT
+				"2022-03-13T08:30:00Z", // 04:30 EDT
+			},
+		},
+		{
+			name:     "cron in skipped hour",
+			schedule: Must(sqpulser.ParseSchedule("30 2 * * *")),
+			loc:      newYork,
+			from:     "2022-03-12T17:00:00Z",
+			expected: []string{
+				"2022-03-13T07:30:00Z", // 02:30 EST does not exist, shifted to 03:30 EDT
+				"2022-03-14T06:30:00Z", // 02:30 EDT
+			},
+		},
+		{
+			name:     "interval 30m across repeated hour",
+			schedule: sqpulser.IntervalSchedule{Interval: 30 * time.Minute},
+			loc:      newYork,
+			from:     "2022-11-06T05:10:00Z", // 01:10 EDT
+			expected: []string{
+				"2022-11-06T05:30:00Z", // 01:30 EDT
+				"2022-11-06T07:00:00Z", // 02:00 EST, repeated 01:00-02:00 EST is skipped
+			},
+		},
+		{
+			name:     "interval 30m in second occurrence of repeated hour",
+			schedule: sqpulser.IntervalSchedule{Interval: 30 * time.Minute},
+			loc:      newYork,
+			from:     "2022-11-06T06:10:00Z", // 01:10 EST
+			expected: []string{
+				"2022-11-06T07:00:00Z", // 02:00 EST
+			},
+		},
+		{
+			name:     "cron in repeated hour",
+			schedule: Must(sqpulser.ParseSchedule("30 1 * * *")),
+			loc:      newYork,
+			from:     "2022-11-05T12:00:00Z",
+			expected: []string{
+				"2022-11-06T05:30:00Z", // 01:30 EDT, first occurrence only
+				"2022-11-07T06:30:00Z", // 01:30 EST
+			},
+		},
+		{
+			name:     "hourly cron across repeated hour",
+			schedule: Must(sqpulser.ParseSchedule("@hourly")),
+			loc:      newYork,
+			from:     "2022-11-06T04:30:00Z", // 00:30 EDT
+			expected: []string{
+				"2022-11-06T05:00:00Z", // 01:00 EDT
+				"2022-11-06T07:00:00Z", // 02:00 EST
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := sqpulser.InLocation(c.schedule, c.loc)
+			next := Must(time.Parse(time.RFC3339, c.from))
+			for _, expected := range c.expected {
+				next = s.Next(next)
+				require.EqualValues(t, expected, next.UTC().Format(time.RFC3339))
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package sqpulser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Sink is an outgoing destination other than SQS queues, such as SNS topics.
+// Unlike SQS, sinks have no per-message delay, so messages are resent to the incoming queue
+// until their emit time has passed, and then emitted to the sink.
+type Sink interface {
+	// Emit emits the due messages, and returns an error for each message.
+	// The received messages whose error is nil are deleted from the incoming queue.
+	Emit(ctx context.Context, msgs []*OutgoingMessage) []error
+	// String returns the destination for logs, e.g. the topic ARN.
+	String() string
+}
+
+// OutgoingMessage is a due message emitted to Sink.
+type OutgoingMessage struct {
+	// ID is the received message id. If aggregated, it is the message id of the first member.
+	ID                string
+	Body              string
+	MessageAttributes map[string]types.MessageAttributeValue
+	// Original is the original attributes of the message. If aggregated, it is the one of the first member.
+	Original *OriginalAttributes
+	EmitTime time.Time
+	// MessageGroupID and DeduplicationID are for FIFO destinations.
+	MessageGroupID  string
+	DeduplicationID string
+}
+
+// outgoingSinkCount returns the number of the outgoing destinations other than the outgoing queue.
+func (opt *Option) outgoingSinkCount() int {
+	var n int
+	for _, target := range []string{opt.OutgoingTopicARN, opt.OutgoingEventBusName, opt.OutgoingWebhookURL, opt.OutgoingStream, opt.OutgoingBucket} {
+		if target != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// newOutgoingSink returns the sink of the outgoing destination. If the destination is the outgoing queue, it returns nil.
+func (app *App) newOutgoingSink() (Sink, error) {
+	switch {
+	case app.opt.OutgoingTopicARN != "":
+		return app.newSNSSink(app.opt.OutgoingTopicARN)
+	case app.opt.OutgoingEventBusName != "":
+		return app.newEventBridgeSink(app.opt.OutgoingEventBusName, app.opt.EventSource, app.opt.EventDetailType)
+	case app.opt.OutgoingWebhookURL != "":
+		return app.newWebhookSink(app.opt.OutgoingWebhookURL)
+	case app.opt.OutgoingStream != "":
+		return app.newKinesisSink(app.opt.OutgoingStream, app.opt.PartitionKeyAttribute)
+	case app.opt.OutgoingBucket != "":
+		return app.newS3Sink(app.opt.OutgoingBucket, app.opt.S3KeyTemplate, app.opt.S3Gzip)
+	}
+	return nil, nil
+}
+
+// newDestinationSink returns the sink of the destination in routing config. If the destination is a queue, it returns nil.
+func (app *App) newDestinationSink(d *DestinationConfig) (Sink, error) {
+	var n int
+	for _, target := range []string{d.QueueURL + d.QueueName, d.TopicARN, d.EventBusName, d.WebhookURL, d.Stream, d.Bucket} {
+		if target != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, errors.New("only one destination can be used")
+	}
+	switch {
+	case d.TopicARN != "":
+		return app.newSNSSink(d.TopicARN)
+	case d.EventBusName != "":
+		source, detailType := d.EventSource, d.EventDetailType
+		if source == "" {
+			source = app.opt.EventSource
+		}
+		if detailType == "" {
+			detailType = app.opt.EventDetailType
+		}
+		return app.newEventBridgeSink(d.EventBusName, source, detailType)
+	case d.WebhookURL != "":
+		return app.newWebhookSink(d.WebhookURL)
+	case d.Stream != "":
+		partitionKeyAttribute := d.PartitionKeyAttribute
+		if partitionKeyAttribute == "" {
+			partitionKeyAttribute = app.opt.PartitionKeyAttribute
+		}
+		return app.newKinesisSink(d.Stream, partitionKeyAttribute)
+	case d.Bucket != "":
+		keyTemplate := d.KeyTemplate
+		if keyTemplate == "" {
+			keyTemplate = app.opt.S3KeyTemplate
+		}
+		return app.newS3Sink(d.Bucket, keyTemplate, d.Gzip || app.opt.S3Gzip)
+	}
+	return nil, nil
+}
+
+// MessageEnvelope is the JSON representation of OutgoingMessage,
+// posted by WebhookSink in the envelope format and written by S3Sink as a line.
+type MessageEnvelope struct {
+	MessageID         string                         `json:"messageId"`
+	SentTimestamp     int64                          `json:"sentTimestamp"`
+	EmitTimestamp     int64                          `json:"emitTimestamp"`
+	Body              string                         `json:"body"`
+	MessageAttributes map[string]AggregatedAttribute `json:"messageAttributes,omitempty"`
+}
+
+// newMessageEnvelope returns the envelope of the message. The original attributes are not in MessageAttributes.
+func newMessageEnvelope(msg *OutgoingMessage) *MessageEnvelope {
+	envelope := &MessageEnvelope{
+		EmitTimestamp: msg.EmitTime.UnixMilli(),
+		Body:          msg.Body,
+	}
+	if msg.Original != nil {
+		envelope.MessageID = msg.Original.MessageID
+		envelope.SentTimestamp = msg.Original.SentTimestamp
+	}
+	for key, value := range msg.MessageAttributes {
+		if key == OriginalMessageIDAttributeKey || key == OriginalMessageSentTimestampAttributeKey {
+			continue
+		}
+		if envelope.MessageAttributes == nil {
+			envelope.MessageAttributes = make(map[string]AggregatedAttribute, len(msg.MessageAttributes))
+		}
+		envelope.MessageAttributes[key] = AggregatedAttribute{
+			DataType:    aws.ToString(value.DataType),
+			StringValue: value.StringValue,
+			BinaryValue: value.BinaryValue,
+		}
+	}
+	return envelope
+}
+
+func newOutgoingMessage(req *sendRequest) *OutgoingMessage {
+	first := req.members[0]
+	return &OutgoingMessage{
+		ID:                *first.msg.MessageId,
+		Body:              aws.ToString(req.input.MessageBody),
+		MessageAttributes: req.input.MessageAttributes,
+		Original:          first.original,
+		EmitTime:          first.emitTime,
+		MessageGroupID:    aws.ToString(req.input.MessageGroupId),
+		DeduplicationID:   aws.ToString(req.input.MessageDeduplicationId),
+	}
+}
+
+// emit emits the requests per sink, and sets the result of each request to errs of its members.
+func (app *App) emit(ctx context.Context, requests []*sendRequest, errs []error) {
+	var sinks []Sink
+	bySink := make(map[Sink][]*sendRequest)
+	for _, req := range requests {
+		if _, ok := bySink[req.sink]; !ok {
+			sinks = append(sinks, req.sink)
+		}
+		bySink[req.sink] = append(bySink[req.sink], req)
+	}
+	for _, sink := range sinks {
+		var (
+			reqs []*sendRequest
+			msgs []*OutgoingMessage
+		)
+		for _, req := range bySink[sink] {
+			msg := newOutgoingMessage(req)
+			pointer, err := app.resolveLargePayload(ctx, msg)
+			if err != nil {
+				for _, p := range req.members {
+					errs[p.index] = fmt.Errorf("emit to %s: %w", sink, err)
+				}
+				continue
+			}
+			req.resolved = pointer
+			reqs = append(reqs, req)
+			msgs = append(msgs, msg)
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		var results []error
+		if err := protect(func() error {
+			results = sink.Emit(ctx, msgs)
+			return nil
+		}); err != nil {
+			results = make([]error, len(msgs))
+			for i := range results {
+				results[i] = err
+			}
+		}
+		for i, req := range reqs {
+			var err error
+			if i < len(results) {
+				err = results[i]
+			} else {
+				err = fmt.Errorf("no result of emit to %s", sink)
+			}
+			if err != nil {
+				for _, p := range req.members {
+					errs[p.index] = fmt.Errorf("emit to %s: %w", sink, err)
+				}
+				continue
+			}
+			for _, p := range req.members {
+				app.logf("[info][%s] emit to %s", *p.msg.MessageId, sink)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package sqpulser
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+type SNSClient interface {
+	PublishBatch(ctx context.Context, params *sns.PublishBatchInput, optFns ...func(*sns.Options)) (*sns.PublishBatchOutput, error)
+}
+
+const (
+	snsMaxBatchEntries     = 10
+	snsMaxBatchPayloadSize = 262144
+)
+
+// SNSSink publishes messages to a SNS topic.
+// SQS message attributes are mapped to SNS message attributes as is.
+type SNSSink struct {
+	client   SNSClient
+	topicARN string
+}
+
+func NewSNSSink(client SNSClient, topicARN string) *SNSSink {
+	return &SNSSink{
+		client:   client,
+		topicARN: topicARN,
+	}
+}
+
+func (app *App) newSNSSink(topicARN string) (*SNSSink, error) {
+	if app.opt.SNSClient == nil {
+		return nil, fmt.Errorf("SNS client is required to publish to %s", topicARN)
+	}
+	return NewSNSSink(app.opt.SNSClient, topicARN), nil
+}
+
+// String implements Sink.
+func (s *SNSSink) String() string {
+	return s.topicARN
+}
+
+// Emit implements Sink, it publishes messages by PublishBatch.
+func (s *SNSSink) Emit(ctx context.Context, msgs []*OutgoingMessage) []error {
+	errs := make([]error, len(msgs))
+	fifo := strings.HasSuffix(s.topicARN, ".fifo")
+	var (
+		entries []snstypes.PublishBatchRequestEntry
+		indexes []int
+		size    int
+	)
+	flush := func() {
+		if len(entries) == 0 {
+			return
+		}
+		s.publishBatch(ctx, entries, indexes, errs)
+		entries, indexes, size = nil, nil, 0
+	}
+	for i, msg := range msgs {
+		entry := snstypes.PublishBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			Message:           aws.String(msg.Body),
+			MessageAttributes: make(map[string]snstypes.MessageAttributeValue, len(msg.MessageAttributes)),
+		}
+		entrySize := len(msg.Body)
+		for name, value := range msg.MessageAttributes {
+			entry.MessageAttributes[name] = snstypes.MessageAttributeValue{
+				DataType:    value.DataType,
+				StringValue: value.StringValue,
+				BinaryValue: value.BinaryValue,
+			}
+			entrySize += len(name) + len(aws.ToString(value.DataType)) + len(aws.ToString(value.StringValue)) + len(value.BinaryValue)
+		}
+		if fifo {
+			entry.MessageGroupId = aws.String(msg.MessageGroupID)
+			entry.MessageDeduplicationId = aws.String(msg.DeduplicationID)
+		}
+		if len(entries) >= snsMaxBatchEntries || size+entrySize > snsMaxBatchPayloadSize {
+			flush()
+		}
+		entries = append(entries, entry)
+		indexes = append(indexes, i)
+		size += entrySize
+	}
+	flush()
+	return errs
+}
+
+func (s *SNSSink) publishBatch(ctx context.Context, entries []snstypes.PublishBatchRequestEntry, indexes []int, errs []error) {
+	output, err := s.client.PublishBatch(ctx, &sns.PublishBatchInput{
+		TopicArn:                   aws.String(s.topicARN),
+		PublishBatchRequestEntries: entries,
+	})
+	if err != nil {
+		for _, i := range indexes {
+			errs[i] = err
+		}
+		return
+	}
+	published := make(map[string]bool, len(output.Successful))
+	for _, successful := range output.Successful {
+		published[aws.ToString(successful.Id)] = true
+	}
+	for _, failed := range output.Failed {
+		i, err := strconv.Atoi(aws.ToString(failed.Id))
+		if err != nil || i < 0 || i >= len(errs) {
+			continue
+		}
+		errs[i] = fmt.Errorf("%s: %s", aws.ToString(failed.Code), aws.ToString(failed.Message))
+	}
+	for _, i := range indexes {
+		if errs[i] == nil && !published[strconv.Itoa(i)] {
+			errs[i] = fmt.Errorf("no result of publish batch entry %d", i)
+		}
+	}
+}
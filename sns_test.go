@@ -0,0 +1,93 @@
+package sqpulser_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+const testOutgoingTopicARN = "arn:aws:sns:ap-northeast-1:012345678900:sqpulser-out"
+
+func TestHandleMessagesSNS(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	snsClient := &fakeSNSClient{
+		failed: func(body string) bool {
+			return body == "body-3"
+		},
+	}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingTopicARN: testOutgoingTopicARN,
+		SNSClient:        snsClient,
+		EmitInterval:     15 * time.Minute,
+	})
+	require.NoError(t, err)
+	msgs := []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+			"Foo": {DataType: aws.String("String"), StringValue: aws.String("bar")},
+		}),
+		newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil),
+		newTestMessage("msg-3", "body-3", Must(time.Parse(time.RFC3339, "2018-12-17T21:10:00Z")).UnixMilli(), nil),
+	}
+	errs := app.HandleMessages(context.Background(), msgs)
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.Error(t, errs[2])
+	require.Contains(t, errs[2].Error(), "emit to "+testOutgoingTopicARN+": InternalError: something wrong")
+
+	// SNS has no delay, so the message is resent to the incoming queue until the emit time.
+	require.Len(t, client.sent, 1)
+	require.Equal(t, testIncomingQueueURL, *client.sent[0].QueueUrl)
+	require.Equal(t, "body-2", *client.sent[0].MessageBody)
+	require.EqualValues(t, 14*60, client.sent[0].DelaySeconds)
+
+	require.Len(t, snsClient.published, 1)
+	input := snsClient.published[0]
+	require.Equal(t, testOutgoingTopicARN, *input.TopicArn)
+	require.Len(t, input.PublishBatchRequestEntries, 2)
+	entry := input.PublishBatchRequestEntries[0]
+	require.Equal(t, "body-1", *entry.Message)
+	require.Equal(t, "bar", *entry.MessageAttributes["Foo"].StringValue)
+	require.Equal(t, "msg-1", *entry.MessageAttributes[sqpulser.OriginalMessageIDAttributeKey].StringValue)
+	require.Equal(t, "Number", *entry.MessageAttributes[sqpulser.OriginalMessageSentTimestampAttributeKey].DataType)
+	require.Nil(t, entry.MessageGroupId)
+}
+
+func TestSNSSinkFIFO(t *testing.T) {
+	snsClient := &fakeSNSClient{}
+	sink := sqpulser.NewSNSSink(snsClient, "arn:aws:sns:ap-northeast-1:012345678900:sqpulser-out.fifo")
+	msgs := make([]*sqpulser.OutgoingMessage, 0, 12)
+	for i := 0; i < 12; i++ {
+		msgs = append(msgs, &sqpulser.OutgoingMessage{
+			ID:              "msg",
+			Body:            "body",
+			MessageGroupID:  "group-1",
+			DeduplicationID: "dedup-1",
+		})
+	}
+	errs := sink.Emit(context.Background(), msgs)
+	require.Equal(t, make([]error, 12), errs)
+	require.Len(t, snsClient.published, 2)
+	require.Len(t, snsClient.published[0].PublishBatchRequestEntries, 10)
+	require.Len(t, snsClient.published[1].PublishBatchRequestEntries, 2)
+	require.Equal(t, "group-1", *snsClient.published[0].PublishBatchRequestEntries[0].MessageGroupId)
+	require.Equal(t, "dedup-1", *snsClient.published[0].PublishBatchRequestEntries[0].MessageDeduplicationId)
+}
+
+func TestNewWithClientSNSWithoutClient(t *testing.T) {
+	_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingTopicARN: testOutgoingTopicARN,
+		EmitInterval:     15 * time.Minute,
+	})
+	require.EqualError(t, err, "SNS client is required to publish to "+testOutgoingTopicARN)
+}
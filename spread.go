@@ -0,0 +1,156 @@
+package sqpulser
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// SpreadOffsetAttributeKey records the spread offset from the pulse in milliseconds,
+// so that the message is emitted at the same time in later hops.
+const SpreadOffsetAttributeKey = "SqpulserSpreadOffset"
+
+// SpreadMode spreads emissions after the pulse, so that consumers see a ramp instead of a wall of messages.
+type SpreadMode string
+
+const (
+	// SpreadNone emits all messages at the pulse.
+	SpreadNone SpreadMode = "none"
+	// SpreadUniform delays each message by a uniformly random jitter within the window.
+	SpreadUniform SpreadMode = "uniform"
+	// SpreadHash delays each message by a jitter within the window derived from the hash of the original message id.
+	SpreadHash SpreadMode = "hash"
+	// SpreadRate delays messages of the pulse in order to emit at most the rate messages per second.
+	SpreadRate SpreadMode = "rate"
+)
+
+// ParseSpreadMode parses the spread mode string.
+func ParseSpreadMode(str string) (SpreadMode, error) {
+	switch m := SpreadMode(strings.ToLower(str)); m {
+	case "":
+		return SpreadNone, nil
+	case SpreadNone, SpreadUniform, SpreadHash, SpreadRate:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown spread mode `%s`", str)
+	}
+}
+
+// SpreadOption is the option of spreading emissions after the pulse.
+type SpreadOption struct {
+	Mode SpreadMode
+	// Window is the max jitter of SpreadUniform and SpreadHash.
+	Window time.Duration
+	// Rate is the number of messages per second of SpreadRate.
+	Rate int
+}
+
+// spreader assigns spread offsets to messages.
+type spreader struct {
+	opt SpreadOption
+
+	mu sync.Mutex
+	// slots is the number of messages assigned to the pulse by SpreadRate.
+	slots map[int64]int
+}
+
+func newSpreader(opt SpreadOption) (*spreader, error) {
+	mode, err := ParseSpreadMode(string(opt.Mode))
+	if err != nil {
+		return nil, err
+	}
+	opt.Mode = mode
+	switch mode {
+	case SpreadNone:
+		return nil, nil
+	case SpreadUniform, SpreadHash:
+		if opt.Window <= 0 {
+			return nil, fmt.Errorf("spread window must be positive for spread mode %s", mode)
+		}
+	case SpreadRate:
+		if opt.Rate <= 0 {
+			return nil, errors.New("spread rate must be positive for spread mode rate")
+		}
+	}
+	return &spreader{
+		opt:   opt,
+		slots: make(map[int64]int),
+	}, nil
+}
+
+// offset returns the spread offset of the message emitted at the pulse.
+func (s *spreader) offset(originalMessageID string, pulse time.Time) time.Duration {
+	switch s.opt.Mode {
+	case SpreadUniform:
+		return time.Duration(rand.Int63n(s.opt.Window.Milliseconds()+1)) * time.Millisecond
+	case SpreadHash:
+		h := fnv.New64a()
+		h.Write([]byte(originalMessageID))
+		return time.Duration(h.Sum64()%uint64(s.opt.Window.Milliseconds()+1)) * time.Millisecond
+	default:
+		return s.nextSlot(pulse)
+	}
+}
+
+// nextSlot assigns the next slot of the pulse by the rate.
+func (s *spreader) nextSlot(pulse time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := flextime.Now()
+	for key, n := range s.slots {
+		// all slots of the pulse have passed.
+		if time.UnixMilli(key).Add(s.slotOffset(n)).Before(now) {
+			delete(s.slots, key)
+		}
+	}
+	key := pulse.UnixMilli()
+	n := s.slots[key]
+	s.slots[key] = n + 1
+	return s.slotOffset(n)
+}
+
+func (s *spreader) slotOffset(n int) time.Duration {
+	return time.Duration(n) * time.Second / time.Duration(s.opt.Rate)
+}
+
+// spread delays the emit time of the pending message by the spread offset.
+// The offset recorded by the previous hop is reused.
+func (app *App) spread(p *pendingMessage) error {
+	if app.spreader == nil {
+		return nil
+	}
+	var offset time.Duration
+	if attr, ok := p.msg.MessageAttributes[SpreadOffsetAttributeKey]; ok {
+		ms, err := strconv.ParseInt(aws.ToString(attr.StringValue), 10, 64)
+		if err != nil || ms < 0 {
+			return fmt.Errorf("invalid %s attribute `%s`", SpreadOffsetAttributeKey, aws.ToString(attr.StringValue))
+		}
+		offset = time.Duration(ms) * time.Millisecond
+	} else {
+		offset = app.spreader.offset(p.original.MessageID, p.emitTime)
+		app.logf("[debug][%s] spread %s after the pulse %s", *p.msg.MessageId, offset, p.emitTime)
+	}
+	p.spreadOffset = &offset
+	p.emitTime = p.emitTime.Add(offset)
+	p.delay = p.emitTime.Sub(flextime.Now())
+	if p.delay < 0 {
+		p.delay = 0
+	}
+	return nil
+}
+
+func setSpreadOffsetAttribute(attributes map[string]types.MessageAttributeValue, offset time.Duration) {
+	attributes[SpreadOffsetAttributeKey] = types.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.FormatInt(offset.Milliseconds(), 10)),
+	}
+}
@@ -0,0 +1,144 @@
+package sqpulser_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+func newSpreadTestMessages(n int) []types.Message {
+	msgs := make([]types.Message, 0, n)
+	for i := 0; i < n; i++ {
+		// all messages are due at the pulse of 21:30.
+		msgs = append(msgs, newTestMessage(fmt.Sprintf("msg-%d", i+1), fmt.Sprintf("body-%d", i+1), Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), nil))
+	}
+	return msgs
+}
+
+// spreadDelays returns the delay seconds of the sent messages, which are emitted at the pulse of now.
+// The offset from the pulse is rounded up to seconds, and the SqpulserSpreadOffset attribute is not delivered.
+func spreadDelays(t *testing.T, client *fakeSQSClient) []int32 {
+	t.Helper()
+	delays := make([]int32, 0, len(client.sent))
+	for _, input := range client.sent {
+		require.Equal(t, testOutgoingQueueURL, *input.QueueUrl)
+		require.NotContains(t, input.MessageAttributes, sqpulser.SpreadOffsetAttributeKey)
+		delays = append(delays, input.DelaySeconds)
+	}
+	return delays
+}
+
+func TestHandleMessagesSpreadJitter(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")))
+	defer restore()
+
+	for _, mode := range []sqpulser.SpreadMode{sqpulser.SpreadUniform, sqpulser.SpreadHash} {
+		t.Run(string(mode), func(t *testing.T) {
+			client := &fakeSQSClient{}
+			app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+				IncomingQueueURL: testIncomingQueueURL,
+				OutgoingQueueURL: testOutgoingQueueURL,
+				EmitInterval:     15 * time.Minute,
+				Spread: sqpulser.SpreadOption{
+					Mode:   mode,
+					Window: 5 * time.Minute,
+				},
+			})
+			require.NoError(t, err)
+			errs := app.HandleMessages(context.Background(), newSpreadTestMessages(20))
+			require.Equal(t, make([]error, 20), errs)
+			require.Len(t, client.sent, 20)
+			delays := spreadDelays(t, client)
+			distinct := make(map[int32]bool)
+			for _, delay := range delays {
+				require.True(t, 0 <= delay && delay <= 300, delay)
+				distinct[delay] = true
+			}
+			require.Greater(t, len(distinct), 1)
+
+			if mode == sqpulser.SpreadHash {
+				client.sent = nil
+				errs := app.HandleMessages(context.Background(), newSpreadTestMessages(20))
+				require.Equal(t, make([]error, 20), errs)
+				require.Equal(t, delays, spreadDelays(t, client))
+			}
+		})
+	}
+}
+
+func TestHandleMessagesSpreadRate(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		Spread: sqpulser.SpreadOption{
+			Mode: sqpulser.SpreadRate,
+			Rate: 2,
+		},
+	})
+	require.NoError(t, err)
+	errs := app.HandleMessages(context.Background(), newSpreadTestMessages(3))
+	require.Equal(t, make([]error, 3), errs)
+	errs = app.HandleMessages(context.Background(), newSpreadTestMessages(2))
+	require.Equal(t, make([]error, 2), errs)
+	require.ElementsMatch(t, []int32{0, 1, 1, 2, 2}, spreadDelays(t, client))
+}
+
+func TestHandleMessagesSpreadRecordedOffset(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		Spread: sqpulser.SpreadOption{
+			Mode:   sqpulser.SpreadUniform,
+			Window: time.Minute,
+		},
+	})
+	require.NoError(t, err)
+	// the offset recorded by the previous hop is reused even if it is out of the window.
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), map[string]types.MessageAttributeValue{
+			sqpulser.SpreadOffsetAttributeKey: {DataType: aws.String("Number"), StringValue: aws.String("120000")},
+		}),
+	})
+	require.Equal(t, []error{nil}, errs)
+	require.Equal(t, []int32{120}, spreadDelays(t, client))
+}
+
+func TestNewWithClientSpread(t *testing.T) {
+	cases := []struct {
+		opt       sqpulser.SpreadOption
+		aggregate sqpulser.AggregateFormat
+		expected  string
+	}{
+		{opt: sqpulser.SpreadOption{Mode: "wave"}, expected: "unknown spread mode `wave`"},
+		{opt: sqpulser.SpreadOption{Mode: sqpulser.SpreadHash}, expected: "spread window must be positive for spread mode hash"},
+		{opt: sqpulser.SpreadOption{Mode: sqpulser.SpreadRate}, expected: "spread rate must be positive for spread mode rate"},
+		{opt: sqpulser.SpreadOption{Mode: sqpulser.SpreadRate, Rate: 10}, aggregate: sqpulser.AggregateFormatJSON, expected: "spread can not be used with aggregate"},
+	}
+	for _, c := range cases {
+		_, err := sqpulser.NewWithClient(context.Background(), &fakeSQSClient{}, &sqpulser.Option{
+			IncomingQueueURL: testIncomingQueueURL,
+			OutgoingQueueURL: testOutgoingQueueURL,
+			EmitInterval:     15 * time.Minute,
+			AggregateFormat:  c.aggregate,
+			Spread:           c.opt,
+		})
+		require.EqualError(t, err, c.expected)
+	}
+}
@@ -0,0 +1,102 @@
+package sqpulser
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+)
+
+// ErrStateConflict is returned by StateStore.Put when the stored version is not the expected one.
+var ErrStateConflict = errors.New("state conflict")
+
+// StateRecord is a record of StateStore.
+type StateRecord struct {
+	Key   string
+	Value []byte
+	// Version is incremented by each put. It is 1 for the first put.
+	Version int64
+	// ExpiresAt is the time after which the record is treated as not found, in seconds like the TTL of DynamoDB.
+	// Zero means it never expires.
+	ExpiresAt time.Time
+}
+
+// expired compares the times in unix seconds, so that all StateStore implementations agree on the expiry.
+func (r *StateRecord) expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && now.Unix() > r.ExpiresAt.Unix()
+}
+
+// StateStore is the durable state beyond message attributes, e.g. for deduplication and the emit windows.
+// Records are read only by key, and Get must return the record of the last successful Put (read-after-write).
+type StateStore interface {
+	// Get returns the record of the key. If the record is not found or expired, it returns nil.
+	Get(ctx context.Context, key string) (*StateRecord, error)
+	// Put stores the record if the version of the stored record is expectedVersion, 0 means not found or expired.
+	// Otherwise it returns ErrStateConflict. The version of the record is set to expectedVersion+1.
+	Put(ctx context.Context, record *StateRecord, expectedVersion int64) error
+	// Delete deletes the record of the key. Deleting the record not found is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// MemoryStateStore is the StateStore in memory, for tests and a single process.
+type MemoryStateStore struct {
+	mu        sync.Mutex
+	records   map[string]StateRecord
+	lastSweep time.Time
+}
+
+// NewMemoryStateStore returns the StateStore in memory.
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		records: make(map[string]StateRecord),
+	}
+}
+
+// Get implements StateStore.
+func (s *MemoryStateStore) Get(_ context.Context, key string) (*StateRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[key]
+	if !ok || record.expired(flextime.Now()) {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// Put implements StateStore.
+func (s *MemoryStateStore) Put(_ context.Context, record *StateRecord, expectedVersion int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := flextime.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for key, stored := range s.records {
+			if stored.expired(now) {
+				delete(s.records, key)
+			}
+		}
+		s.lastSweep = now
+	}
+	var version int64
+	if stored, ok := s.records[record.Key]; ok && !stored.expired(now) {
+		version = stored.Version
+	}
+	if version != expectedVersion {
+		return ErrStateConflict
+	}
+	record.Version = expectedVersion + 1
+	s.records[record.Key] = *record
+	return nil
+}
+
+// Delete implements StateStore.
+func (s *MemoryStateStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// maxStateConflicts is the max number of retries of the conflicted put.
+const maxStateConflicts = 5
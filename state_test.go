@@ -0,0 +1,80 @@
+package sqpulser_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+// testStateStore tests the behavior common to StateStore implementations.
+func testStateStore(t *testing.T, store sqpulser.StateStore) {
+	t.Helper()
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:00:00Z")))
+	defer func() { restore() }()
+
+	ctx := context.Background()
+	expiresAt := Must(time.Parse(time.RFC3339, "2018-12-17T21:15:00Z"))
+
+	record, err := store.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Nil(t, record)
+
+	a := &sqpulser.StateRecord{Key: "a", Value: []byte("1"), ExpiresAt: expiresAt.Add(time.Hour)}
+	require.NoError(t, store.Put(ctx, a, 0))
+	require.EqualValues(t, 1, a.Version)
+	require.ErrorIs(t, store.Put(ctx, &sqpulser.StateRecord{Key: "a", Value: []byte("x")}, 0), sqpulser.ErrStateConflict)
+	a.Value = []byte("2")
+	require.NoError(t, store.Put(ctx, a, 1))
+	require.EqualValues(t, 2, a.Version)
+	require.ErrorIs(t, store.Put(ctx, a, 1), sqpulser.ErrStateConflict)
+
+	record, err = store.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, "a", record.Key)
+	require.Equal(t, []byte("2"), record.Value)
+	require.EqualValues(t, 2, record.Version)
+	require.True(t, record.ExpiresAt.Equal(expiresAt.Add(time.Hour)), record.ExpiresAt)
+
+	require.NoError(t, store.Put(ctx, &sqpulser.StateRecord{Key: "b", Value: []byte("b"), ExpiresAt: expiresAt}, 0))
+
+	require.NoError(t, store.Delete(ctx, "a"))
+	require.NoError(t, store.Delete(ctx, "a"))
+	record, err = store.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Nil(t, record)
+
+	// expired records are treated as not found.
+	restore()
+	restore = flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:16:00Z")))
+	record, err = store.Get(ctx, "b")
+	require.NoError(t, err)
+	require.Nil(t, record)
+	// the expired record is not updated by its version.
+	require.ErrorIs(t, store.Put(ctx, &sqpulser.StateRecord{Key: "b", Value: []byte("b1")}, 1), sqpulser.ErrStateConflict)
+	b := &sqpulser.StateRecord{Key: "b", Value: []byte("b2")}
+	require.NoError(t, store.Put(ctx, b, 0))
+	require.EqualValues(t, 1, b.Version)
+
+	// records expire in seconds, on get and on put alike.
+	require.NoError(t, store.Put(ctx, &sqpulser.StateRecord{Key: "s", Value: []byte("s"), ExpiresAt: Must(time.Parse(time.RFC3339Nano, "2018-12-17T21:16:00.5Z"))}, 0))
+	restore()
+	restore = flextime.Fix(Must(time.Parse(time.RFC3339Nano, "2018-12-17T21:16:00.9Z")))
+	record, err = store.Get(ctx, "s")
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	require.ErrorIs(t, store.Put(ctx, &sqpulser.StateRecord{Key: "s", Value: []byte("s2")}, 0), sqpulser.ErrStateConflict)
+	restore()
+	restore = flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:16:01Z")))
+	record, err = store.Get(ctx, "s")
+	require.NoError(t, err)
+	require.Nil(t, record)
+	require.NoError(t, store.Put(ctx, &sqpulser.StateRecord{Key: "s", Value: []byte("s2")}, 0))
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	testStateStore(t, sqpulser.NewMemoryStateStore())
+}
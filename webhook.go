@@ -0,0 +1,240 @@
+package sqpulser
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// WebhookFormat is the request body format of WebhookSink.
+type WebhookFormat string
+
+const (
+	// WebhookFormatRaw posts the message body as is, and the message attributes as headers.
+	WebhookFormatRaw WebhookFormat = "raw"
+	// WebhookFormatEnvelope posts MessageEnvelope as JSON.
+	WebhookFormatEnvelope WebhookFormat = "envelope"
+)
+
+// ParseWebhookFormat parses the webhook format string.
+func ParseWebhookFormat(str string) (WebhookFormat, error) {
+	switch f := WebhookFormat(strings.ToLower(str)); f {
+	case "":
+		return WebhookFormatRaw, nil
+	case WebhookFormatRaw, WebhookFormatEnvelope:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown webhook format `%s`", str)
+	}
+}
+
+const (
+	// WebhookSignatureHeader is the HMAC-SHA256 signature of the request, `sha256=<hex>`.
+	// The signed payload is the timestamp header value, `.` and the request body.
+	WebhookSignatureHeader = "X-Sqpulser-Signature"
+	// WebhookTimestampHeader is the unix time in seconds when the request is signed.
+	WebhookTimestampHeader = "X-Sqpulser-Timestamp"
+	// WebhookAttributeHeaderPrefix is the header name prefix of the message attributes in the raw format.
+	WebhookAttributeHeaderPrefix = "X-Sqpulser-Attribute-"
+
+	webhookOriginalMessageIDHeader     = "X-Sqpulser-Original-Message-Id"
+	webhookOriginalSentTimestampHeader = "X-Sqpulser-Original-Sent-Timestamp"
+	webhookEmitTimestampHeader         = "X-Sqpulser-Emit-Timestamp"
+
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+// WebhookOption is the option of WebhookSink.
+type WebhookOption struct {
+	// Secret signs requests. If empty, requests are not signed.
+	Secret string
+	// Format is the request body format, default is WebhookFormatRaw.
+	Format WebhookFormat
+	// Timeout is the timeout of each request, default is 10s.
+	Timeout time.Duration
+	// MaxRetries is the number of retries of a failed request. 0 means no retry.
+	MaxRetries int
+}
+
+// WebhookSink posts messages to a HTTP endpoint one by one.
+// Requests failed by network errors, 408, 429 or 5xx responses are retried with backoff,
+// and the messages still failed are left in the incoming queue.
+type WebhookSink struct {
+	client *http.Client
+	url    string
+	opt    WebhookOption
+}
+
+func NewWebhookSink(client *http.Client, url string, opt WebhookOption) *WebhookSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if opt.Format == "" {
+		opt.Format = WebhookFormatRaw
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultWebhookTimeout
+	}
+	return &WebhookSink{
+		client: client,
+		url:    url,
+		opt:    opt,
+	}
+}
+
+func (app *App) newWebhookSink(url string) (*WebhookSink, error) {
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return nil, fmt.Errorf("webhook url %s must be http or https", url)
+	}
+	if _, err := ParseWebhookFormat(string(app.opt.Webhook.Format)); err != nil {
+		return nil, err
+	}
+	return NewWebhookSink(app.opt.HTTPClient, url, app.opt.Webhook), nil
+}
+
+// String implements Sink.
+func (s *WebhookSink) String() string {
+	return s.url
+}
+
+// Emit implements Sink, it posts each message.
+func (s *WebhookSink) Emit(ctx context.Context, msgs []*OutgoingMessage) []error {
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = s.post(ctx, msg)
+	}
+	return errs
+}
+
+// webhookStatusError is the error of the non-2xx response.
+type webhookStatusError struct {
+	statusCode int
+	body       string
+}
+
+func (err *webhookStatusError) Error() string {
+	if err.body == "" {
+		return fmt.Sprintf("webhook responded %d", err.statusCode)
+	}
+	return fmt.Sprintf("webhook responded %d: %s", err.statusCode, err.body)
+}
+
+func (err *webhookStatusError) retryable() bool {
+	return err.statusCode == http.StatusRequestTimeout || err.statusCode == http.StatusTooManyRequests || err.statusCode >= 500
+}
+
+func (s *WebhookSink) post(ctx context.Context, msg *OutgoingMessage) error {
+	body, header, err := s.encode(msg)
+	if err != nil {
+		return err
+	}
+	var b backoff
+	for retries := 0; ; retries++ {
+		err := s.do(ctx, body, header)
+		if err == nil {
+			return nil
+		}
+		var statusErr *webhookStatusError
+		if errors.As(err, &statusErr) && !statusErr.retryable() {
+			return err
+		}
+		if retries >= s.opt.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+		if !sleepContext(ctx, b.next()) {
+			return err
+		}
+	}
+}
+
+func (s *WebhookSink) do(ctx context.Context, body []byte, header http.Header) error {
+	ctx, cancel := context.WithTimeout(ctx, s.opt.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	// sign at each attempt, so that the timestamp is fresh for the receiver checking the replay window.
+	if s.opt.Secret != "" {
+		timestamp := strconv.FormatInt(flextime.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, WebhookSignature([]byte(s.opt.Secret), timestamp, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	excerpt, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	return &webhookStatusError{
+		statusCode: resp.StatusCode,
+		body:       strings.TrimSpace(string(excerpt)),
+	}
+}
+
+// encode returns the request body and headers of the message.
+func (s *WebhookSink) encode(msg *OutgoingMessage) ([]byte, http.Header, error) {
+	header := make(http.Header)
+	envelope := newMessageEnvelope(msg)
+	header.Set(webhookOriginalMessageIDHeader, envelope.MessageID)
+	header.Set(webhookOriginalSentTimestampHeader, strconv.FormatInt(envelope.SentTimestamp, 10))
+	header.Set(webhookEmitTimestampHeader, strconv.FormatInt(envelope.EmitTimestamp, 10))
+	if s.opt.Format == WebhookFormatEnvelope {
+		body, err := json.Marshal(envelope)
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Set("Content-Type", "application/json")
+		return body, header, nil
+	}
+	for key, value := range msg.MessageAttributes {
+		if key == OriginalMessageIDAttributeKey || key == OriginalMessageSentTimestampAttributeKey {
+			continue
+		}
+		str := aws.ToString(value.StringValue)
+		if value.BinaryValue != nil {
+			str = base64.StdEncoding.EncodeToString(value.BinaryValue)
+		}
+		if strings.ContainsAny(str, "\r\n\x00") {
+			return nil, nil, fmt.Errorf("message attribute %s can not be sent as a header, use the envelope format", key)
+		}
+		header.Set(WebhookAttributeHeaderPrefix+key, str)
+	}
+	body := []byte(msg.Body)
+	if json.Valid(body) {
+		header.Set("Content-Type", "application/json")
+	} else {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	return body, header, nil
+}
+
+// WebhookSignature returns the value of WebhookSignatureHeader. Receivers can verify requests by comparing it with hmac.Equal.
+func WebhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
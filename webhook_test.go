@@ -0,0 +1,198 @@
+package sqpulser_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   string
+}
+
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*webhookRequest
+	// status returns the response status of the n-th request with the body.
+	status func(body string, n int) int
+}
+
+func newWebhookServer(status func(body string, n int) int) *webhookServer {
+	s := &webhookServer{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		var n int
+		for _, req := range s.requests {
+			if req.body == string(body) {
+				n++
+			}
+		}
+		s.requests = append(s.requests, &webhookRequest{header: r.Header, body: string(body)})
+		s.mu.Unlock()
+		code := http.StatusOK
+		if s.status != nil {
+			code = s.status(string(body), n)
+		}
+		w.WriteHeader(code)
+	}))
+	return s
+}
+
+func (s *webhookServer) received() []*webhookRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*webhookRequest(nil), s.requests...)
+}
+
+func TestHandleMessagesWebhook(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	server := newWebhookServer(func(body string, n int) int {
+		switch {
+		case body == "retried" && n == 0:
+			return http.StatusServiceUnavailable
+		case body == "bad":
+			return http.StatusBadRequest
+		case body == "down":
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	defer server.Close()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL:   testIncomingQueueURL,
+		OutgoingWebhookURL: server.URL,
+		Webhook: sqpulser.WebhookOption{
+			Secret:     "s3cr3t",
+			MaxRetries: 2,
+		},
+		EmitInterval: 15 * time.Minute,
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli()
+	msgs := []types.Message{
+		newTestMessage("msg-1", `{"id":1}`, sentTimestamp, map[string]types.MessageAttributeValue{
+			"Foo": {DataType: aws.String("String"), StringValue: aws.String("bar")},
+		}),
+		newTestMessage("msg-2", "retried", sentTimestamp, nil),
+		newTestMessage("msg-3", "bad", sentTimestamp, nil),
+		newTestMessage("msg-4", "down", sentTimestamp, nil),
+		newTestMessage("msg-5", "later", Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")).UnixMilli(), nil),
+	}
+	errs := app.HandleMessages(context.Background(), msgs)
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.EqualError(t, errs[2], "emit to "+server.URL+": webhook responded 400")
+	require.EqualError(t, errs[3], "emit to "+server.URL+": webhook responded 500")
+	require.NoError(t, errs[4])
+
+	// not due yet, resent to the incoming queue.
+	require.Len(t, client.sent, 1)
+	require.Equal(t, "later", *client.sent[0].MessageBody)
+
+	// msg-1: 1, retried: 1 + 1, bad: 1, down: 1 + 2
+	requests := server.received()
+	require.Len(t, requests, 7)
+	req := requests[0]
+	require.Equal(t, `{"id":1}`, req.body)
+	require.Equal(t, "application/json", req.header.Get("Content-Type"))
+	require.Equal(t, "bar", req.header.Get(sqpulser.WebhookAttributeHeaderPrefix+"Foo"))
+	require.Equal(t, "msg-1", req.header.Get("X-Sqpulser-Original-Message-Id"))
+	require.Equal(t, "1545082200000", req.header.Get("X-Sqpulser-Emit-Timestamp"))
+	timestamp := req.header.Get(sqpulser.WebhookTimestampHeader)
+	require.Equal(t, "1545082260", timestamp)
+	require.Equal(t, sqpulser.WebhookSignature([]byte("s3cr3t"), timestamp, []byte(req.body)), req.header.Get(sqpulser.WebhookSignatureHeader))
+	require.Equal(t, "text/plain; charset=utf-8", requests[1].header.Get("Content-Type"))
+}
+
+func TestWebhookSinkEnvelope(t *testing.T) {
+	server := newWebhookServer(nil)
+	defer server.Close()
+
+	sink := sqpulser.NewWebhookSink(server.Client(), server.URL, sqpulser.WebhookOption{
+		Format: sqpulser.WebhookFormatEnvelope,
+	})
+	errs := sink.Emit(context.Background(), []*sqpulser.OutgoingMessage{
+		{
+			ID:   "msg-1",
+			Body: "line1\nline2",
+			MessageAttributes: map[string]types.MessageAttributeValue{
+				"Foo":                                  {DataType: aws.String("String"), StringValue: aws.String("multi\nline")},
+				sqpulser.OriginalMessageIDAttributeKey: {DataType: aws.String("String"), StringValue: aws.String("msg-0")},
+			},
+			Original: &sqpulser.OriginalAttributes{MessageID: "msg-0", SentTimestamp: 1545081600000},
+			EmitTime: Must(time.Parse(time.RFC3339, "2018-12-17T21:30:00Z")),
+		},
+	})
+	require.Equal(t, []error{nil}, errs)
+	requests := server.received()
+	require.Len(t, requests, 1)
+	req := requests[0]
+	require.Equal(t, "application/json", req.header.Get("Content-Type"))
+	require.Empty(t, req.header.Get(sqpulser.WebhookSignatureHeader))
+	var envelope sqpulser.MessageEnvelope
+	require.NoError(t, json.Unmarshal([]byte(req.body), &envelope))
+	require.Equal(t, sqpulser.MessageEnvelope{
+		MessageID:     "msg-0",
+		SentTimestamp: 1545081600000,
+		EmitTimestamp: 1545082200000,
+		Body:          "line1\nline2",
+		MessageAttributes: map[string]sqpulser.AggregatedAttribute{
+			"Foo": {DataType: "String", StringValue: aws.String("multi\nline")},
+		},
+	}, envelope)
+}
+
+func TestWebhookSinkRawInvalidHeader(t *testing.T) {
+	server := newWebhookServer(nil)
+	defer server.Close()
+
+	sink := sqpulser.NewWebhookSink(server.Client(), server.URL, sqpulser.WebhookOption{})
+	errs := sink.Emit(context.Background(), []*sqpulser.OutgoingMessage{
+		{
+			ID:   "msg-1",
+			Body: "body",
+			MessageAttributes: map[string]types.MessageAttributeValue{
+				"Foo": {DataType: aws.String("String"), StringValue: aws.String("multi\nline")},
+			},
+		},
+	})
+	require.EqualError(t, errs[0], "message attribute Foo can not be sent as a header, use the envelope format")
+	require.Empty(t, server.received())
+}
+
+func TestWebhookSinkTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	sink := sqpulser.NewWebhookSink(server.Client(), server.URL, sqpulser.WebhookOption{
+		Timeout: 50 * time.Millisecond,
+	})
+	errs := sink.Emit(context.Background(), []*sqpulser.OutgoingMessage{{ID: "msg-1", Body: "body"}})
+	require.Error(t, errs[0])
+	require.ErrorIs(t, errs[0], context.DeadlineExceeded)
+}
@@ -0,0 +1,414 @@
+package sqpulser
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// FlushAttributeKey marks the flush message of an emit window, sent to the incoming queue by sqpulser itself.
+// Its value is the state store key of the window.
+const FlushAttributeKey = "SqpulserFlush"
+
+// DefaultFlushDelay is the default duration from the first due message of an emit window to the flush of the window.
+const DefaultFlushDelay = time.Minute
+
+// windowBufferTTL is the lifetime of the buffered records after the emit time.
+// It is the max retention period of SQS, so that the records outlive the flush message.
+const windowBufferTTL = 14 * 24 * time.Hour
+
+// windowed returns true if the due messages of the destination are buffered in the state store
+// and emitted together once per emit window, i.e. aggregated, written into an S3 object or put to a Kinesis data stream.
+func (app *App) windowed(dest *destination) bool {
+	if app.opt.AggregateFormat != AggregateFormatNone {
+		return true
+	}
+	switch dest.sink.(type) {
+	case *S3Sink, *KinesisSink:
+		return true
+	}
+	return false
+}
+
+// windowKeyPrefix is the prefix of the state store keys of the emit windows of the incoming queue.
+func (app *App) windowKeyPrefix() string {
+	return "window/" + app.opt.IncomingQueueURL + "/"
+}
+
+// windowKey is the state store key of the emit window of the destination.
+// The keys of the buffered messages of the window are it followed by the original message ids.
+func (app *App) windowKey(dest *destination, emitTime time.Time) string {
+	return fmt.Sprintf("%s%s/%d", app.windowKeyPrefix(), dest, emitTime.UnixMilli())
+}
+
+// bufferedMessage is the due message buffered in the state store until its window is flushed.
+type bufferedMessage struct {
+	MessageID             string                         `json:"messageId"`
+	OriginalMessageID     string                         `json:"originalMessageId"`
+	OriginalSentTimestamp int64                          `json:"originalSentTimestamp"`
+	Body                  string                         `json:"body"`
+	MessageAttributes     map[string]AggregatedAttribute `json:"messageAttributes,omitempty"`
+	// Attributes are the FIFO parameters of the received message.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Late       bool              `json:"late,omitempty"`
+}
+
+func newBufferedMessage(p *pendingMessage) *bufferedMessage {
+	b := &bufferedMessage{
+		MessageID:             *p.msg.MessageId,
+		OriginalMessageID:     p.original.MessageID,
+		OriginalSentTimestamp: p.original.SentTimestamp,
+		Body:                  aws.ToString(p.msg.Body),
+		Late:                  p.late,
+	}
+	for key, value := range p.msg.MessageAttributes {
+		if b.MessageAttributes == nil {
+			b.MessageAttributes = make(map[string]AggregatedAttribute, len(p.msg.MessageAttributes))
+		}
+		b.MessageAttributes[key] = AggregatedAttribute{
+			DataType:    aws.ToString(value.DataType),
+			StringValue: value.StringValue,
+			BinaryValue: value.BinaryValue,
+		}
+	}
+	for _, name := range []string{messageGroupIDAttributeName, deduplicationIDAttributeName} {
+		if value, ok := p.msg.Attributes[name]; ok {
+			if b.Attributes == nil {
+				b.Attributes = make(map[string]string, 2)
+			}
+			b.Attributes[name] = value
+		}
+	}
+	return b
+}
+
+// pendingMessage restores the due message of the window.
+func (b *bufferedMessage) pendingMessage(dest *destination, emitTime time.Time) *pendingMessage {
+	msg := &types.Message{
+		MessageId:  aws.String(b.MessageID),
+		Body:       aws.String(b.Body),
+		Attributes: b.Attributes,
+	}
+	for key, value := range b.MessageAttributes {
+		if msg.MessageAttributes == nil {
+			msg.MessageAttributes = make(map[string]types.MessageAttributeValue, len(b.MessageAttributes))
+		}
+		msg.MessageAttributes[key] = types.MessageAttributeValue{
+			DataType:    aws.String(value.DataType),
+			StringValue: value.StringValue,
+			BinaryValue: value.BinaryValue,
+		}
+	}
+	return &pendingMessage{
+		msg: msg,
+		original: &OriginalAttributes{
+			MessageID:     b.OriginalMessageID,
+			SentTimestamp: b.OriginalSentTimestamp,
+		},
+		dest:     dest,
+		emitTime: emitTime,
+		pulse:    emitTime,
+		late:     b.Late,
+	}
+}
+
+// windowState is the value of the window record.
+// The members are listed in the record itself, so that they are read by the strongly consistent get of the record.
+type windowState struct {
+	// Token is the body of the flush message, so that only the flush message sent by sqpulser flushes the window.
+	// Empty means the flush of the window is not scheduled.
+	Token         string `json:"token,omitempty"`
+	Destination   string `json:"destination,omitempty"`
+	EmitTimestamp int64  `json:"emitTimestamp"`
+	// FlushAt is the unix time in milliseconds at which the window is flushed.
+	FlushAt int64 `json:"flushAt,omitempty"`
+	// Members are the original message ids of the buffered messages to flush.
+	Members []string `json:"members,omitempty"`
+}
+
+// hasMember returns true if the message is a member of the window.
+func (s *windowState) hasMember(id string) bool {
+	for _, member := range s.Members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) flushDelay() time.Duration {
+	if app.opt.FlushDelay <= 0 {
+		return DefaultFlushDelay
+	}
+	return app.opt.FlushDelay
+}
+
+// buffer records the due message in the state store, and adds it to the members of its window.
+// The message is deleted from the incoming queue only after it is a member, so that the flush of the window emits it.
+func (app *App) buffer(ctx context.Context, p *pendingMessage) error {
+	key := app.windowKey(p.dest, p.emitTime)
+	value, err := json.Marshal(newBufferedMessage(p))
+	if err != nil {
+		return fmt.Errorf("buffer: %w", err)
+	}
+	err = app.opt.StateStore.Put(ctx, &StateRecord{
+		Key:       key + "/" + p.original.MessageID,
+		Value:     value,
+		ExpiresAt: p.emitTime.Add(windowBufferTTL),
+	}, 0)
+	switch {
+	case errors.Is(err, ErrStateConflict):
+		// buffered by the previous receive of the same message.
+		app.logf("[info][%s] already buffered for emit window %s", *p.msg.MessageId, p.emitTime)
+	case err != nil:
+		return fmt.Errorf("buffer: %w", err)
+	default:
+		app.logf("[info][%s] buffer for emit window %s of %s", *p.msg.MessageId, p.emitTime, p.dest)
+	}
+	if err := app.joinWindow(ctx, p.dest, p.emitTime, p.original.MessageID); err != nil {
+		return fmt.Errorf("buffer: %w", err)
+	}
+	return nil
+}
+
+// getWindow returns the window record and its state. If the record is not found, the state is empty and the version is 0.
+func (app *App) getWindow(ctx context.Context, key string) (*windowState, int64, error) {
+	record, err := app.opt.StateStore.Get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	var state windowState
+	if record == nil {
+		return &state, 0, nil
+	}
+	if err := json.Unmarshal(record.Value, &state); err != nil {
+		return nil, 0, fmt.Errorf("decode window record %s: %w", key, err)
+	}
+	return &state, record.Version, nil
+}
+
+// putWindow stores the state of the window record, if the version of the stored record is expectedVersion.
+func (app *App) putWindow(ctx context.Context, key string, emitTime time.Time, state *windowState, expectedVersion int64) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return app.opt.StateStore.Put(ctx, &StateRecord{
+		Key:       key,
+		Value:     value,
+		ExpiresAt: emitTime.Add(windowBufferTTL),
+	}, expectedVersion)
+}
+
+// joinWindow adds the message to the members of the window, and schedules the flush of the window unless it is already scheduled.
+func (app *App) joinWindow(ctx context.Context, dest *destination, emitTime time.Time, id string) error {
+	key := app.windowKey(dest, emitTime)
+	var token string
+	for i := 0; ; i++ {
+		state, version, err := app.getWindow(ctx, key)
+		if err != nil {
+			return err
+		}
+		if state.Token != "" && state.hasMember(id) {
+			return nil
+		}
+		if !state.hasMember(id) {
+			state.Members = append(state.Members, id)
+		}
+		if state.Token == "" {
+			// the flush message is sent before the record refers to it, so that the scheduled flush is never lost.
+			// The flush message whose token is not recorded is ignored.
+			if token == "" {
+				if token, err = app.sendFlush(ctx, key, dest, emitTime); err != nil {
+					return err
+				}
+			}
+			state.Token = token
+			state.Destination = dest.name
+			state.EmitTimestamp = emitTime.UnixMilli()
+			state.FlushAt = flextime.Now().Add(app.flushDelay()).UnixMilli()
+		}
+		err = app.putWindow(ctx, key, emitTime, state, version)
+		if errors.Is(err, ErrStateConflict) && i+1 < maxStateConflicts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("window record %s: %w", key, err)
+		}
+		return nil
+	}
+}
+
+// sendFlush sends the flush message of the window to the incoming queue, and returns its token.
+func (app *App) sendFlush(ctx context.Context, key string, dest *destination, emitTime time.Time) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b[:])
+	delay := app.flushDelay()
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(app.opt.IncomingQueueURL),
+		MessageBody: aws.String(token),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			FlushAttributeKey: {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(key),
+			},
+		},
+		DelaySeconds: delaySeconds(delay),
+	}
+	if isFIFOQueue(app.opt.IncomingQueueURL) {
+		// FIFO queues have no per-message delay, the flush message is held until FlushAt when received.
+		h := sha256.Sum256([]byte(key))
+		input.MessageGroupId = aws.String("sqpulser-flush-" + hex.EncodeToString(h[:8]))
+		input.MessageDeduplicationId = aws.String(token)
+		input.DelaySeconds = 0
+	}
+	if _, err := app.client.SendMessage(ctx, input); err != nil {
+		return "", fmt.Errorf("send flush message to %s: %w", app.opt.IncomingQueueURL, err)
+	}
+	app.logf("[info] schedule flush of emit window %s of %s after %s", emitTime, dest, delay)
+	return token, nil
+}
+
+// windowFlush is the flush of an emit window by the flush message.
+type windowFlush struct {
+	msg      *types.Message
+	index    int
+	key      string
+	token    string
+	dest     *destination
+	emitTime time.Time
+	// members are the buffered messages of the window, whose index is the one of the flush message.
+	members []*pendingMessage
+	// ids are the original message ids of the members, removed from the window record after the members are emitted.
+	ids []string
+}
+
+// isFlushMessage returns true if the message is the flush message of an emit window.
+func isFlushMessage(msg *types.Message) bool {
+	_, ok := msg.MessageAttributes[FlushAttributeKey]
+	return ok
+}
+
+// flush loads the buffered messages of the window of the flush message.
+// If the window is not due yet, the flush message is held and ErrMessageHeld is returned.
+// If the window has already been flushed, or the flush message is not the one sent by sqpulser, it returns nil.
+func (app *App) flush(ctx context.Context, msg *types.Message, index int) (*windowFlush, error) {
+	key := aws.ToString(msg.MessageAttributes[FlushAttributeKey].StringValue)
+	if !strings.HasPrefix(key, app.windowKeyPrefix()) {
+		app.logf("[warn][%s] ignore flush message of unknown window `%s`", *msg.MessageId, key)
+		return nil, nil
+	}
+	state, _, err := app.getWindow(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("flush: %w", err)
+	}
+	if state.Token == "" {
+		app.logf("[info][%s] emit window `%s` has already been flushed", *msg.MessageId, key)
+		return nil, nil
+	}
+	if state.Token != aws.ToString(msg.Body) {
+		app.logf("[warn][%s] ignore flush message of emit window `%s` with unknown token", *msg.MessageId, key)
+		return nil, nil
+	}
+	dest, err := app.router.destination(state.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("flush: %w", err)
+	}
+	if remaining := time.UnixMilli(state.FlushAt).Sub(flextime.Now()); remaining > 0 {
+		return nil, app.holdMessage(ctx, msg, remaining)
+	}
+	emitTime := time.UnixMilli(state.EmitTimestamp)
+	f := &windowFlush{
+		msg:      msg,
+		index:    index,
+		key:      key,
+		token:    state.Token,
+		dest:     dest,
+		emitTime: emitTime,
+	}
+	for _, id := range state.Members {
+		record, err := app.opt.StateStore.Get(ctx, key+"/"+id)
+		if err != nil {
+			return nil, fmt.Errorf("flush: %w", err)
+		}
+		f.ids = append(f.ids, id)
+		if record == nil {
+			// emitted by the previous flush, which failed to update the window record.
+			app.logf("[info][%s] buffered message %s of emit window `%s` has already been emitted", *msg.MessageId, id, key)
+			continue
+		}
+		var b bufferedMessage
+		if err := json.Unmarshal(record.Value, &b); err != nil {
+			return nil, fmt.Errorf("flush: decode buffered record %s: %w", record.Key, err)
+		}
+		p := b.pendingMessage(dest, emitTime)
+		p.index = index
+		f.members = append(f.members, p)
+	}
+	app.logf("[info][%s] flush emit window %s of %s, %d messages", *msg.MessageId, emitTime, dest, len(f.members))
+	return f, nil
+}
+
+// flushed deletes the records of the emitted members, and removes them from the window record.
+// If messages joined the window during the flush, the flush message is held to flush them again after the flush delay.
+func (app *App) flushed(ctx context.Context, f *windowFlush) error {
+	for _, id := range f.ids {
+		if err := app.opt.StateStore.Delete(ctx, f.key+"/"+id); err != nil {
+			app.logf("[warn] failed to delete buffered record %s/%s: %v", f.key, id, err)
+		}
+	}
+	emitted := make(map[string]bool, len(f.ids))
+	for _, id := range f.ids {
+		emitted[id] = true
+	}
+	for i := 0; ; i++ {
+		state, version, err := app.getWindow(ctx, f.key)
+		if err != nil {
+			return fmt.Errorf("flushed: %w", err)
+		}
+		if state.Token != f.token {
+			return nil
+		}
+		var rest []string
+		for _, id := range state.Members {
+			if !emitted[id] {
+				rest = append(rest, id)
+			}
+		}
+		state.Members = rest
+		delay := app.flushDelay()
+		if len(rest) == 0 {
+			// the next message of the window schedules a new flush.
+			state.Token = ""
+			state.FlushAt = 0
+		} else {
+			state.FlushAt = flextime.Now().Add(delay).UnixMilli()
+		}
+		err = app.putWindow(ctx, f.key, f.emitTime, state, version)
+		if errors.Is(err, ErrStateConflict) && i+1 < maxStateConflicts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("flushed: window record %s: %w", f.key, err)
+		}
+		if len(rest) == 0 {
+			return nil
+		}
+		app.logf("[info][%s] %d messages joined emit window %s of %s during the flush", *f.msg.MessageId, len(rest), f.emitTime, f.dest)
+		return app.holdMessage(ctx, f.msg, delay)
+	}
+}
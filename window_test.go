@@ -0,0 +1,191 @@
+package sqpulser_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/sqpulser"
+	"github.com/stretchr/testify/require"
+)
+
+// flushMessages returns the flush messages sent to the incoming queue as received messages.
+func flushMessages(client *fakeSQSClient) []types.Message {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	var msgs []types.Message
+	for i, input := range client.sent {
+		if _, ok := input.MessageAttributes[sqpulser.FlushAttributeKey]; !ok {
+			continue
+		}
+		msg := newTestMessage(fmt.Sprintf("flush-%d", i), *input.MessageBody, flextime.Now().UnixMilli(), input.MessageAttributes)
+		if input.MessageGroupId != nil {
+			msg.Attributes["MessageGroupId"] = *input.MessageGroupId
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestHandleMessagesAggregateFlushFailure(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		AggregateFormat:  sqpulser.AggregateFormatJSON,
+		StateStore:       sqpulser.NewMemoryStateStore(),
+	})
+	require.NoError(t, err)
+	sentTimestamp := Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli()
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", sentTimestamp, nil),
+	})
+	require.Equal(t, []error{nil}, errs)
+	flushes := flushMessages(client)
+	require.Len(t, flushes, 1)
+
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")))
+	client.batchErr = errors.New("something wrong")
+	errs = app.HandleMessages(context.Background(), flushes)
+	require.Error(t, errs[0])
+
+	// the buffered messages are kept until the flush succeeds.
+	client.batchErr = nil
+	errs = app.HandleMessages(context.Background(), flushes)
+	require.Equal(t, []error{nil}, errs)
+	require.Len(t, client.sent, 2)
+	require.Equal(t, "1", *client.sent[1].MessageAttributes[sqpulser.AggregatedMessageCountAttributeKey].StringValue)
+}
+
+func TestHandleMessagesAggregateForgedFlush(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		AggregateFormat:  sqpulser.AggregateFormatJSON,
+		StateStore:       sqpulser.NewMemoryStateStore(),
+	})
+	require.NoError(t, err)
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, []error{nil}, errs)
+	flushes := flushMessages(client)
+	require.Len(t, flushes, 1)
+
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")))
+	forged := flushes[0]
+	forged.Body = aws.String("forged")
+	errs = app.HandleMessages(context.Background(), []types.Message{forged})
+	require.Equal(t, []error{nil}, errs)
+	require.Len(t, client.sent, 1)
+}
+
+func TestHandleMessagesAggregateBufferedBeforeFlush(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		AggregateFormat:  sqpulser.AggregateFormatJSON,
+		// the members are read by the strongly consistent get of the window record, not by an index of the table.
+		StateTable:     "sqpulser-state",
+		DynamoDBClient: &fakeDynamoDBClient{},
+	})
+	require.NoError(t, err)
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, []error{nil}, errs)
+
+	// buffered just before the flush.
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")))
+	errs = app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T21:25:00Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, []error{nil}, errs)
+	flushes := flushMessages(client)
+	require.Len(t, flushes, 1)
+
+	errs = app.HandleMessages(context.Background(), flushes)
+	require.Equal(t, []error{nil}, errs)
+	require.Len(t, client.sent, 2)
+	require.Equal(t, "2", *client.sent[1].MessageAttributes[sqpulser.AggregatedMessageCountAttributeKey].StringValue)
+}
+
+func TestHandleMessagesAggregateJoinDuringFlush(t *testing.T) {
+	restore := flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:31:00Z")))
+	defer restore()
+
+	client := &fakeSQSClient{}
+	app, err := sqpulser.NewWithClient(context.Background(), client, &sqpulser.Option{
+		IncomingQueueURL: testIncomingQueueURL,
+		OutgoingQueueURL: testOutgoingQueueURL,
+		EmitInterval:     15 * time.Minute,
+		AggregateFormat:  sqpulser.AggregateFormatJSON,
+		StateStore:       sqpulser.NewMemoryStateStore(),
+	})
+	require.NoError(t, err)
+	errs := app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-1", "body-1", Must(time.Parse(time.RFC3339, "2018-12-17T21:20:00Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, []error{nil}, errs)
+	flushes := flushMessages(client)
+	require.Len(t, flushes, 1)
+
+	// msg-2 joins the window while the members loaded by the flush are emitted.
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:32:00Z")))
+	var joinErrs []error
+	client.sendHook = func() {
+		client.sendHook = nil
+		joinErrs = app.HandleMessages(context.Background(), []types.Message{
+			newTestMessage("msg-2", "body-2", Must(time.Parse(time.RFC3339, "2018-12-17T21:25:00Z")).UnixMilli(), nil),
+		})
+	}
+	errs = app.HandleMessages(context.Background(), flushes)
+	require.Equal(t, []error{nil}, joinErrs)
+	require.ErrorIs(t, errs[0], sqpulser.ErrMessageHeld)
+	require.Len(t, client.sent, 2)
+	require.Equal(t, "1", *client.sent[1].MessageAttributes[sqpulser.AggregatedMessageCountAttributeKey].StringValue)
+	// the flush message is held to flush msg-2 after the flush delay, instead of a new flush message.
+	require.Len(t, client.changed, 1)
+	require.EqualValues(t, 60, client.changed[0].VisibilityTimeout)
+	require.Len(t, flushMessages(client), 1)
+
+	flextime.Fix(Must(time.Parse(time.RFC3339, "2018-12-17T21:33:00Z")))
+	errs = app.HandleMessages(context.Background(), flushes)
+	require.Equal(t, []error{nil}, errs)
+	require.Len(t, client.sent, 3)
+	require.Equal(t, "1", *client.sent[2].MessageAttributes[sqpulser.AggregatedMessageCountAttributeKey].StringValue)
+	entries, err := sqpulser.AggregateFormatJSON.DecodeAggregatedBody(*client.sent[2].MessageBody)
+	require.NoError(t, err)
+	require.Equal(t, "msg-2", entries[0].MessageID)
+
+	// the window is flushed only once.
+	errs = app.HandleMessages(context.Background(), flushes)
+	require.Equal(t, []error{nil}, errs)
+	require.Len(t, client.sent, 3)
+
+	// the next message of the window schedules a new flush.
+	errs = app.HandleMessages(context.Background(), []types.Message{
+		newTestMessage("msg-3", "body-3", Must(time.Parse(time.RFC3339, "2018-12-17T21:26:00Z")).UnixMilli(), nil),
+	})
+	require.Equal(t, []error{nil}, errs)
+	require.Len(t, flushMessages(client), 2)
+}